@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+)
+
+// runBackup writes a snapshot of the configured store, encrypted with
+// backup.passphrase if one is set. Without -out it is saved in backup.dir
+// and old backups are rotated like scheduled ones. A running proxy keeps
+// the Bolt file locked, so use the admin endpoint or scheduled backups
+// while it is up.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	out := fs.String("out", "", "Write the backup to this file instead of backup.dir")
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatalf("load config: %v", err)
+	}
+	store, err := openFileStore(cfg.Storage.Driver, cfg.Storage.Path)
+	if err != nil {
+		fatalf("open store: %v", err)
+	}
+	defer store.Close()
+	backupSvc := service.NewBackupService(store, cfg)
+
+	ctx := context.Background()
+	if *out == "" {
+		path, err := backupSvc.Create(ctx)
+		if err != nil {
+			fatalf("backup: %v", err)
+		}
+		fmt.Println(path)
+		return
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fatalf("create backup file: %v", err)
+	}
+	_, _, err = backupSvc.Write(ctx, f, "")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		fatalf("backup: %v", err)
+	}
+	fmt.Println(*out)
+}
+
+// runRestore replaces the configured database with a backup. The snapshot
+// is decrypted and verified in a temporary file first, and the current
+// database is kept next to it with a .pre-restore suffix. The proxy must be
+// stopped: restore takes the store lock and refuses to run while the proxy
+// holds it, unless -force is given.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	in := fs.String("in", "", "Backup file to restore")
+	force := fs.Bool("force", false, "Restore even if the store lock is held by another process")
+	fs.Parse(args)
+	if *in == "" {
+		fatalf("restore: -in is required")
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatalf("load config: %v", err)
+	}
+	if isMemoryDriver(cfg.Storage.Driver) {
+		fatalf("restore: %v", errMemoryDriver)
+	}
+	path := cfg.Storage.Path
+	// The lock also keeps the proxy from starting halfway through.
+	unlock, err := lockStore(path)
+	switch {
+	case err == nil:
+		defer unlock()
+	case errors.Is(err, errStoreLocked) && *force:
+		fmt.Println("warning: the store lock is held; restoring anyway because of -force")
+	case errors.Is(err, errStoreLocked):
+		fatalf("restore: %v; stop the proxy first, or pass -force if it is not running", err)
+	default:
+		fatalf("lock store: %v", err)
+	}
+	tmpPath := path + ".restore"
+	if err := extractBackup(*in, tmpPath, cfg.Backup.Passphrase); err != nil {
+		os.Remove(tmpPath)
+		fatalf("read backup: %v", err)
+	}
+	if err := verifySnapshot(cfg.Storage.Driver, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		fatalf("backup is not a valid %s database: %v", cfg.Storage.Driver, err)
+	}
+
+	// Opening the live store fails while the proxy holds the Bolt lock.
+	if _, err := os.Stat(path); err == nil {
+		store, err := openFileStore(cfg.Storage.Driver, path)
+		if err != nil {
+			os.Remove(tmpPath)
+			fatalf("open current store (is the proxy still running?): %v", err)
+		}
+		store.Close()
+		// SQLite side files belong to the old database and must move with it.
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			if err := os.Rename(path+suffix, path+".pre-restore"+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				os.Remove(tmpPath)
+				fatalf("keep current database: %v", err)
+			}
+		}
+		fmt.Printf("previous database kept at %s\n", path+".pre-restore")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		fatalf("replace database: %v", err)
+	}
+
+	store, err := openFileStore(cfg.Storage.Driver, path)
+	if err != nil {
+		fatalf("open restored store: %v", err)
+	}
+	defer store.Close()
+	devices, err := store.ListDevices(context.Background())
+	if err != nil {
+		fatalf("read restored store: %v", err)
+	}
+	fmt.Printf("restored %s: %d devices\n", path, len(devices))
+}
+
+// extractBackup copies the backup at src to dst, decrypting it if needed.
+// Without a configured passphrase one is read from stdin.
+func extractBackup(src, dst, passphrase string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	var r io.Reader = br
+	if crypto.IsEncrypted(br) {
+		if passphrase == "" {
+			if passphrase, err = readPassword("Passphrase: "); err != nil {
+				return err
+			}
+		}
+		if r, err = crypto.NewDecryptReader(r, passphrase); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/bolt"
+)
+
+// runImportBarkServer adopts the devices of a bark-server database so users
+// don't have to register again, and writes a handout with each device's new
+// encryption settings.
+func runImportBarkServer(args []string) {
+	fs := flag.NewFlagSet("import-bark-server", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	dbPath := fs.String("db", "bark.db", "Path of the bark-server database")
+	report := fs.String("report", "", "Write the handout report to this file (default stdout)")
+	format := fs.String("format", "text", "Report format: text, csv or json")
+	dryRun := fs.Bool("dry-run", false, "List what would be imported without writing")
+	fs.Parse(args)
+
+	write, ok := handoutWriters[*format]
+	if !ok {
+		fatalf("unknown report format %q", *format)
+	}
+	entries, err := bolt.ReadBarkServerDevices(*dbPath)
+	if err != nil {
+		fatalf("read bark-server database: %v", err)
+	}
+
+	deviceSvc, store := openDeviceService(*configPath)
+	defer store.Close()
+	result, err := deviceSvc.ImportBarkServer(cliContext(), entries, *dryRun)
+	if err != nil {
+		fatalf("import devices: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *report != "" {
+		// The handout holds encryption keys.
+		f, err := os.OpenFile(*report, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			fatalf("create report: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := write(w, result); err != nil {
+		fatalf("write report: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "%d devices: %d created, %d skipped, %d failed\n", result.Total, result.Created, result.Skipped, result.Failed)
+}
+
+var handoutWriters = map[string]func(io.Writer, *service.BarkServerImportReport) error{
+	"text": writeHandoutText,
+	"csv":  writeHandoutCSV,
+	"json": func(w io.Writer, report *service.BarkServerImportReport) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	},
+}
+
+// writeHandoutText prints one block per created device that can be passed
+// to its owner as is, followed by the devices that were not imported.
+func writeHandoutText(w io.Writer, report *service.BarkServerImportReport) error {
+	var skipped []service.DeviceHandout
+	for _, d := range report.Devices {
+		if d.Action != service.ImportCreate {
+			skipped = append(skipped, d)
+			continue
+		}
+		fmt.Fprintf(w, "Device key: %s\n", d.DeviceKey)
+		if report.DryRun {
+			fmt.Fprintf(w, "  (dry run, no key generated)\n\n")
+			continue
+		}
+		fmt.Fprintf(w, "  Enter in Bark > Settings > Encryption:\n")
+		fmt.Fprintf(w, "  Algorithm: %s\n  Mode:      %s\n  Padding:   %s\n  Key:       %s\n  IV:        %s\n\n", d.Algorithm, d.Mode, d.Padding, d.EncodeKey, d.IV)
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "Not imported:\n")
+		for _, d := range skipped {
+			fmt.Fprintf(w, "  %s (%s): %s\n", d.DeviceKey, d.DeviceToken, d.Reason)
+		}
+	}
+	return nil
+}
+
+func writeHandoutCSV(w io.Writer, report *service.BarkServerImportReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"deviceKey", "deviceToken", "action", "reason", "algorithm", "model", "padding", "encodeKey", "iv"})
+	for _, d := range report.Devices {
+		cw.Write([]string{d.DeviceKey, d.DeviceToken, d.Action, d.Reason, d.Algorithm, d.Mode, d.Padding, d.EncodeKey, d.IV})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// openDeviceService opens the configured store for the device commands.
+// Devices are not registered with Bark from the command line, so no Bark
+// client is set up.
+func openDeviceService(configPath string) (*service.DeviceService, storage.Store) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fatalf("load config: %v", err)
+	}
+	store, err := openFileStore(cfg.Storage.Driver, cfg.Storage.Path)
+	if err != nil {
+		fatalf("open store: %v", err)
+	}
+	return service.NewDeviceService(store, cfg, nil, service.NewAuditService(store)), store
+}
+
+// cliContext attributes audit entries written by commands to "cli".
+func cliContext() context.Context {
+	return service.WithActor(context.Background(), "cli", "")
+}
+
+// runExportDevices writes every device, keys included, as JSON or CSV.
+func runExportDevices(args []string) {
+	fs := flag.NewFlagSet("export-devices", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	format := fs.String("format", service.DeviceFormatJSON, "Output format: json or csv")
+	out := fs.String("out", "", "Output file (default stdout)")
+	fs.Parse(args)
+
+	deviceSvc, store := openDeviceService(*configPath)
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			fatalf("create output file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := deviceSvc.Export(cliContext(), w, *format)
+	if err != nil {
+		fatalf("export devices: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d devices\n", n)
+}
+
+// runImportDevices reads devices from a file and prints the import report
+// as JSON.
+func runImportDevices(args []string) {
+	fs := flag.NewFlagSet("import-devices", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	format := fs.String("format", service.DeviceFormatJSON, "Input format: json, csv or bark-api")
+	conflict := fs.String("conflict", service.ConflictSkip, "Existing devices: skip, overwrite or merge")
+	dryRun := fs.Bool("dry-run", false, "Report what would change without writing")
+	in := fs.String("in", "", "Input file (default stdin)")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fatalf("open input file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	devices, err := service.ParseDevices(r, *format)
+	if err != nil {
+		fatalf("read devices: %v", err)
+	}
+
+	deviceSvc, store := openDeviceService(*configPath)
+	defer store.Close()
+	report, err := deviceSvc.Import(cliContext(), devices, service.DeviceImportOptions{Conflict: *conflict, DryRun: *dryRun})
+	if err != nil {
+		fatalf("import devices: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
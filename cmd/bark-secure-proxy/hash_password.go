@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"golang.org/x/term"
+)
+
+// runHashPassword prints the bcrypt hash of a password for auth.password.
+// The password is never taken as an argument, so it does not end up in shell
+// history or the process list: on a terminal it is prompted for without
+// echo, otherwise the first line of stdin is used.
+func runHashPassword(args []string) {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: bark-secure-proxy hash-password (the password is read from the terminal or stdin)")
+		os.Exit(2)
+	}
+	password, err := readPassword("Password: ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read password: %v\n", err)
+		os.Exit(1)
+	}
+	hash, err := service.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
+
+// readPassword prompts on stderr and reads a line from stdin without echoing
+// it when stdin is a terminal.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine("")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+// readLine prompts on stderr and reads one line from stdin.
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
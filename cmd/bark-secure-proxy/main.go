@@ -12,35 +12,113 @@ import (
 	"github.com/bark-labs/bark-secure-proxy/internal/config"
 	"github.com/bark-labs/bark-secure-proxy/internal/server"
 	"github.com/bark-labs/bark-secure-proxy/internal/service"
-	"github.com/bark-labs/bark-secure-proxy/internal/storage/bolt"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		runHashPassword(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-store" {
+		runMigrateStore(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		runBackup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-devices" {
+		runExportDevices(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-devices" {
+		runImportDevices(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-bark-server" {
+		runImportBarkServer(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("config", "config.yaml", "Path to config file")
+	migrateOnly := flag.Bool("migrate-only", false, "Apply pending storage migrations and exit")
+	dryRun := flag.Bool("dry-run", false, "With -migrate-only, report pending migrations without applying them")
 	flag.Parse()
+	if *dryRun && !*migrateOnly {
+		log.Fatalf("-dry-run requires -migrate-only")
+	}
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
 
+	if *migrateOnly {
+		report, err := applyMigrations(cfg.Storage.Driver, cfg.Storage.Path, *dryRun)
+		if err != nil {
+			log.Fatalf("migrate store: %v", err)
+		}
+		printMigrationReport(os.Stdout, report)
+		return
+	}
+
+	if cfg.HTTP.ProxyHeader != "" && len(cfg.HTTP.TrustedProxies) == 0 {
+		log.Printf("http.proxy_header is set but http.trusted_proxies is empty; the header is ignored and clients are identified by their connection address")
+	}
+
 	barkClient, err := barkclient.New(cfg.Bark.BaseURL, cfg.Bark.Token, cfg.Bark.RequestTimeout)
 	if err != nil {
 		log.Fatalf("init bark client: %v", err)
 	}
 
-	store, err := bolt.New(cfg.Storage.Path)
+	if !isMemoryDriver(cfg.Storage.Driver) {
+		unlock, err := lockStore(cfg.Storage.Path)
+		if err != nil {
+			log.Fatalf("lock store: %v", err)
+		}
+		defer unlock()
+	}
+	store, err := openStore(cfg.Storage.Driver, cfg.Storage.Path)
 	if err != nil {
 		log.Fatalf("open store: %v", err)
 	}
 	defer store.Close()
+	if isMemoryDriver(cfg.Storage.Driver) {
+		log.Println("warning: storage driver memory keeps all data in memory; it is lost when the proxy stops")
+	}
 
-	authSvc := service.NewAuthService(cfg)
-	deviceSvc := service.NewDeviceService(store, cfg, barkClient)
+	auditSvc := service.NewAuditService(store)
+	authSvc := service.NewAuthService(store, cfg, auditSvc)
+	if err := authSvc.CheckSecrets(); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+	if err := authSvc.CheckOIDC(); err != nil {
+		log.Fatalf("invalid oidc config: %v", err)
+	}
+	if authSvc.Enabled() {
+		if err := authSvc.EnsureAdmin(context.Background()); err != nil {
+			log.Fatalf("seed admin user: %v", err)
+		}
+	}
+	deviceSvc := service.NewDeviceService(store, cfg, barkClient, auditSvc)
 	noticeSvc := service.NewNoticeService(store, barkClient)
 	logSvc := service.NewNoticeLogService(store, deviceSvc)
+	attachSvc := service.NewAttachmentService(store, cfg)
+	apiKeySvc := service.NewAPIKeyService(store, cfg, auditSvc)
+	backupSvc := service.NewBackupService(store, cfg)
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go attachSvc.Run(bgCtx)
+	go service.NewRetentionService(store, cfg).Run(bgCtx)
+	go backupSvc.Run(bgCtx)
+	go deviceSvc.RunPurge(bgCtx)
 
-	srv := server.New(cfg, store, deviceSvc, noticeSvc, logSvc, authSvc, barkClient)
+	srv := server.New(cfg, store, deviceSvc, noticeSvc, logSvc, authSvc, attachSvc, apiKeySvc, auditSvc, backupSvc, barkClient)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -51,6 +129,7 @@ func main() {
 	// graceful shutdown
 	waitForSignal()
 	log.Println("shutting down...")
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.WriteTimeout)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// runMigrateStore copies devices, push logs, API keys, users and the audit
+// log from one store into a new, empty one, e.g. from the Bolt file into
+// SQLite. Sessions and login counters are transient and are not copied, so
+// users log in again after switching. Broadcast records and attachment
+// metadata are not copied either.
+func runMigrateStore(args []string) {
+	fs := flag.NewFlagSet("migrate-store", flag.ExitOnError)
+	from := fs.String("from", "./data/devices.db", "Path of the store to copy from")
+	fromDriver := fs.String("from-driver", "bolt", "Storage driver of the source store")
+	to := fs.String("to", "./data/devices.sqlite", "Path of the new store")
+	toDriver := fs.String("to-driver", "sqlite", "Storage driver of the new store")
+	fs.Parse(args)
+
+	if *from == *to {
+		fatalf("source and target are the same file")
+	}
+	if info, err := os.Stat(*to); err == nil && info.Size() > 0 {
+		fatalf("target %s already exists; remove it or choose another path", *to)
+	}
+	src, err := openFileStore(*fromDriver, *from)
+	if err != nil {
+		fatalf("open source store: %v", err)
+	}
+	defer src.Close()
+	dst, err := openFileStore(*toDriver, *to)
+	if err != nil {
+		fatalf("open target store: %v", err)
+	}
+	defer dst.Close()
+
+	if err := migrateStore(context.Background(), src, dst); err != nil {
+		fatalf("migrate store: %v", err)
+	}
+}
+
+func migrateStore(ctx context.Context, src, dst storage.Store) error {
+	devices, err := src.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := dst.UpsertDevice(ctx, device); err != nil {
+			return fmt.Errorf("device %s: %w", device.DeviceToken, err)
+		}
+	}
+	fmt.Printf("devices: %d\n", len(devices))
+
+	deleted, err := src.ListDeletedDevices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range deleted {
+		if err := dst.SaveDeletedDevice(ctx, d); err != nil {
+			return fmt.Errorf("deleted device %s: %w", d.Device.DeviceToken, err)
+		}
+	}
+	fmt.Printf("deleted devices: %d\n", len(deleted))
+
+	// Logs get new IDs in the target, so retries are pointed at the new ID
+	// of the log they retried. ListNoticeLogs returns them in ID order, which
+	// puts every original before its retries.
+	logs, err := src.ListNoticeLogs(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make(map[uint64]uint64, len(logs))
+	for _, log := range logs {
+		oldID := log.ID
+		log.ID = 0
+		if log.RetryOf != 0 {
+			log.RetryOf = ids[log.RetryOf]
+		}
+		if err := dst.AppendNoticeLog(ctx, log); err != nil {
+			return fmt.Errorf("log %d: %w", oldID, err)
+		}
+		ids[oldID] = log.ID
+	}
+	fmt.Printf("push logs: %d\n", len(logs))
+
+	keys, err := src.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := dst.SaveAPIKey(ctx, key); err != nil {
+			return fmt.Errorf("api key %s: %w", key.ID, err)
+		}
+	}
+	fmt.Printf("api keys: %d\n", len(keys))
+
+	users, err := src.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := dst.SaveUser(ctx, user); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+	}
+	fmt.Printf("users: %d\n", len(users))
+
+	entries, err := src.ListAuditEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.ID = 0
+		if err := dst.AppendAuditEntry(ctx, entry); err != nil {
+			return fmt.Errorf("audit entry: %w", err)
+		}
+	}
+	fmt.Printf("audit entries: %d\n", len(entries))
+	return nil
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
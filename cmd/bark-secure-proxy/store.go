@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/bolt"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/memory"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/sqlite"
+)
+
+// openStore opens the storage backend selected by storage.driver.
+func openStore(driver, path string) (storage.Store, error) {
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "", "bolt":
+		return bolt.New(path)
+	case "sqlite":
+		return sqlite.New(path)
+	case "memory":
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// errMemoryDriver rejects file operations and offline commands for the
+// memory driver, whose data only lives as long as the proxy process.
+var errMemoryDriver = errors.New("storage driver memory has no database file")
+
+// openFileStore is openStore for the offline commands, which would only see
+// an empty store with the memory driver.
+func openFileStore(driver, path string) (storage.Store, error) {
+	if isMemoryDriver(driver) {
+		return nil, errMemoryDriver
+	}
+	return openStore(driver, path)
+}
+
+func isMemoryDriver(driver string) bool {
+	return strings.EqualFold(strings.TrimSpace(driver), "memory")
+}
+
+// errStoreLocked is returned by lockStore while another process holds the
+// lock.
+var errStoreLocked = errors.New("store is in use by a running proxy")
+
+// lockStore takes the lock file next to the database at path, which the
+// proxy holds for as long as it runs. Bolt locks its own file, but SQLite
+// does not while idle, so restore relies on this lock to tell whether the
+// proxy is still up. The lock is released by unlock or when the process
+// exits, so a crash never leaves it stale.
+func lockStore(path string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// The PID is only there for whoever looks at the file.
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return func() { f.Close() }, nil
+}
+
+// verifySnapshot checks that the file at path is a valid database for
+// driver.
+func verifySnapshot(driver, path string) error {
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "", "bolt":
+		return bolt.Verify(path)
+	case "sqlite":
+		return sqlite.Verify(path)
+	case "memory":
+		return errMemoryDriver
+	default:
+		return fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// applyMigrations brings the database at path up to the schema version of
+// this build, or with dryRun only reports the pending steps.
+func applyMigrations(driver, path string, dryRun bool) (*model.MigrationReport, error) {
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "", "bolt":
+		return bolt.Migrate(path, dryRun)
+	case "sqlite":
+		return sqlite.Migrate(path, dryRun)
+	case "memory":
+		return nil, errMemoryDriver
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+func printMigrationReport(w io.Writer, report *model.MigrationReport) {
+	if len(report.Steps) == 0 {
+		fmt.Fprintf(w, "schema is up to date (version %d)\n", report.From)
+		return
+	}
+	verb := "migrated"
+	if report.DryRun {
+		verb = "would migrate"
+	}
+	fmt.Fprintf(w, "%s schema from version %d to %d:\n", verb, report.From, report.To)
+	for _, step := range report.Steps {
+		fmt.Fprintf(w, "  %d. %s: %s\n", step.Version, step.Description, step.Changes)
+	}
+}
@@ -91,12 +91,11 @@ func (c *Client) Register(ctx context.Context, deviceToken, key string) (*Common
 	return &payload, nil
 }
 
-// SendEncryptedPush posts ciphertext to Bark server push endpoint.
-func (c *Client) SendEncryptedPush(ctx context.Context, deviceKey, ciphertext, iv string) (*CommonResponse[struct{}], error) {
-	body, err := json.Marshal(map[string]string{
-		"ciphertext": ciphertext,
-		"iv":         iv,
-	})
+// SendEncryptedPush posts ciphertext to Bark server push endpoint. Extra
+// params travel in plaintext next to the ciphertext for options bark-server
+// itself must see, such as the notification id or delete flag.
+func (c *Client) SendEncryptedPush(ctx context.Context, deviceKey, ciphertext, iv string, params map[string]string) (*CommonResponse[struct{}], error) {
+	body, err := EncryptedPushBody(ciphertext, iv, params)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +120,20 @@ func (c *Client) SendEncryptedPush(ctx context.Context, deviceKey, ciphertext, i
 	return &payload, nil
 }
 
+// EncryptedPushBody builds the JSON body SendEncryptedPush posts to Bark.
+func EncryptedPushBody(ciphertext, iv string, params map[string]string) ([]byte, error) {
+	fields := map[string]string{
+		"ciphertext": ciphertext,
+		"iv":         iv,
+	}
+	for k, v := range params {
+		if _, reserved := fields[k]; !reserved && v != "" {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
 func (c *Client) resolve(p string) string {
 	u := *c.baseURL
 	u.Path = path.Join(c.baseURL.Path, p)
@@ -14,6 +14,13 @@ type Config struct {
 		Addr         string        `mapstructure:"addr"`
 		ReadTimeout  time.Duration `mapstructure:"read_timeout"`
 		WriteTimeout time.Duration `mapstructure:"write_timeout"`
+		// ProxyHeader names the header carrying the client IP when running
+		// behind a reverse proxy, e.g. X-Forwarded-For.
+		ProxyHeader string `mapstructure:"proxy_header"`
+		// TrustedProxies lists the proxy IPs or CIDR ranges whose
+		// ProxyHeader is believed. The header from any other peer is
+		// ignored, so clients cannot pick their own IP.
+		TrustedProxies []string `mapstructure:"trusted_proxies"`
 	} `mapstructure:"http"`
 	Bark struct {
 		BaseURL        string        `mapstructure:"base_url"`
@@ -21,8 +28,39 @@ type Config struct {
 		RequestTimeout time.Duration `mapstructure:"request_timeout"`
 	} `mapstructure:"bark"`
 	Storage struct {
-		Path string `mapstructure:"path"`
+		Driver string `mapstructure:"driver"`
+		Path   string `mapstructure:"path"`
 	} `mapstructure:"storage"`
+	LogRetention struct {
+		Interval   time.Duration `mapstructure:"interval"`
+		MaxAge     time.Duration `mapstructure:"max_age"`
+		MaxEntries int           `mapstructure:"max_entries"`
+		// Statuses overrides the limits for logs with a given status, e.g.
+		// keep FAILED entries longer than SUCCESS ones.
+		Statuses map[string]RetentionRule `mapstructure:"statuses"`
+	} `mapstructure:"log_retention"`
+	Audit struct {
+		// MaxAge deletes audit entries older than this on the log
+		// retention schedule; zero keeps them forever.
+		MaxAge time.Duration `mapstructure:"max_age"`
+	} `mapstructure:"audit"`
+	Backup struct {
+		Dir      string        `mapstructure:"dir"`
+		Interval time.Duration `mapstructure:"interval"`
+		Keep     int           `mapstructure:"keep"`
+		// Passphrase encrypts scheduled backups and is the default for the
+		// backup endpoint and CLI. Empty writes plain snapshots.
+		Passphrase string `mapstructure:"passphrase"`
+	} `mapstructure:"backup"`
+	Devices struct {
+		// RestoreWindow keeps deleted devices restorable for this long
+		// before they are purged; zero deletes them immediately.
+		RestoreWindow time.Duration `mapstructure:"restore_window"`
+		PurgeInterval time.Duration `mapstructure:"purge_interval"`
+		// DeletedLogs is what happens to a deleted device's push logs unless
+		// the request says otherwise: keep, purge or anonymize.
+		DeletedLogs string `mapstructure:"deleted_logs"`
+	} `mapstructure:"devices"`
 	Crypto struct {
 		DefaultAlgorithm string `mapstructure:"default_algorithm"`
 		DefaultMode      string `mapstructure:"default_mode"`
@@ -33,14 +71,78 @@ type Config struct {
 	Frontend struct {
 		Dir string `mapstructure:"dir"`
 	} `mapstructure:"frontend"`
+	Attachments struct {
+		Dir           string        `mapstructure:"dir"`
+		MaxSize       int64         `mapstructure:"max_size"`
+		AllowedTypes  []string      `mapstructure:"allowed_types"`
+		TTL           time.Duration `mapstructure:"ttl"`
+		GCInterval    time.Duration `mapstructure:"gc_interval"`
+		PublicBaseURL string        `mapstructure:"public_base_url"`
+	} `mapstructure:"attachments"`
+	APIKeys struct {
+		Strict          bool          `mapstructure:"strict"`
+		SignatureWindow time.Duration `mapstructure:"signature_window"`
+	} `mapstructure:"api_keys"`
+	RateLimit struct {
+		Enabled bool                      `mapstructure:"enabled"`
+		Groups  map[string]RateLimitGroup `mapstructure:"groups"`
+	} `mapstructure:"rate_limit"`
 	Auth struct {
 		Enabled   bool   `mapstructure:"enabled"`
 		Username  string `mapstructure:"username"`
 		Password  string `mapstructure:"password"`
 		JWTSecret string `mapstructure:"jwt_secret"`
+		// PreviousJWTSecrets still verify tokens after jwt_secret is rotated.
+		PreviousJWTSecrets []string      `mapstructure:"previous_jwt_secrets"`
+		AccessTokenTTL     time.Duration `mapstructure:"access_token_ttl"`
+		RefreshTokenTTL    time.Duration `mapstructure:"refresh_token_ttl"`
+		Lockout            struct {
+			Enabled         bool          `mapstructure:"enabled"`
+			FreeAttempts    int           `mapstructure:"free_attempts"`
+			BaseDelay       time.Duration `mapstructure:"base_delay"`
+			MaxDelay        time.Duration `mapstructure:"max_delay"`
+			MaxUserFailures int           `mapstructure:"max_user_failures"`
+			MaxIPFailures   int           `mapstructure:"max_ip_failures"`
+			Duration        time.Duration `mapstructure:"duration"`
+			ResetAfter      time.Duration `mapstructure:"reset_after"`
+		} `mapstructure:"lockout"`
+		OIDC struct {
+			Enabled       bool              `mapstructure:"enabled"`
+			Issuer        string            `mapstructure:"issuer"`
+			ClientID      string            `mapstructure:"client_id"`
+			ClientSecret  string            `mapstructure:"client_secret"`
+			RedirectURL   string            `mapstructure:"redirect_url"`
+			Scopes        []string          `mapstructure:"scopes"`
+			UsernameClaim string            `mapstructure:"username_claim"`
+			GroupsClaim   string            `mapstructure:"groups_claim"`
+			AllowedGroups []string          `mapstructure:"allowed_groups"`
+			RoleMapping   map[string]string `mapstructure:"role_mapping"`
+			DefaultRole   string            `mapstructure:"default_role"`
+		} `mapstructure:"oidc"`
 	} `mapstructure:"auth"`
 }
 
+// RetentionRule limits how long and how many push logs are kept. Zero
+// values keep logs forever.
+type RetentionRule struct {
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	MaxEntries int           `mapstructure:"max_entries"`
+}
+
+// RateLimitGroup holds the token buckets applied to one route group.
+type RateLimitGroup struct {
+	PerIP     RateLimitRule `mapstructure:"per_ip"`
+	PerAPIKey RateLimitRule `mapstructure:"per_api_key"`
+	Total     RateLimitRule `mapstructure:"total"`
+}
+
+// RateLimitRule is a token bucket refilled at Rate tokens per second and
+// holding at most Burst tokens. A zero Rate disables the rule.
+type RateLimitRule struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
 // Load reads the configuration from disk/environment using Viper.
 func Load(path string) (*Config, error) {
 	v := viper.New()
@@ -70,12 +172,29 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("http.addr", ":8090")
 	v.SetDefault("http.read_timeout", "15s")
 	v.SetDefault("http.write_timeout", "30s")
+	v.SetDefault("http.proxy_header", "")
+	v.SetDefault("http.trusted_proxies", []string{})
 
 	v.SetDefault("bark.base_url", "http://127.0.0.1:8080")
 	v.SetDefault("bark.request_timeout", "10s")
 
+	v.SetDefault("storage.driver", "bolt")
 	v.SetDefault("storage.path", "./data/devices.db")
 
+	v.SetDefault("log_retention.interval", "1h")
+	v.SetDefault("log_retention.max_age", "0s")
+	v.SetDefault("log_retention.max_entries", 0)
+	v.SetDefault("audit.max_age", "0s")
+
+	v.SetDefault("backup.dir", "./data/backups")
+	v.SetDefault("backup.interval", "0s")
+	v.SetDefault("backup.keep", 7)
+	v.SetDefault("backup.passphrase", "")
+
+	v.SetDefault("devices.restore_window", "168h")
+	v.SetDefault("devices.purge_interval", "1h")
+	v.SetDefault("devices.deleted_logs", "keep")
+
 	v.SetDefault("crypto.default_algorithm", "AES")
 	v.SetDefault("crypto.default_mode", "CBC")
 	v.SetDefault("crypto.default_padding", "PKCS7Padding")
@@ -84,8 +203,59 @@ func setDefaults(v *viper.Viper) {
 
 	v.SetDefault("frontend.dir", "./web")
 
+	v.SetDefault("attachments.dir", "./data/attachments")
+	v.SetDefault("attachments.max_size", 5*1024*1024)
+	v.SetDefault("attachments.allowed_types", []string{"image/png", "image/jpeg", "image/gif", "image/webp"})
+	v.SetDefault("attachments.ttl", "72h")
+	v.SetDefault("attachments.gc_interval", "10m")
+	v.SetDefault("attachments.public_base_url", "")
+
+	v.SetDefault("api_keys.strict", false)
+	v.SetDefault("api_keys.signature_window", "5m")
+
+	v.SetDefault("rate_limit.enabled", true)
+	v.SetDefault("rate_limit.groups.notice.per_ip.rate", 5)
+	v.SetDefault("rate_limit.groups.notice.per_ip.burst", 20)
+	v.SetDefault("rate_limit.groups.notice.per_api_key.rate", 10)
+	v.SetDefault("rate_limit.groups.notice.per_api_key.burst", 50)
+	v.SetDefault("rate_limit.groups.notice.total.rate", 50)
+	v.SetDefault("rate_limit.groups.notice.total.burst", 200)
+	v.SetDefault("rate_limit.groups.register.per_ip.rate", 1)
+	v.SetDefault("rate_limit.groups.register.per_ip.burst", 10)
+	v.SetDefault("rate_limit.groups.register.total.rate", 10)
+	v.SetDefault("rate_limit.groups.register.total.burst", 50)
+	v.SetDefault("rate_limit.groups.device.per_ip.rate", 5)
+	v.SetDefault("rate_limit.groups.device.per_ip.burst", 20)
+	v.SetDefault("rate_limit.groups.device.per_api_key.rate", 10)
+	v.SetDefault("rate_limit.groups.device.per_api_key.burst", 50)
+	v.SetDefault("rate_limit.groups.oidc.per_ip.rate", 1)
+	v.SetDefault("rate_limit.groups.oidc.per_ip.burst", 10)
+	v.SetDefault("rate_limit.groups.oidc.total.rate", 10)
+	v.SetDefault("rate_limit.groups.oidc.total.burst", 50)
+
 	v.SetDefault("auth.enabled", true)
 	v.SetDefault("auth.username", "admin")
 	v.SetDefault("auth.password", "admin123")
 	v.SetDefault("auth.jwt_secret", "change-me-secret")
+	v.SetDefault("auth.previous_jwt_secrets", []string{})
+	v.SetDefault("auth.access_token_ttl", "15m")
+	v.SetDefault("auth.refresh_token_ttl", "168h")
+	v.SetDefault("auth.lockout.enabled", true)
+	v.SetDefault("auth.lockout.free_attempts", 3)
+	v.SetDefault("auth.lockout.base_delay", "1s")
+	v.SetDefault("auth.lockout.max_delay", "30s")
+	v.SetDefault("auth.lockout.max_user_failures", 10)
+	v.SetDefault("auth.lockout.max_ip_failures", 30)
+	v.SetDefault("auth.lockout.duration", "15m")
+	v.SetDefault("auth.lockout.reset_after", "1h")
+	v.SetDefault("auth.oidc.enabled", false)
+	v.SetDefault("auth.oidc.issuer", "")
+	v.SetDefault("auth.oidc.client_id", "")
+	v.SetDefault("auth.oidc.client_secret", "")
+	v.SetDefault("auth.oidc.redirect_url", "")
+	v.SetDefault("auth.oidc.scopes", []string{"openid", "profile", "email", "groups"})
+	v.SetDefault("auth.oidc.username_claim", "preferred_username")
+	v.SetDefault("auth.oidc.groups_claim", "groups")
+	v.SetDefault("auth.oidc.allowed_groups", []string{})
+	v.SetDefault("auth.oidc.default_role", "")
 }
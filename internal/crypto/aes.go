@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
 )
@@ -27,6 +28,18 @@ func GenerateString(n int) (string, error) {
 	return string(b), nil
 }
 
+// RandomToken returns n random bytes encoded as a URL-safe hex string.
+func RandomToken(n int) (string, error) {
+	if n <= 0 {
+		return "", errors.New("length must be positive")
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 // EncryptToBase64 encrypts data with AES-CBC and returns base64 ciphertext.
 func EncryptToBase64(plaintext []byte, key []byte, iv []byte) (string, error) {
 	block, err := aes.NewCipher(key)
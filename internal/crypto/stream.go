@@ -0,0 +1,226 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted streams start with streamMagic, a random salt and nonce prefix,
+// followed by AES-256-GCM sealed chunks. Each chunk is a 4-byte length and
+// the sealed bytes; its nonce is the prefix plus a chunk counter, and the
+// last chunk is sealed with a different additional-data byte so truncation
+// is detected. The key is derived from the passphrase with scrypt.
+var streamMagic = []byte("BSPENC01")
+
+const (
+	streamChunkSize = 64 << 10
+	streamSaltSize  = 16
+	streamPrefixLen = 4
+)
+
+var (
+	// ErrNotEncrypted is returned by NewDecryptReader for plain input.
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	// ErrDecrypt is returned for a wrong passphrase or corrupted data.
+	ErrDecrypt = errors.New("decryption failed: wrong passphrase or corrupted data")
+)
+
+func streamKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, n uint64) []byte {
+	nonce := make([]byte, streamPrefixLen+8)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[streamPrefixLen:], n)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint64
+	buf    []byte
+	err    error
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// with passphrase and writes the result to w. Close must be called to write
+// the final chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	header := make([]byte, len(streamMagic)+streamSaltSize+streamPrefixLen)
+	copy(header, streamMagic)
+	if _, err := io.ReadFull(rand.Reader, header[len(streamMagic):]); err != nil {
+		return nil, err
+	}
+	salt := header[len(streamMagic) : len(streamMagic)+streamSaltSize]
+	aead, err := streamKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: header[len(streamMagic)+streamSaltSize:],
+		buf:    make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the last
+		// chunk is always the one sealed by Close.
+		if len(e.buf) == streamChunkSize {
+			if e.err = e.flush(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):streamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.n), e.buf, chunkAD(last))
+	e.n++
+	e.buf = e.buf[:0]
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := e.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if err := e.flush(true); err != nil {
+		e.err = err
+		return err
+	}
+	e.err = errors.New("write to closed encrypt writer")
+	return nil
+}
+
+// IsEncrypted reports whether r starts with the encrypted stream header. It
+// peeks without consuming input.
+func IsEncrypted(r *bufio.Reader) bool {
+	head, err := r.Peek(len(streamMagic))
+	return err == nil && bytes.Equal(head, streamMagic)
+}
+
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint64
+	buf    []byte
+	done   bool
+}
+
+// NewDecryptReader returns a reader over the plaintext of an encrypted
+// stream. Reading fails with ErrDecrypt if the passphrase is wrong or the
+// data was modified or truncated.
+func NewDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+streamSaltSize+streamPrefixLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return nil, ErrNotEncrypted
+	}
+	aead, err := streamKey(passphrase, header[len(streamMagic):len(streamMagic)+streamSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, prefix: header[len(streamMagic)+streamSaltSize:]}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		// The stream ended without its final chunk.
+		return ErrDecrypt
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(d.aead.Overhead()) || n > streamChunkSize+uint32(d.aead.Overhead()) {
+		return ErrDecrypt
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return ErrDecrypt
+	}
+	nonce := chunkNonce(d.prefix, d.n)
+	d.n++
+	// Open clears its output on failure, so it must not overwrite sealed
+	// before the second attempt.
+	if plain, err := d.aead.Open(nil, nonce, sealed, chunkAD(false)); err == nil {
+		d.buf = plain
+		return nil
+	}
+	plain, err := d.aead.Open(nil, nonce, sealed, chunkAD(true))
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.buf = plain
+	d.done = true
+	// Anything after the final chunk means the file was tampered with.
+	if _, err := io.ReadFull(d.r, make([]byte, 1)); err != io.EOF {
+		return ErrDecrypt
+	}
+	return nil
+}
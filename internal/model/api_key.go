@@ -0,0 +1,68 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// API key scopes.
+const (
+	ScopeSend        = "send"
+	ScopeDeviceRead  = "device:read"
+	ScopeDeviceWrite = "device:write"
+)
+
+// APIKey is a sender credential for the Bark-compatible endpoints. Only a
+// hash of the secret is stored; the plaintext is shown once at creation.
+type APIKey struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	SecretHash string `json:"secretHash,omitempty"`
+	// SigningSecret is the HMAC secret for signed requests. Unlike the key
+	// itself it must be kept in plaintext to verify signatures.
+	SigningSecret string     `json:"signingSecret,omitempty"`
+	Scopes        []string   `json:"scopes"`
+	Devices       []string   `json:"devices,omitempty"`
+	Groups        []string   `json:"groups,omitempty"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt    *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// Expired reports whether the key is past its expiry.
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// HasScope reports whether the key grants scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDevice reports whether deviceKey is within the key's device list;
+// an empty list allows every device.
+func (k *APIKey) AllowsDevice(deviceKey string) bool {
+	return len(k.Devices) == 0 || containsFold(k.Devices, deviceKey)
+}
+
+// AllowsGroup reports whether group is within the key's topic list; an empty
+// list allows every group.
+func (k *APIKey) AllowsGroup(group string) bool {
+	return len(k.Groups) == 0 || containsFold(k.Groups, group)
+}
+
+func containsFold(values []string, target string) bool {
+	target = strings.TrimSpace(target)
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// Attachment describes an uploaded image/icon hosted by the proxy.
+type Attachment struct {
+	ID          string    `json:"id"`
+	FileName    string    `json:"fileName"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	URL         string    `json:"url,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Expired reports whether the attachment should no longer be served.
+func (a *Attachment) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
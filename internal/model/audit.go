@@ -0,0 +1,72 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// AuditEntry records one administrative change: who did what to which
+// object, and how the object changed.
+type AuditEntry struct {
+	ID     uint64 `json:"id"`
+	Actor  string `json:"actor"`
+	Role   string `json:"role,omitempty"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	// Changes holds the fields that differ between the object before and
+	// after the action. Secret fields only record that they changed.
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+	// Meta describes actions that are not a change to one object, such as
+	// how many sessions were revoked or devices exported.
+	Meta      map[string]any `json:"meta,omitempty"`
+	IP        string         `json:"ip,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// AuditChange is the old and new value of one field.
+type AuditChange struct {
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+// AuditFilter describes query parameters for the audit trail. Action
+// matches as a prefix, so "user" selects user.create, user.update, ...
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	Target    string
+	BeginTime *time.Time
+	EndTime   *time.Time
+	Page      int
+	PageSize  int
+}
+
+// AuditPage is one page of audit entries, newest first.
+type AuditPage struct {
+	Data     []*AuditEntry `json:"data"`
+	Total    int           `json:"total"`
+	Pages    int           `json:"pages"`
+	PageNum  int           `json:"pageNum"`
+	PageSize int           `json:"pageSize"`
+}
+
+// Matches reports whether entry passes the actor, action, target and time
+// conditions of f. Paging is left to the caller.
+func (f AuditFilter) Matches(entry *AuditEntry) bool {
+	if f.Actor != "" && !strings.EqualFold(entry.Actor, f.Actor) {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(entry.Action, f.Action) {
+		return false
+	}
+	if f.Target != "" && !strings.Contains(entry.Target, f.Target) {
+		return false
+	}
+	if f.BeginTime != nil && entry.CreatedAt.Before(*f.BeginTime) {
+		return false
+	}
+	if f.EndTime != nil && entry.CreatedAt.After(*f.EndTime) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// DeletedDevice is a soft-deleted device. It no longer receives pushes and
+// can be restored until PurgeAt, when LogPolicy is applied to its push logs
+// and the record is dropped.
+type DeletedDevice struct {
+	Device    *Device   `json:"device"`
+	LogPolicy string    `json:"logPolicy"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+// What happens to a deleted device's push logs.
+const (
+	DeviceLogsKeep      = "keep"
+	DeviceLogsPurge     = "purge"
+	DeviceLogsAnonymize = "anonymize"
+)
+
+// AnonymizedDeviceKey replaces the device key of anonymized push logs, so
+// they still count towards statistics without naming the device.
+const AnonymizedDeviceKey = "(deleted)"
@@ -20,4 +20,8 @@ type Device struct {
 const (
 	DeviceStatusActive = "ACTIVE"
 	DeviceStatusStop   = "STOP"
+	// DeviceStatusPending marks a device whose encryption key has been
+	// generated but not yet entered in the Bark app. It gets no broadcasts
+	// until it is activated.
+	DeviceStatusPending = "PENDING"
 )
@@ -0,0 +1,51 @@
+package model
+
+import "time"
+
+// Login attempt counters are kept per username and client IP, per username
+// across all IPs, and per client IP.
+const (
+	LoginAttemptUser    = "user"
+	LoginAttemptAccount = "account"
+	LoginAttemptIP      = "ip"
+)
+
+// LoginAttempt tracks consecutive failed logins for one username and IP, one
+// username, or one IP.
+type LoginAttempt struct {
+	Kind        string         `json:"kind"`
+	Subject     string         `json:"subject"`
+	Failures    int            `json:"failures"`
+	LastFailure time.Time      `json:"lastFailure"`
+	LockedUntil *time.Time     `json:"lockedUntil,omitempty"`
+	Recent      []LoginFailure `json:"recent,omitempty"`
+}
+
+// LoginFailure records one rejected login.
+type LoginFailure struct {
+	At       time.Time `json:"at"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip"`
+	Reason   string    `json:"reason"`
+}
+
+// LoginAttemptUserSubject is the subject of the username counter for logins
+// from ip, e.g. "alice@203.0.113.5".
+func LoginAttemptUserSubject(username, ip string) string {
+	username = NormalizeUsername(username)
+	if ip == "" {
+		return username
+	}
+	return username + "@" + ip
+}
+
+// Key returns the storage key, e.g. "user:alice@203.0.113.5",
+// "account:alice" or "ip:203.0.113.5".
+func (a *LoginAttempt) Key() string {
+	return a.Kind + ":" + a.Subject
+}
+
+// Locked reports whether the subject is locked out at now.
+func (a *LoginAttempt) Locked(now time.Time) bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(now)
+}
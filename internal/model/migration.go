@@ -0,0 +1,18 @@
+package model
+
+// MigrationStep is one schema migration of a store.
+type MigrationStep struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	// Changes summarizes what the step did, or would do in a dry run.
+	Changes string `json:"changes,omitempty"`
+}
+
+// MigrationReport lists the migrations run when opening a store. With
+// DryRun set they were rolled back.
+type MigrationReport struct {
+	From   int             `json:"from"`
+	To     int             `json:"to"`
+	DryRun bool            `json:"dryRun"`
+	Steps  []MigrationStep `json:"steps"`
+}
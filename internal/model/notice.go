@@ -2,14 +2,15 @@ package model
 
 // NoticeRequest models plaintext message clients send to the proxy.
 type NoticeRequest struct {
-	Title      string   `json:"title"`
-	Subtitle   string   `json:"subtitle"`
-	Body       string   `json:"body"`
-	Group      string   `json:"group"`
-	Url        string   `json:"url"`
-	Icon       string   `json:"icon"`
-	Image      string   `json:"image"`
-	DeviceKeys []string `json:"deviceKeys"`
+	ID         string   `json:"id" form:"id"`
+	Title      string   `json:"title" form:"title"`
+	Subtitle   string   `json:"subtitle" form:"subtitle"`
+	Body       string   `json:"body" form:"body"`
+	Group      string   `json:"group" form:"group"`
+	Url        string   `json:"url" form:"url"`
+	Icon       string   `json:"icon" form:"icon"`
+	Image      string   `json:"image" form:"image"`
+	DeviceKeys []string `json:"deviceKeys" form:"deviceKeys"`
 }
 
 // NoticeResult summarises a push attempt.
@@ -5,24 +5,58 @@ import "time"
 // NoticeLog tracks each push attempt.
 type NoticeLog struct {
 	ID        uint64    `json:"id"`
+	NoticeID  string    `json:"noticeId,omitempty"`
+	RetryOf   uint64    `json:"retryOf,omitempty"`
+	Recall    bool      `json:"recall,omitempty"`
 	DeviceKey string    `json:"deviceKey"`
 	URL       string    `json:"url"`
 	Title     string    `json:"title"`
+	Subtitle  string    `json:"subtitle,omitempty"`
 	Body      string    `json:"body"`
 	Group     string    `json:"group"`
+	Link      string    `json:"link,omitempty"`
+	Icon      string    `json:"icon,omitempty"`
+	Image     string    `json:"image,omitempty"`
 	Result    string    `json:"result"`
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
-// NoticeLogFilter describes query parameters for log searching.
+// NoticeLogFilter describes query parameters for log searching. Results
+// are newest first. With Page set the result is an offset page carrying the
+// total count; with Page zero it continues after Cursor (empty for the newest
+// entries) without counting.
 type NoticeLogFilter struct {
 	DeviceKey string
 	Group     string
 	Status    string
 	BeginTime *time.Time
 	EndTime   *time.Time
+	// Unretried drops entries that have already been resent.
+	Unretried bool
 	Page      int
 	PageSize  int
+	Cursor    string
 }
+
+// NoticeLogPrune selects push logs to delete: those created before Before
+// (when set) and those past the newest Keep entries (when positive). An
+// empty Status applies the rule to every status except ExceptStatuses,
+// whose logs are neither deleted nor counted towards Keep.
+type NoticeLogPrune struct {
+	Status         string
+	ExceptStatuses []string
+	Before         time.Time
+	Keep           int
+}
+
+// Groupings accepted by Store.CountNoticeLogs.
+const (
+	NoticeLogByDay    = "day"
+	NoticeLogByMonth  = "month"
+	NoticeLogByYear   = "year"
+	NoticeLogByStatus = "status"
+	NoticeLogByGroup  = "group"
+	NoticeLogByDevice = "device"
+)
@@ -0,0 +1,26 @@
+package model
+
+// NoticePreview is the dry-run report for a notice: what would be encrypted
+// and sent to bark-server, without contacting it.
+type NoticePreview struct {
+	ID           string                `json:"id"`
+	Valid        bool                  `json:"valid"`
+	Errors       []string              `json:"errors,omitempty"`
+	Decisions    []string              `json:"decisions"`
+	Plaintext    string                `json:"plaintext"`
+	PayloadBytes int                   `json:"payloadBytes"`
+	Targets      []NoticePreviewTarget `json:"targets"`
+}
+
+// NoticePreviewTarget holds the per-device ciphertext a send would produce.
+type NoticePreviewTarget struct {
+	DeviceKey    string `json:"deviceKey"`
+	Name         string `json:"name,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	Ciphertext   string `json:"ciphertext,omitempty"`
+	IV           string `json:"iv,omitempty"`
+	RequestBody  string `json:"requestBody,omitempty"`
+	RequestBytes int    `json:"requestBytes,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
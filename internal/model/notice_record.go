@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// NoticeRecord remembers a broadcast so it can later be replaced or recalled
+// on the same devices through Bark's notification id.
+type NoticeRecord struct {
+	ID         string        `json:"id"`
+	Request    NoticeRequest `json:"request"`
+	DeviceKeys []string      `json:"deviceKeys"`
+	RecalledAt *time.Time    `json:"recalledAt,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	UpdatedAt  time.Time     `json:"updatedAt"`
+}
@@ -2,6 +2,7 @@ package model
 
 // NoticeSummary mirrors bark-api's NoticeResponse payload.
 type NoticeSummary struct {
-	SendNum    int `json:"sendNum"`
-	SuccessNum int `json:"successNum"`
+	ID         string `json:"id,omitempty"`
+	SendNum    int    `json:"sendNum"`
+	SuccessNum int    `json:"successNum"`
 }
@@ -7,4 +7,6 @@ type NoticeLogPage struct {
 	Pages    int          `json:"pages"`
 	PageNum  int          `json:"pageNum"`
 	PageSize int          `json:"pageSize"`
+	// NextCursor fetches the entries after this page; empty on the last one.
+	NextCursor string `json:"nextCursor,omitempty"`
 }
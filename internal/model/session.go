@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Session is a console login backed by a rotating refresh token. Access
+// tokens carry the session ID, so deleting the session revokes them.
+type Session struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Provider string `json:"provider,omitempty"`
+	// RefreshHash is the SHA-256 of the current refresh secret. PreviousHash
+	// keeps the one it replaced so a replayed refresh token can be detected.
+	RefreshHash  string    `json:"refreshHash,omitempty"`
+	PreviousHash string    `json:"previousHash,omitempty"`
+	IP           string    `json:"ip,omitempty"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	RefreshedAt  time.Time `json:"refreshedAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,24 @@
+package model
+
+// StoreStats describes the database file and its buckets.
+type StoreStats struct {
+	Path     string        `json:"path"`
+	FileSize int64         `json:"fileSize"`
+	Buckets  []BucketStats `json:"buckets"`
+}
+
+// BucketStats is the size of one bucket. Bytes counts the data in use,
+// Allocated the pages holding it.
+type BucketStats struct {
+	Name      string `json:"name"`
+	Keys      int    `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	Allocated int64  `json:"allocated"`
+}
+
+// CompactResult reports the file size before and after a compaction.
+type CompactResult struct {
+	BeforeSize int64 `json:"beforeSize"`
+	AfterSize  int64 `json:"afterSize"`
+	DurationMS int64 `json:"durationMs"`
+}
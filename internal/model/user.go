@@ -0,0 +1,55 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// Admin console roles, from most to least privileged.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// User is an admin console account. Passwords are stored as bcrypt hashes.
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	// MustChangePassword restricts the user to /auth/password until a new
+	// password is set, e.g. after seeding with the default password.
+	MustChangePassword bool `json:"mustChangePassword,omitempty"`
+	// TOTP two-factor state. PendingTOTPSecret holds a secret during
+	// enrollment until the first code is verified; RecoveryCodes are SHA-256
+	// hashes of the one-time codes.
+	TOTPEnabled       bool      `json:"totpEnabled"`
+	TOTPSecret        string    `json:"totpSecret,omitempty"`
+	PendingTOTPSecret string    `json:"pendingTotpSecret,omitempty"`
+	TOTPLastStep      int64     `json:"totpLastStep,omitempty"`
+	RecoveryCodes     []string  `json:"recoveryCodes,omitempty"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAllows reports whether role grants at least the privileges of need.
+func RoleAllows(role, need string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[need]
+}
+
+// NormalizeUsername returns the canonical form used as the storage key.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/bark-labs/bark-secure-proxy/pkg/signer"
+	"github.com/gofiber/fiber/v2"
+)
+
+const localsAPIKey = "apiKey"
+
+var errForbidden = errors.New("API Key 无权操作该设备或分组")
+
+// requireScope guards the Bark-compatible sender endpoints. A valid API key
+// must carry scope; a console session must have a role covering it.
+// Anonymous calls are only let through while api_keys.strict is off.
+func (s *Server) requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get(signer.HeaderSignature) != "" {
+			key, err := s.apiKeySvc.AuthenticateSigned(context.Background(), service.SignedRequest{
+				KeyID:      c.Get(signer.HeaderKeyID),
+				Timestamp:  c.Get(signer.HeaderTimestamp),
+				Nonce:      c.Get(signer.HeaderNonce),
+				Signature:  c.Get(signer.HeaderSignature),
+				Method:     c.Method(),
+				RequestURI: string(c.Request().RequestURI()),
+				Body:       c.Body(),
+			})
+			if err != nil {
+				return c.Status(http.StatusUnauthorized).JSON(model.Error("签名校验失败: " + err.Error()))
+			}
+			if !key.HasScope(scope) {
+				return c.Status(http.StatusForbidden).JSON(model.Error("API Key 缺少权限 " + scope))
+			}
+			c.Locals(localsAPIKey, key)
+			return c.Next()
+		}
+		if raw := apiKeyFromRequest(c); raw != "" {
+			key, err := s.apiKeySvc.Authenticate(context.Background(), raw)
+			if err != nil {
+				return c.Status(http.StatusUnauthorized).JSON(model.Error("API Key 无效或已过期"))
+			}
+			if !key.HasScope(scope) {
+				return c.Status(http.StatusForbidden).JSON(model.Error("API Key 缺少权限 " + scope))
+			}
+			c.Locals(localsAPIKey, key)
+			return c.Next()
+		}
+		if token := extractBearerToken(c.Get("Authorization")); token != "" && s.authSvc.Enabled() {
+			if claims, err := s.authSvc.Validate(token); err == nil {
+				if claims.MustChangePassword {
+					return c.Status(http.StatusForbidden).JSON(model.Error(errMustChangePassword))
+				}
+				if !model.RoleAllows(claims.Role, scopeRole(scope)) {
+					return c.Status(http.StatusForbidden).JSON(model.Error("权限不足"))
+				}
+				c.Locals("username", claims.Username)
+				c.Locals("role", claims.Role)
+				return c.Next()
+			}
+		}
+		if s.apiKeySvc.Strict() {
+			return c.Status(http.StatusUnauthorized).JSON(model.Error("缺少 API Key"))
+		}
+		return c.Next()
+	}
+}
+
+// scopeRole maps an API key scope to the console role granting it.
+func scopeRole(scope string) string {
+	if scope == model.ScopeDeviceRead {
+		return model.RoleViewer
+	}
+	return model.RoleOperator
+}
+
+// apiKeyFromRequest accepts the key as X-API-Key, ?apiKey= (for URL-only
+// scripts) or a bearer token carrying the key prefix.
+func apiKeyFromRequest(c *fiber.Ctx) string {
+	if v := strings.TrimSpace(c.Get("X-API-Key")); v != "" {
+		return v
+	}
+	if v := strings.TrimSpace(c.Query("apiKey")); v != "" {
+		return v
+	}
+	if token := extractBearerToken(c.Get("Authorization")); service.IsAPIKey(token) {
+		return token
+	}
+	return ""
+}
+
+func currentAPIKey(c *fiber.Ctx) *model.APIKey {
+	key, _ := c.Locals(localsAPIKey).(*model.APIKey)
+	return key
+}
+
+// authorizeNotice narrows a notice to the devices and groups the caller's API
+// key may reach. Broadcasts from a device-restricted key are rewritten to
+// target only the allowed ACTIVE devices.
+func (s *Server) authorizeNotice(c *fiber.Ctx, req *model.NoticeRequest) error {
+	key := currentAPIKey(c)
+	if key == nil {
+		return nil
+	}
+	if !key.AllowsGroup(req.Group) {
+		return errForbidden
+	}
+	// Sending with the ID of an existing notice replaces that record, so the
+	// key must be allowed to update it as well.
+	if id := strings.TrimSpace(req.ID); id != "" {
+		if err := s.authorizeNoticeRecord(c, id, nil); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+	}
+	if len(req.DeviceKeys) > 0 {
+		for _, deviceKey := range req.DeviceKeys {
+			if !key.AllowsDevice(deviceKey) {
+				return errForbidden
+			}
+		}
+		return nil
+	}
+	if len(key.Devices) == 0 {
+		return nil
+	}
+	active, err := s.deviceSvc.ListActive(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, device := range active {
+		if key.AllowsDevice(device.DeviceKey) {
+			req.DeviceKeys = append(req.DeviceKeys, device.DeviceKey)
+		}
+	}
+	if len(req.DeviceKeys) == 0 {
+		return fmt.Errorf("no target devices resolved")
+	}
+	return nil
+}
+
+// authorizeNoticeRecord checks a stored broadcast against the caller's key
+// before it is updated or recalled. For an update, patch is checked too,
+// since it may move the notice into another group.
+func (s *Server) authorizeNoticeRecord(c *fiber.Ctx, id string, patch *model.NoticeRequest) error {
+	key := currentAPIKey(c)
+	if key == nil {
+		return nil
+	}
+	record, err := s.noticeSvc.Get(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if !key.AllowsGroup(record.Request.Group) {
+		return errForbidden
+	}
+	// The service keeps the stored group unless the patch sets one.
+	if patch != nil && strings.TrimSpace(patch.Group) != "" && !key.AllowsGroup(patch.Group) {
+		return errForbidden
+	}
+	for _, deviceKey := range record.DeviceKeys {
+		if !key.AllowsDevice(deviceKey) {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// recordAuthError answers a failed authorization check against a stored
+// record. It fails closed: a missing record is 404, a record the key may not
+// touch is 403 and a lookup error is 500, so the operation never runs.
+func recordAuthError(c *fiber.Ctx, err error, notFound string) error {
+	switch err {
+	case errForbidden:
+		return c.Status(http.StatusForbidden).JSON(model.Error(err.Error()))
+	case storage.ErrNotFound:
+		return c.Status(http.StatusNotFound).JSON(model.Error(notFound))
+	default:
+		return c.Status(http.StatusInternalServerError).JSON(model.Error(err.Error()))
+	}
+}
+
+// authorizeDevice checks a device-level operation against the caller's key.
+func authorizeDevice(c *fiber.Ctx, deviceKey string) error {
+	if key := currentAPIKey(c); key != nil && !key.AllowsDevice(deviceKey) {
+		return errForbidden
+	}
+	return nil
+}
+
+func (s *Server) handleAdminListAPIKeys(c *fiber.Ctx) error {
+	keys, err := s.apiKeySvc.List(context.Background())
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	for _, key := range keys {
+		key.SecretHash = ""
+		key.SigningSecret = ""
+	}
+	return c.JSON(keys)
+}
+
+func (s *Server) handleAdminCreateAPIKey(c *fiber.Ctx) error {
+	var req service.APIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	key, secret, err := s.apiKeySvc.Create(actorContext(c), req)
+	if err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	signingSecret := key.SigningSecret
+	key.SecretHash = ""
+	key.SigningSecret = ""
+	resp := fiber.Map{"key": key, "secret": secret}
+	if signingSecret != "" {
+		resp["signingSecret"] = signingSecret
+	}
+	return c.JSON(resp)
+}
+
+func (s *Server) handleAdminDeleteAPIKey(c *fiber.Ctx) error {
+	if err := s.apiKeySvc.Delete(actorContext(c), c.Params("id")); err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "api key not found")
+		}
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
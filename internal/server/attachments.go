@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultBodyLimit = 4 * 1024 * 1024
+
+// bodyLimit leaves room for an image plus an icon in one multipart notice.
+func bodyLimit(attachSvc *service.AttachmentService) int {
+	limit := defaultBodyLimit
+	if attachSvc.Enabled() {
+		if need := int(2*attachSvc.MaxSize()) + 1024*1024; need > limit {
+			limit = need
+		}
+	}
+	return limit
+}
+
+func (s *Server) handleAttachmentUpload(c *fiber.Ctx) error {
+	if !s.attachSvc.Enabled() {
+		return c.JSON(model.Error("附件功能未启用"))
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(model.Error("file不能为空"))
+	}
+	attachment, err := s.saveAttachment(c, header)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("上传成功", attachment))
+}
+
+func (s *Server) handleAttachmentGet(c *fiber.Ctx) error {
+	attachment, f, err := s.attachSvc.Open(context.Background(), c.Params("id"))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.SendStatus(http.StatusNotFound)
+		}
+		return c.SendStatus(http.StatusInternalServerError)
+	}
+	c.Set(fiber.HeaderContentType, attachment.ContentType)
+	c.Set("X-Content-Type-Options", "nosniff")
+	if !attachment.ExpiresAt.IsZero() {
+		maxAge := int(time.Until(attachment.ExpiresAt).Seconds())
+		c.Set(fiber.HeaderCacheControl, "private, max-age="+strconv.Itoa(maxAge))
+	}
+	return c.SendStream(f, int(attachment.Size))
+}
+
+// attachNoticeFiles uploads multipart "image"/"icon" files and points the
+// notice at the resulting URLs.
+func (s *Server) attachNoticeFiles(c *fiber.Ctx, req *model.NoticeRequest) error {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return fmt.Errorf("请求格式错误")
+	}
+	for field, target := range map[string]*string{"image": &req.Image, "icon": &req.Icon} {
+		files := form.File[field]
+		if len(files) == 0 {
+			continue
+		}
+		if !s.attachSvc.Enabled() {
+			return fmt.Errorf("附件功能未启用")
+		}
+		attachment, err := s.saveAttachment(c, files[0])
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		*target = attachment.URL
+	}
+	return nil
+}
+
+func (s *Server) saveAttachment(c *fiber.Ctx, header *multipart.FileHeader) (*model.Attachment, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	attachment, err := s.attachSvc.Save(context.Background(), header.Filename, header.Size, f)
+	if err != nil {
+		return nil, err
+	}
+	attachment.URL = s.attachSvc.URL(c.BaseURL(), attachment.ID)
+	return attachment, nil
+}
+
+func isMultipart(c *fiber.Ctx) bool {
+	return strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEMultipartForm)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// handleDeviceDelete is the Bark-compatible counterpart of the admin delete
+// endpoint, next to /device/stop. API keys may only delete devices they are
+// allowed to reach.
+func (s *Server) handleDeviceDelete(c *fiber.Ctx) error {
+	token := c.Query("deviceToken")
+	if token == "" {
+		return c.JSON(model.Error("deviceToken不能为空"))
+	}
+	if key := currentAPIKey(c); key != nil {
+		device, err := s.deviceSvc.Get(context.Background(), token)
+		if err == nil {
+			err = authorizeDevice(c, device.DeviceKey)
+		}
+		if err != nil {
+			return recordAuthError(c, err, "设备不存在")
+		}
+	}
+	result, err := s.deviceSvc.Delete(actorContext(c), token, deleteOptions(c))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.JSON(model.Error("设备不存在"))
+		}
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("删除成功", result))
+}
+
+func (s *Server) handleDeviceRestore(c *fiber.Ctx) error {
+	token := c.Query("deviceToken")
+	if token == "" {
+		return c.JSON(model.Error("deviceToken不能为空"))
+	}
+	if key := currentAPIKey(c); key != nil {
+		deleted, err := s.deviceSvc.GetDeleted(context.Background(), token)
+		if err == nil {
+			err = authorizeDevice(c, deleted.Device.DeviceKey)
+		}
+		if err != nil {
+			return recordAuthError(c, err, "已删除设备不存在或已过恢复期")
+		}
+	}
+	device, err := s.deviceSvc.Restore(actorContext(c), token)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.JSON(model.Error("已删除设备不存在或已过恢复期"))
+		}
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("恢复成功", device))
+}
+
+func (s *Server) handleAdminDeleteDevice(c *fiber.Ctx) error {
+	result, err := s.deviceSvc.Delete(actorContext(c), c.Params("token"), deleteOptions(c))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "device not found")
+		}
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(result)
+}
+
+func (s *Server) handleAdminListDeletedDevices(c *fiber.Ctx) error {
+	list, err := s.deviceSvc.ListDeleted(context.Background())
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(list)
+}
+
+func (s *Server) handleAdminRestoreDevice(c *fiber.Ctx) error {
+	device, err := s.deviceSvc.Restore(actorContext(c), c.Params("token"))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "deleted device not found")
+		}
+		return s.fail(c, http.StatusConflict, err.Error())
+	}
+	return c.JSON(device)
+}
+
+func (s *Server) handleAdminPurgeDevice(c *fiber.Ctx) error {
+	result, err := s.deviceSvc.Purge(actorContext(c), c.Params("token"), c.Query("logs"))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "deleted device not found")
+		}
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(result)
+}
+
+func deleteOptions(c *fiber.Ctx) service.DeviceDeleteOptions {
+	return service.DeviceDeleteOptions{Logs: c.Query("logs"), Permanent: c.QueryBool("permanent")}
+}
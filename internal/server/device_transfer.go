@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) handleAdminExportDevices(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format", service.DeviceFormatJSON))
+	if format != service.DeviceFormatJSON && format != service.DeviceFormatCSV {
+		return s.fail(c, http.StatusBadRequest, "format must be json or csv")
+	}
+	var buf bytes.Buffer
+	if _, err := s.deviceSvc.Export(actorContext(c), &buf, format); err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	if format == service.DeviceFormatCSV {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="devices-`+time.Now().UTC().Format("20060102-150405")+"."+format+`"`)
+	return c.Send(buf.Bytes())
+}
+
+// handleAdminImportDevices takes the file as the request body or as the
+// "file" field of a multipart form. Without format, a CSV content type (or
+// .csv file name) selects CSV and anything else JSON.
+func (s *Server) handleAdminImportDevices(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format"))
+	var r io.Reader = bytes.NewReader(c.Body())
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			return s.fail(c, http.StatusBadRequest, err.Error())
+		}
+		defer f.Close()
+		r = f
+		if format == "" && strings.HasSuffix(strings.ToLower(file.Filename), ".csv") {
+			format = service.DeviceFormatCSV
+		}
+	}
+	if format == "" {
+		format = service.DeviceFormatJSON
+		if strings.Contains(strings.ToLower(c.Get(fiber.HeaderContentType)), "csv") {
+			format = service.DeviceFormatCSV
+		}
+	}
+	devices, err := service.ParseDevices(r, format)
+	if err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	report, err := s.deviceSvc.Import(actorContext(c), devices, service.DeviceImportOptions{
+		Conflict: c.Query("conflict"),
+		DryRun:   c.QueryBool("dryRun"),
+	})
+	if err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(report)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The console picks the result of a single sign-on login up from the URL
+// fragment, which is never sent back to the server or logged by proxies.
+const (
+	oidcTokenFragment   = "oidc_token"
+	oidcRefreshFragment = "oidc_refresh"
+	oidcErrorFragment   = "oidc_error"
+)
+
+// oidcStateCookie binds a pending login to the browser that started it.
+const oidcStateCookie = "bsp_oidc_state"
+
+func (s *Server) handleOIDCConfig(c *fiber.Ctx) error {
+	return c.JSON(model.Success("ok", fiber.Map{
+		"enabled": s.authSvc != nil && s.authSvc.OIDCEnabled(),
+	}))
+}
+
+func (s *Server) handleOIDCLogin(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.OIDCEnabled() {
+		return c.Status(http.StatusNotFound).JSON(model.Error("未启用 OIDC 登录"))
+	}
+	target, state, err := s.authSvc.OIDCLoginURL(context.Background())
+	if err != nil {
+		return s.oidcRedirect(c, url.Values{oidcErrorFragment: {err.Error()}})
+	}
+	// The state is also kept in a cookie so that the callback only
+	// completes in the browser that started the login; otherwise anyone
+	// could finish their own login in a victim's browser. Lax lets the
+	// cookie through on the IdP's top-level redirect back.
+	setOIDCStateCookie(c, state, int(s.authSvc.OIDCLoginTTL().Seconds()))
+	return c.Redirect(target, http.StatusFound)
+}
+
+// setOIDCStateCookie sets the state cookie, or deletes it when maxAge is
+// negative.
+func setOIDCStateCookie(c *fiber.Ctx, state string, maxAge int) {
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func (s *Server) handleOIDCCallback(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.OIDCEnabled() {
+		return c.Status(http.StatusNotFound).JSON(model.Error("未启用 OIDC 登录"))
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		msg := c.Query("error_description")
+		if msg == "" {
+			msg = errCode
+		}
+		return s.oidcRedirect(c, url.Values{oidcErrorFragment: {msg}})
+	}
+	state := c.Query("state")
+	browserState := c.Cookies(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return s.oidcRedirect(c, url.Values{oidcErrorFragment: {"登录请求与当前浏览器不匹配，请重试"}})
+	}
+	ctx, cancel := context.WithTimeout(clientContext(c), 15*time.Second)
+	defer cancel()
+	result, err := s.authSvc.OIDCCallback(ctx, state, c.Query("code"))
+	if err != nil {
+		return s.oidcRedirect(c, url.Values{oidcErrorFragment: {err.Error()}})
+	}
+	return s.oidcRedirect(c, url.Values{
+		oidcTokenFragment:   {result.Token},
+		oidcRefreshFragment: {result.RefreshToken},
+	})
+}
+
+func (s *Server) oidcRedirect(c *fiber.Ctx, fragment url.Values) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Redirect("/#"+fragment.Encode(), http.StatusFound)
+}
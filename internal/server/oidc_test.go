@@ -0,0 +1,356 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/memory"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientID = "bark-console"
+
+// mockProvider is a minimal OIDC provider: discovery, an authorization
+// endpoint that remembers the PKCE challenge, a JWKS with one RSA key and a
+// token endpoint that checks the verifier and signs whatever claims the test
+// sets.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	claims    jwt.MapClaims
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.challenge = q.Get("code_challenge")
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=good-code&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verified := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		p.mu.Lock()
+		challenge := p.challenge
+		p.mu.Unlock()
+		if r.PostFormValue("code") != "good-code" || challenge == "" || base64.RawURLEncoding.EncodeToString(verified[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss": p.URL,
+			"aud": testClientID,
+			"sub": "user-1",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		p.mu.Lock()
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		p.mu.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize plays the browser's visit to the authorization endpoint.
+func (p *mockProvider) authorize(t *testing.T, target *url.URL) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+}
+
+func (p *mockProvider) setChallenge(challenge string) {
+	p.mu.Lock()
+	p.challenge = challenge
+	p.mu.Unlock()
+}
+
+func (p *mockProvider) setClaims(claims jwt.MapClaims) {
+	p.mu.Lock()
+	p.claims = claims
+	p.mu.Unlock()
+}
+
+type oidcTestEnv struct {
+	app      *fiber.App
+	authSvc  *service.AuthService
+	provider *mockProvider
+}
+
+func newOIDCTestEnv(t *testing.T, configure func(cfg *config.Config)) *oidcTestEnv {
+	t.Helper()
+	provider := newMockProvider(t)
+	cfg := &config.Config{}
+	cfg.Auth.Enabled = true
+	cfg.Auth.JWTSecret = "oidc-test-secret-0123456789abcdef"
+	cfg.Auth.OIDC.Enabled = true
+	cfg.Auth.OIDC.Issuer = provider.URL
+	cfg.Auth.OIDC.ClientID = testClientID
+	cfg.Auth.OIDC.RedirectURL = "https://proxy.example.com/auth/oidc/callback"
+	cfg.Auth.OIDC.Scopes = []string{"openid", "groups"}
+	cfg.Auth.OIDC.RoleMapping = map[string]string{"ops": model.RoleOperator, "admins": model.RoleAdmin}
+	if configure != nil {
+		configure(cfg)
+	}
+	store := memory.New()
+	authSvc := service.NewAuthService(store, cfg, service.NewAuditService(store))
+	if err := authSvc.CheckOIDC(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{authSvc: authSvc, cfg: cfg}
+	app := fiber.New()
+	app.Get("/auth/oidc/login", s.handleOIDCLogin)
+	app.Get("/auth/oidc/callback", s.handleOIDCCallback)
+	return &oidcTestEnv{app: app, authSvc: authSvc, provider: provider}
+}
+
+// login starts a login and returns the authorization request parameters and
+// the state cookie set on the browser.
+func (e *oidcTestEnv) login(t *testing.T) (url.Values, *http.Cookie) {
+	t.Helper()
+	resp, err := e.app.Test(httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	target, err := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(target.String(), e.provider.URL+"/authorize?") {
+		t.Fatalf("login redirects to %s", target)
+	}
+	e.provider.authorize(t, target)
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcStateCookie {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+				t.Fatalf("state cookie is not HttpOnly/SameSite=Lax: %+v", cookie)
+			}
+			return target.Query(), cookie
+		}
+	}
+	t.Fatal("login did not set the state cookie")
+	return nil, nil
+}
+
+// callback finishes a login and returns the values in the redirect fragment.
+func (e *oidcTestEnv) callback(t *testing.T, state string, cookie *http.Cookie) url.Values {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	resp, err := e.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	location := resp.Header.Get(fiber.HeaderLocation)
+	fragment, ok := strings.CutPrefix(location, "/#")
+	if !ok {
+		t.Fatalf("callback redirects to %s", location)
+	}
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestOIDCCallback(t *testing.T) {
+	env := newOIDCTestEnv(t, nil)
+	params, cookie := env.login(t)
+	env.provider.setClaims(jwt.MapClaims{
+		"nonce":              params.Get("nonce"),
+		"preferred_username": "alice",
+		"groups":             []string{"ops"},
+	})
+	values := env.callback(t, params.Get("state"), cookie)
+	if msg := values.Get(oidcErrorFragment); msg != "" {
+		t.Fatalf("callback failed: %s", msg)
+	}
+	if values.Get(oidcRefreshFragment) == "" {
+		t.Fatal("callback returned no refresh token")
+	}
+	claims, err := env.authSvc.Validate(values.Get(oidcTokenFragment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "oidc:alice" || claims.Role != model.RoleOperator || claims.Provider != service.ProviderOIDC {
+		t.Fatalf("claims = %s/%s/%s, want oidc:alice/operator/oidc", claims.Username, claims.Role, claims.Provider)
+	}
+
+	// The state is single use.
+	values = env.callback(t, params.Get("state"), cookie)
+	if values.Get(oidcErrorFragment) == "" {
+		t.Fatal("replayed callback succeeded")
+	}
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	env := newOIDCTestEnv(t, nil)
+	params, cookie := env.login(t)
+	env.provider.setClaims(jwt.MapClaims{"nonce": params.Get("nonce"), "preferred_username": "alice", "groups": []string{"ops"}})
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+	}{
+		{"no cookie", params.Get("state"), nil},
+		{"other browser", params.Get("state"), &http.Cookie{Name: oidcStateCookie, Value: "someone-else"}},
+		{"no state", "", cookie},
+		{"unknown state", "forged", &http.Cookie{Name: oidcStateCookie, Value: "forged"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := env.callback(t, tt.state, tt.cookie)
+			if values.Get(oidcErrorFragment) == "" || values.Get(oidcTokenFragment) != "" {
+				t.Fatalf("callback = %v, want an error", values)
+			}
+		})
+	}
+
+	// Rejected attempts do not consume the login, so the real browser can
+	// still finish it.
+	values := env.callback(t, params.Get("state"), cookie)
+	if msg := values.Get(oidcErrorFragment); msg != "" {
+		t.Fatalf("callback failed: %s", msg)
+	}
+}
+
+func TestOIDCCallbackNonceMismatch(t *testing.T) {
+	env := newOIDCTestEnv(t, nil)
+	params, cookie := env.login(t)
+	env.provider.setClaims(jwt.MapClaims{"nonce": "replayed-token", "preferred_username": "alice", "groups": []string{"ops"}})
+	values := env.callback(t, params.Get("state"), cookie)
+	if msg := values.Get(oidcErrorFragment); !strings.Contains(msg, "nonce") {
+		t.Fatalf("callback error = %q, want a nonce mismatch", msg)
+	}
+	if values.Get(oidcTokenFragment) != "" {
+		t.Fatal("callback issued a token")
+	}
+}
+
+func TestOIDCCallbackPKCEMismatch(t *testing.T) {
+	env := newOIDCTestEnv(t, nil)
+	params, cookie := env.login(t)
+	env.provider.setClaims(jwt.MapClaims{"nonce": params.Get("nonce"), "preferred_username": "alice", "groups": []string{"ops"}})
+	// The code was issued for another login's challenge.
+	env.provider.setChallenge("0ZlNXGBx5aCbAjyBXhDLtrCjHgHN4Tpvu0DqDTOmtpY")
+	values := env.callback(t, params.Get("state"), cookie)
+	if values.Get(oidcErrorFragment) == "" || values.Get(oidcTokenFragment) != "" {
+		t.Fatalf("callback = %v, want an error", values)
+	}
+}
+
+func TestOIDCRoleMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		groups    any
+		allowed   []string
+		fallback  string
+		wantRole  string
+		wantError bool
+	}{
+		{name: "mapped group", groups: []string{"ops"}, wantRole: model.RoleOperator},
+		{name: "most privileged wins", groups: []string{"ops", "Admins"}, wantRole: model.RoleAdmin},
+		{name: "single string claim", groups: "admins", wantRole: model.RoleAdmin},
+		{name: "default role", groups: []string{"staff"}, fallback: model.RoleViewer, wantRole: model.RoleViewer},
+		{name: "no role", groups: []string{"staff"}, wantError: true},
+		{name: "allowed group", groups: []string{"ops", "bark"}, allowed: []string{"bark"}, wantRole: model.RoleOperator},
+		{name: "not in allowed groups", groups: []string{"admins"}, allowed: []string{"bark"}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newOIDCTestEnv(t, func(cfg *config.Config) {
+				cfg.Auth.OIDC.AllowedGroups = tt.allowed
+				cfg.Auth.OIDC.DefaultRole = tt.fallback
+			})
+			params, cookie := env.login(t)
+			env.provider.setClaims(jwt.MapClaims{"nonce": params.Get("nonce"), "preferred_username": "bob", "groups": tt.groups})
+			values := env.callback(t, params.Get("state"), cookie)
+			if tt.wantError {
+				if values.Get(oidcErrorFragment) == "" {
+					t.Fatalf("callback = %v, want an error", values)
+				}
+				return
+			}
+			claims, err := env.authSvc.Validate(values.Get(oidcTokenFragment))
+			if err != nil {
+				t.Fatalf("validate: %v (callback = %v)", err, values)
+			}
+			if claims.Role != tt.wantRole {
+				t.Fatalf("role = %s, want %s", claims.Role, tt.wantRole)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Route groups with their own rate limits.
+const (
+	limitGroupNotice   = "notice"
+	limitGroupRegister = "register"
+	limitGroupDevice   = "device"
+	limitGroupOIDC     = "oidc"
+)
+
+// Dimensions a request can be rejected on.
+const (
+	limitByIP     = "ip"
+	limitByAPIKey = "apiKey"
+	limitByGroup  = "total"
+)
+
+// limiterSweepInterval controls how often idle buckets are dropped.
+const limiterSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	burst  float64
+	rate   float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+type limitCheck struct {
+	dimension string
+	key       string
+	rule      config.RateLimitRule
+}
+
+// rateLimiter keeps in-memory token buckets and counts rejections per route
+// group and dimension.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	rejected  map[string]map[string]uint64
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		rejected: make(map[string]map[string]uint64),
+	}
+}
+
+// allow takes one token from every bucket in checks, or from none if any of
+// them is empty, in which case it also returns how long until a token is
+// available.
+func (l *rateLimiter) allow(group string, checks []limitCheck, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.sweep(now)
+	}
+	buckets := make([]*tokenBucket, len(checks))
+	for i, check := range checks {
+		b := l.buckets[check.key]
+		if b == nil {
+			burst := burstOf(check.rule)
+			b = &tokenBucket{tokens: burst, burst: burst, rate: check.rule.Rate, last: now}
+			l.buckets[check.key] = b
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			if l.rejected[group] == nil {
+				l.rejected[group] = make(map[string]uint64)
+			}
+			l.rejected[group][check.dimension]++
+			return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+		buckets[i] = b
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely; recreating them later
+// yields the same state.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *rateLimiter) snapshot() (map[string]map[string]uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]map[string]uint64, len(l.rejected))
+	var total uint64
+	for group, counts := range l.rejected {
+		out[group] = make(map[string]uint64, len(counts))
+		for dimension, n := range counts {
+			out[group][dimension] = n
+			total += n
+		}
+	}
+	return out, total
+}
+
+func burstOf(rule config.RateLimitRule) float64 {
+	if rule.Burst > 0 {
+		return float64(rule.Burst)
+	}
+	return math.Max(1, math.Ceil(rule.Rate))
+}
+
+// rateLimit applies the per-IP and shared token buckets configured for
+// group. It runs before requireScope, so requests with a bad API key or
+// signature are limited as well.
+func (s *Server) rateLimit(group string) fiber.Handler {
+	rules, ok := s.cfg.RateLimit.Groups[group]
+	if !s.cfg.RateLimit.Enabled || !ok {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return func(c *fiber.Ctx) error {
+		var checks []limitCheck
+		if rules.PerIP.Rate > 0 {
+			checks = append(checks, limitCheck{limitByIP, group + "|ip|" + c.IP(), rules.PerIP})
+		}
+		if rules.Total.Rate > 0 {
+			checks = append(checks, limitCheck{limitByGroup, group, rules.Total})
+		}
+		return s.applyLimits(c, group, checks)
+	}
+}
+
+// keyRateLimit applies the per-API-key token bucket configured for group.
+// It must run after requireScope so the key is authenticated.
+func (s *Server) keyRateLimit(group string) fiber.Handler {
+	rules, ok := s.cfg.RateLimit.Groups[group]
+	if !s.cfg.RateLimit.Enabled || !ok || rules.PerAPIKey.Rate <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return func(c *fiber.Ctx) error {
+		key := currentAPIKey(c)
+		if key == nil {
+			return c.Next()
+		}
+		return s.applyLimits(c, group, []limitCheck{{limitByAPIKey, group + "|key|" + key.ID, rules.PerAPIKey}})
+	}
+}
+
+func (s *Server) applyLimits(c *fiber.Ctx, group string, checks []limitCheck) error {
+	if len(checks) == 0 {
+		return c.Next()
+	}
+	if ok, wait := s.limiter.allow(group, checks, time.Now()); !ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		return c.Status(http.StatusTooManyRequests).JSON(model.Error("请求过于频繁，请稍后再试"))
+	}
+	return c.Next()
+}
+
+func (s *Server) handleAdminRateLimit(c *fiber.Ctx) error {
+	rejected, total := s.limiter.snapshot()
+	return c.JSON(fiber.Map{
+		"enabled":       s.cfg.RateLimit.Enabled,
+		"rejected":      rejected,
+		"rejectedTotal": total,
+	})
+}
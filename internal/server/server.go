@@ -2,10 +2,11 @@ package server
 
 import (
 	"context"
+	"errors"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,17 +27,27 @@ type Server struct {
 	logSvc     *service.NoticeLogService
 	barkClient *barkclient.Client
 	authSvc    *service.AuthService
+	attachSvc  *service.AttachmentService
+	apiKeySvc  *service.APIKeyService
+	auditSvc   *service.AuditService
+	backupSvc  *service.BackupService
+	limiter    *rateLimiter
 	store      storage.Store
 	cfg        *config.Config
 }
 
 // New builds a server instance.
-func New(cfg *config.Config, store storage.Store, deviceSvc *service.DeviceService, noticeSvc *service.NoticeService, logSvc *service.NoticeLogService, authSvc *service.AuthService, barkClient *barkclient.Client) *Server {
+func New(cfg *config.Config, store storage.Store, deviceSvc *service.DeviceService, noticeSvc *service.NoticeService, logSvc *service.NoticeLogService, authSvc *service.AuthService, attachSvc *service.AttachmentService, apiKeySvc *service.APIKeyService, auditSvc *service.AuditService, backupSvc *service.BackupService, barkClient *barkclient.Client) *Server {
 	app := fiber.New(fiber.Config{
 		IdleTimeout:  cfg.HTTP.ReadTimeout,
 		ReadTimeout:  cfg.HTTP.ReadTimeout,
 		WriteTimeout: cfg.HTTP.WriteTimeout,
-		AppName:      "bark-secure-proxy",
+		BodyLimit:    bodyLimit(attachSvc),
+		ProxyHeader:  cfg.HTTP.ProxyHeader,
+		// The proxy header is only honoured from trusted_proxies.
+		EnableTrustedProxyCheck: cfg.HTTP.ProxyHeader != "",
+		TrustedProxies:          cfg.HTTP.TrustedProxies,
+		AppName:                 "bark-secure-proxy",
 	})
 	s := &Server{
 		app:        app,
@@ -45,6 +56,11 @@ func New(cfg *config.Config, store storage.Store, deviceSvc *service.DeviceServi
 		logSvc:     logSvc,
 		barkClient: barkClient,
 		authSvc:    authSvc,
+		attachSvc:  attachSvc,
+		apiKeySvc:  apiKeySvc,
+		auditSvc:   auditSvc,
+		backupSvc:  backupSvc,
+		limiter:    newRateLimiter(),
 		store:      store,
 		cfg:        cfg,
 	}
@@ -68,36 +84,91 @@ func (s *Server) registerRoutes() {
 
 	s.app.Post("/auth/login", s.handleLogin)
 	s.app.Get("/auth/profile", s.handleProfile)
+	s.app.Post("/auth/password", s.handleChangePassword)
+	s.app.Post("/auth/refresh", s.handleRefresh)
+	s.app.Post("/auth/logout", s.handleLogout)
+	s.app.Post("/auth/login/2fa", s.handleLoginTwoFactor)
+	s.app.Post("/auth/2fa/setup", s.requireSession, s.handleTOTPSetup)
+	s.app.Post("/auth/2fa/enable", s.requireSession, s.handleTOTPEnable)
+	s.app.Post("/auth/2fa/disable", s.requireSession, s.handleTOTPDisable)
+	s.app.Post("/auth/2fa/recovery-codes", s.requireSession, s.handleRecoveryCodes)
+	s.app.Get("/auth/oidc/config", s.handleOIDCConfig)
+	s.app.Get("/auth/oidc/login", s.rateLimit(limitGroupOIDC), s.handleOIDCLogin)
+	s.app.Get("/auth/oidc/callback", s.handleOIDCCallback)
 
 	// Bark-App compatible endpoints
-	s.app.Get("/register", s.handleRegister)
-	s.app.Post("/device/gen", s.handleDeviceGen)
-	s.app.Get("/device/query", s.handleDeviceQuery)
-	s.app.Get("/device/queryAll", s.handleDeviceQueryAll)
-	s.app.Get("/device/active", s.handleDeviceActivate)
-	s.app.Get("/device/stop", s.handleDeviceStop)
-
-	s.app.Get("/notice", s.handleNoticeQuery)
-	s.app.Get("/notice/:title/:body", s.handleNoticePath)
-	s.app.Get("/notice/:title/:subtitle/:body", s.handleNoticePath)
-	s.app.Post("/notice", s.handleNoticePost)
+	send := s.requireScope(model.ScopeSend)
+	deviceRead := s.requireScope(model.ScopeDeviceRead)
+	deviceWrite := s.requireScope(model.ScopeDeviceWrite)
+	// The IP and total limits run before authentication so that guessing
+	// keys or signatures is throttled too; the per-key limit needs the
+	// authenticated key and runs after.
+	noticeLimit, noticeKeyLimit := s.rateLimit(limitGroupNotice), s.keyRateLimit(limitGroupNotice)
+	deviceLimit, deviceKeyLimit := s.rateLimit(limitGroupDevice), s.keyRateLimit(limitGroupDevice)
+	s.app.Get("/register", s.rateLimit(limitGroupRegister), s.handleRegister)
+	s.app.Post("/device/gen", deviceLimit, deviceWrite, deviceKeyLimit, s.handleDeviceGen)
+	s.app.Get("/device/query", deviceLimit, deviceRead, deviceKeyLimit, s.handleDeviceQuery)
+	s.app.Get("/device/queryAll", deviceLimit, deviceRead, deviceKeyLimit, s.handleDeviceQueryAll)
+	s.app.Get("/device/active", deviceLimit, deviceWrite, deviceKeyLimit, s.handleDeviceActivate)
+	s.app.Get("/device/stop", deviceLimit, deviceWrite, deviceKeyLimit, s.handleDeviceStop)
+	s.app.Get("/device/delete", deviceLimit, deviceWrite, deviceKeyLimit, s.handleDeviceDelete)
+	s.app.Get("/device/restore", deviceLimit, deviceWrite, deviceKeyLimit, s.handleDeviceRestore)
+
+	s.app.Get("/notice", noticeLimit, send, noticeKeyLimit, s.handleNoticeQuery)
+	s.app.Get("/notice/:title/:body", noticeLimit, send, noticeKeyLimit, s.handleNoticePath)
+	s.app.Get("/notice/:title/:subtitle/:body", noticeLimit, send, noticeKeyLimit, s.handleNoticePath)
+	s.app.Post("/notice", noticeLimit, send, noticeKeyLimit, s.handleNoticePost)
+	s.app.Patch("/notice/:id", noticeLimit, send, noticeKeyLimit, s.handleNoticeUpdate)
+	s.app.Delete("/notice/:id", noticeLimit, send, noticeKeyLimit, s.handleNoticeRecall)
+
+	s.app.Post("/attachments", noticeLimit, send, noticeKeyLimit, s.handleAttachmentUpload)
+	s.app.Get("/attachments/:id", s.handleAttachmentGet)
 
 	s.app.Get("/status/endpoint", s.handleStatusEndpoint)
 
 	// Notice log APIs
-	logGroup := s.app.Group("/api/notice/log", s.requireAuth)
-	logGroup.Get("/list", s.handleLogList)
-	logGroup.Get("/count/date", s.handleLogCountDate)
-	logGroup.Get("/count/status", s.handleLogCountStatus)
-	logGroup.Get("/count/group", s.handleLogCountGroup)
-	logGroup.Get("/count/device", s.handleLogCountDevice)
+	viewer := s.requireRole(model.RoleViewer)
+	operator := s.requireRole(model.RoleOperator)
+	adminOnly := s.requireRole(model.RoleAdmin)
+
+	logGroup := s.app.Group("/api/notice/log")
+	logGroup.Get("/list", viewer, s.handleLogList)
+	logGroup.Get("/count/date", viewer, s.handleLogCountDate)
+	logGroup.Get("/count/status", viewer, s.handleLogCountStatus)
+	logGroup.Get("/count/group", viewer, s.handleLogCountGroup)
+	logGroup.Get("/count/device", viewer, s.handleLogCountDevice)
+	logGroup.Post("/resend", operator, s.handleLogResendFailed)
+	logGroup.Post("/resend/:id", operator, s.handleLogResend)
 
 	// Internal admin helpers for the lightweight frontend
-	admin := s.app.Group("/admin", s.requireAuth)
-	admin.Get("/summary", s.handleAdminSummary)
-	admin.Get("/devices", s.handleAdminListDevices)
-	admin.Get("/devices/:token", s.handleAdminGetDevice)
-	admin.Post("/devices", s.handleAdminUpsertDevice)
+	admin := s.app.Group("/admin")
+	admin.Get("/summary", viewer, s.handleAdminSummary)
+	admin.Get("/devices", viewer, s.handleAdminListDevices)
+	admin.Get("/devices/export", viewer, s.handleAdminExportDevices)
+	admin.Post("/devices/import", operator, s.handleAdminImportDevices)
+	admin.Get("/devices/deleted", viewer, s.handleAdminListDeletedDevices)
+	admin.Post("/devices/deleted/:token/restore", operator, s.handleAdminRestoreDevice)
+	admin.Delete("/devices/deleted/:token", operator, s.handleAdminPurgeDevice)
+	admin.Get("/devices/:token", viewer, s.handleAdminGetDevice)
+	admin.Delete("/devices/:token", operator, s.handleAdminDeleteDevice)
+	admin.Post("/devices", operator, s.handleAdminUpsertDevice)
+	admin.Get("/apikeys", adminOnly, s.handleAdminListAPIKeys)
+	admin.Post("/apikeys", adminOnly, s.handleAdminCreateAPIKey)
+	admin.Delete("/apikeys/:id", adminOnly, s.handleAdminDeleteAPIKey)
+	admin.Get("/ratelimit", viewer, s.handleAdminRateLimit)
+	admin.Get("/users", adminOnly, s.handleAdminListUsers)
+	admin.Post("/users", adminOnly, s.handleAdminCreateUser)
+	admin.Patch("/users/:username", adminOnly, s.handleAdminUpdateUser)
+	admin.Delete("/users/:username", adminOnly, s.handleAdminDeleteUser)
+	admin.Delete("/users/:username/sessions", adminOnly, s.handleAdminRevokeUserSessions)
+	admin.Get("/sessions", adminOnly, s.handleAdminListSessions)
+	admin.Get("/login-attempts", adminOnly, s.handleAdminLoginAttempts)
+	admin.Delete("/login-attempts", adminOnly, s.handleAdminClearLoginAttempts)
+	admin.Delete("/sessions/:id", adminOnly, s.handleAdminRevokeSession)
+	admin.Get("/audit", adminOnly, s.handleAdminAudit)
+	admin.Get("/storage", adminOnly, s.handleAdminStorageStats)
+	admin.Post("/storage/compact", adminOnly, s.handleAdminCompact)
+	admin.Post("/storage/backup", adminOnly, s.handleAdminBackup)
 
 	s.serveFrontend()
 }
@@ -144,15 +215,42 @@ func (s *Server) handleLogin(c *fiber.Ctx) error {
 			"username": "guest",
 		}))
 	}
-	token, err := s.authSvc.Authenticate(req.Username, req.Password)
+	result, err := s.authSvc.Authenticate(clientContext(c), req.Username, req.Password)
 	if err != nil {
-		return c.Status(http.StatusUnauthorized).JSON(model.Error(err.Error()))
+		return loginFailed(c, err)
+	}
+	if result.Challenge != "" {
+		return c.JSON(model.Success("请输入两步验证码", fiber.Map{
+			"enabled":           true,
+			"twoFactorRequired": true,
+			"challenge":         result.Challenge,
+			"username":          result.User.Username,
+		}))
 	}
-	return c.JSON(model.Success("登录成功", fiber.Map{
-		"token":    token,
-		"enabled":  true,
-		"username": s.authSvcUsername(),
-	}))
+	return c.JSON(loginResponse("登录成功", result))
+}
+
+// loginFailed answers a rejected login step, with 429 and Retry-After while
+// the username or IP is throttled.
+func loginFailed(c *fiber.Ctx, err error) error {
+	var lockout *service.LockoutError
+	if errors.As(err, &lockout) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, int(math.Ceil(lockout.RetryAfter.Seconds())))))
+		return c.Status(http.StatusTooManyRequests).JSON(model.Error(err.Error()))
+	}
+	return c.Status(http.StatusUnauthorized).JSON(model.Error(err.Error()))
+}
+
+func loginResponse(msg string, result *service.LoginResult) model.BasicResponse {
+	return model.Success(msg, fiber.Map{
+		"token":              result.Token,
+		"refreshToken":       result.RefreshToken,
+		"expiresIn":          int(time.Until(result.ExpiresAt).Seconds()),
+		"enabled":            true,
+		"username":           result.User.Username,
+		"role":               result.User.Role,
+		"mustChangePassword": result.User.MustChangePassword,
+	})
 }
 
 func (s *Server) handleProfile(c *fiber.Ctx) error {
@@ -160,6 +258,7 @@ func (s *Server) handleProfile(c *fiber.Ctx) error {
 		return c.JSON(model.Success("ok", fiber.Map{
 			"enabled":  false,
 			"username": "guest",
+			"role":     model.RoleAdmin,
 		}))
 	}
 	token := extractBearerToken(c.Get("Authorization"))
@@ -170,19 +269,54 @@ func (s *Server) handleProfile(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(http.StatusUnauthorized).JSON(model.Error("登录已失效"))
 	}
+	twoFactor := false
+	if claims.Provider != service.ProviderOIDC {
+		if user, err := s.authSvc.User(context.Background(), claims.Username); err == nil {
+			twoFactor = user.TOTPEnabled
+		}
+	}
 	return c.JSON(model.Success("ok", fiber.Map{
-		"enabled":  true,
-		"username": claims.Username,
+		"enabled":            true,
+		"username":           claims.Username,
+		"role":               claims.Role,
+		"provider":           claims.Provider,
+		"mustChangePassword": claims.MustChangePassword,
+		"twoFactorEnabled":   twoFactor,
 	}))
 }
 
+func (s *Server) handleChangePassword(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.Enabled() {
+		return c.JSON(model.Error("未启用登录"))
+	}
+	claims, err := s.authSvc.Validate(extractBearerToken(c.Get("Authorization")))
+	if err != nil {
+		return c.Status(http.StatusUnauthorized).JSON(model.Error("登录已失效"))
+	}
+	if claims.Provider == service.ProviderOIDC {
+		return c.Status(http.StatusForbidden).JSON(model.Error(errExternalAccount))
+	}
+	var req struct {
+		OldPassword string `json:"oldPassword"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	result, err := s.authSvc.ChangePassword(service.WithActor(clientContext(c), claims.Username, claims.Role), claims.Username, req.OldPassword, req.NewPassword)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(loginResponse("密码已修改", result))
+}
+
 func (s *Server) handleRegister(c *fiber.Ctx) error {
 	if s.barkClient == nil {
 		return c.JSON(model.Error("bark client not configured"))
 	}
 	deviceToken := c.Query("devicetoken")
 	key := c.Query("key")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(actorContext(c), 5*time.Second)
 	defer cancel()
 	resp, err := s.deviceSvc.RegisterDevice(ctx, deviceToken, key)
 	if err != nil {
@@ -196,7 +330,10 @@ func (s *Server) handleDeviceGen(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.JSON(model.Error("参数格式错误"))
 	}
-	device, err := s.deviceSvc.GenerateConfig(context.Background(), req)
+	if err := authorizeDevice(c, req.DeviceKey); err != nil {
+		return c.Status(http.StatusForbidden).JSON(model.Error(err.Error()))
+	}
+	device, err := s.deviceSvc.GenerateConfig(actorContext(c), req)
 	if err != nil {
 		return c.JSON(model.Error(err.Error()))
 	}
@@ -209,6 +346,13 @@ func (s *Server) handleDeviceQuery(c *fiber.Ctx) error {
 		return c.JSON(model.Error("deviceToken不能为空"))
 	}
 	device, err := s.deviceSvc.Get(context.Background(), token)
+	// A key limited to some devices gets the same answer for tokens that do
+	// not exist as for devices it may not see, so it cannot probe for them.
+	if key := currentAPIKey(c); key != nil && len(key.Devices) > 0 {
+		if err == storage.ErrNotFound || (err == nil && !key.AllowsDevice(device.DeviceKey)) {
+			return c.Status(http.StatusForbidden).JSON(model.Error(errForbidden.Error()))
+		}
+	}
 	if err != nil {
 		if err == storage.ErrNotFound {
 			return c.JSON(model.Error("设备不存在"))
@@ -219,7 +363,11 @@ func (s *Server) handleDeviceQuery(c *fiber.Ctx) error {
 }
 
 func (s *Server) handleDeviceQueryAll(c *fiber.Ctx) error {
-	views, err := s.deviceSvc.ListViews(context.Background())
+	var match func(*model.Device) bool
+	if key := currentAPIKey(c); key != nil {
+		match = func(d *model.Device) bool { return key.AllowsDevice(d.DeviceKey) }
+	}
+	views, err := s.deviceSvc.ListViewsMatching(context.Background(), match)
 	if err != nil {
 		return c.JSON(model.Error(err.Error()))
 	}
@@ -239,7 +387,16 @@ func (s *Server) handleDeviceStatusChange(c *fiber.Ctx, status, msg string) erro
 	if token == "" {
 		return c.JSON(model.Error("deviceToken不能为空"))
 	}
-	_, err := s.deviceSvc.UpdateStatus(context.Background(), token, status)
+	if key := currentAPIKey(c); key != nil {
+		device, err := s.deviceSvc.Get(context.Background(), token)
+		if err == nil {
+			err = authorizeDevice(c, device.DeviceKey)
+		}
+		if err != nil {
+			return recordAuthError(c, err, "设备不存在")
+		}
+	}
+	_, err := s.deviceSvc.UpdateStatus(actorContext(c), token, status)
 	if err != nil {
 		if err == storage.ErrNotFound {
 			return c.JSON(model.Error("设备不存在"))
@@ -256,6 +413,7 @@ func (s *Server) handleNoticeQuery(c *fiber.Ctx) error {
 		Body:     c.Query("body"),
 		Group:    c.Query("group"),
 		Url:      c.Query("url"),
+		ID:       c.Query("id"),
 	}
 	if strings.TrimSpace(req.Body) == "" {
 		return c.JSON(model.Error("body不能为空"))
@@ -270,6 +428,7 @@ func (s *Server) handleNoticePath(c *fiber.Ctx) error {
 		Body:     decodePathSegment(c.Params("body")),
 		Group:    c.Query("group"),
 		Url:      c.Query("url"),
+		ID:       c.Query("id"),
 	}
 	if strings.TrimSpace(req.Body) == "" {
 		return c.JSON(model.Error("body不能为空"))
@@ -282,14 +441,97 @@ func (s *Server) handleNoticePost(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.JSON(model.Error("请求格式错误"))
 	}
-	return s.dispatchNotice(c, req)
+	// Authorize before storing any uploaded files.
+	if err := s.authorizeNotice(c, &req); err != nil {
+		return noticeAuthError(c, err)
+	}
+	if isMultipart(c) && !isDryRun(c) {
+		if err := s.attachNoticeFiles(c, &req); err != nil {
+			return c.JSON(model.Error(err.Error()))
+		}
+	}
+	return s.sendNotice(c, req)
+}
+
+func (s *Server) handleNoticeUpdate(c *fiber.Ctx) error {
+	var req model.NoticeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("请求格式错误"))
+	}
+	if err := s.authorizeNoticeRecord(c, c.Params("id"), &req); err != nil {
+		return recordAuthError(c, err, "通知不存在")
+	}
+	if isMultipart(c) {
+		if err := s.attachNoticeFiles(c, &req); err != nil {
+			return c.JSON(model.Error(err.Error()))
+		}
+	}
+	ctx := actorContext(c)
+	summary, _, err := s.noticeSvc.Update(ctx, c.Params("id"), req)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.JSON(model.Error("通知不存在"))
+		}
+		return c.JSON(model.Error(err.Error()))
+	}
+	if consoleUser(c) != "" {
+		s.auditNotice(ctx, service.AuditNoticeUpdate, req, summary)
+	}
+	return c.JSON(model.Success("更新成功", summary))
+}
+
+func (s *Server) handleNoticeRecall(c *fiber.Ctx) error {
+	if err := s.authorizeNoticeRecord(c, c.Params("id"), nil); err != nil {
+		return recordAuthError(c, err, "通知不存在")
+	}
+	ctx := actorContext(c)
+	summary, _, err := s.noticeSvc.Recall(ctx, c.Params("id"))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.JSON(model.Error("通知不存在"))
+		}
+		return c.JSON(model.Error(err.Error()))
+	}
+	if consoleUser(c) != "" {
+		s.auditNotice(ctx, service.AuditNoticeRecall, model.NoticeRequest{}, summary)
+	}
+	return c.JSON(model.Success("撤回成功", summary))
 }
 
 func (s *Server) dispatchNotice(c *fiber.Ctx, req model.NoticeRequest) error {
-	summary, _, err := s.noticeSvc.Broadcast(context.Background(), req)
+	if err := s.authorizeNotice(c, &req); err != nil {
+		return noticeAuthError(c, err)
+	}
+	return s.sendNotice(c, req)
+}
+
+func noticeAuthError(c *fiber.Ctx, err error) error {
+	if err == errForbidden {
+		return c.Status(http.StatusForbidden).JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Error(err.Error()))
+}
+
+// sendNotice delivers an authorized notice, or previews it in a dry run.
+func (s *Server) sendNotice(c *fiber.Ctx, req model.NoticeRequest) error {
+	if isDryRun(c) {
+		preview := s.noticeSvc.Preview(context.Background(), req)
+		if isMultipart(c) {
+			preview.Decisions = append(preview.Decisions, "multipart image/icon files are not uploaded in dry run")
+		}
+		return c.JSON(model.Success("预览成功", preview))
+	}
+	if format := streamFormat(c); format != "" {
+		return s.streamNotice(c, req, format)
+	}
+	ctx := actorContext(c)
+	summary, _, err := s.noticeSvc.Broadcast(ctx, req)
 	if err != nil {
 		return c.JSON(model.Error(err.Error()))
 	}
+	if consoleUser(c) != "" {
+		s.auditNotice(ctx, service.AuditNoticeBroadcast, req, summary)
+	}
 	return c.JSON(model.Success("发送成功", summary))
 }
 
@@ -384,6 +626,42 @@ func (s *Server) handleLogCountDevice(c *fiber.Ctx) error {
 	return c.JSON(model.Success("按设备统计成功", data))
 }
 
+func (s *Server) handleLogResend(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.JSON(model.Error("日志ID格式错误"))
+	}
+	ctx := actorContext(c)
+	entry, err := s.logSvc.Get(ctx, id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.JSON(model.Error("日志不存在"))
+		}
+		return c.JSON(model.Error(err.Error()))
+	}
+	result, err := s.noticeSvc.Resend(ctx, entry)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	s.auditSvc.RecordMeta(ctx, service.AuditNoticeResend, "log:"+c.Params("id"), nil, nil, result)
+	return c.JSON(model.Success("重发完成", result))
+}
+
+func (s *Server) handleLogResendFailed(c *fiber.Ctx) error {
+	ctx := actorContext(c)
+	entries, err := s.logSvc.Retryable(ctx, parseLogFilter(c))
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	summary, results := s.noticeSvc.ResendAll(ctx, entries)
+	s.auditSvc.RecordMeta(ctx, service.AuditNoticeResend, "failed", nil, nil, summary)
+	return c.JSON(model.Success("重发完成", fiber.Map{
+		"sendNum":    summary.SendNum,
+		"successNum": summary.SuccessNum,
+		"results":    results,
+	}))
+}
+
 // Internal admin endpoints for the lightweight UI (raw JSON)
 func (s *Server) handleAdminListDevices(c *fiber.Ctx) error {
 	devices, err := s.deviceSvc.List(context.Background())
@@ -409,7 +687,7 @@ func (s *Server) handleAdminUpsertDevice(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return s.fail(c, http.StatusBadRequest, err.Error())
 	}
-	device, err := s.deviceSvc.Upsert(context.Background(), req)
+	device, err := s.deviceSvc.Upsert(actorContext(c), req)
 	if err != nil {
 		return s.fail(c, http.StatusBadRequest, err.Error())
 	}
@@ -428,35 +706,28 @@ func (s *Server) handleAdminSummary(c *fiber.Ctx) error {
 			active++
 		}
 	}
-	logs, err := s.store.ListNoticeLogs(ctx)
-	if err != nil {
-		logs = nil
-	}
-	sort.Slice(logs, func(i, j int) bool {
-		return logs[i].CreatedAt.After(logs[j].CreatedAt)
-	})
 	todayStart := time.Now().UTC().Truncate(24 * time.Hour)
 	todaySent := 0
 	todaySuccess := 0
-	for _, log := range logs {
-		if !log.CreatedAt.Before(todayStart) {
-			todaySent++
-			if strings.EqualFold(log.Status, "SUCCESS") {
-				todaySuccess++
+	if counts, err := s.store.CountNoticeLogs(ctx, model.NoticeLogByStatus, &todayStart, nil); err == nil {
+		for status, n := range counts {
+			todaySent += n
+			if strings.EqualFold(status, "SUCCESS") {
+				todaySuccess += n
 			}
-		} else {
-			break
 		}
 	}
 	recent := make([]fiber.Map, 0, 5)
-	for i := 0; i < len(logs) && i < 5; i++ {
-		recent = append(recent, fiber.Map{
-			"title":     logs[i].Title,
-			"group":     logs[i].Group,
-			"status":    logs[i].Status,
-			"deviceKey": maskKey(logs[i].DeviceKey),
-			"time":      logs[i].CreatedAt.Local().Format("01-02 15:04"),
-		})
+	if page, err := s.store.QueryNoticeLogs(ctx, model.NoticeLogFilter{PageSize: 5}); err == nil {
+		for _, log := range page.Data {
+			recent = append(recent, fiber.Map{
+				"title":     log.Title,
+				"group":     log.Group,
+				"status":    log.Status,
+				"deviceKey": maskKey(log.DeviceKey),
+				"time":      log.CreatedAt.Local().Format("01-02 15:04"),
+			})
+		}
 	}
 	status := "离线"
 	if s.pingBark() {
@@ -491,6 +762,11 @@ func (s *Server) serveFrontend() {
 	})
 }
 
+func isDryRun(c *fiber.Ctx) bool {
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	return dryRun
+}
+
 func decodePathSegment(value string) string {
 	if value == "" {
 		return value
@@ -504,6 +780,13 @@ func decodePathSegment(value string) string {
 
 func parseLogFilter(c *fiber.Ctx) model.NoticeLogFilter {
 	page, _ := strconv.Atoi(c.Query("page", "1"))
+	if page <= 0 {
+		page = 1
+	}
+	if c.Context().QueryArgs().Has("cursor") {
+		// Cursor paging; an empty cursor starts from the newest entry.
+		page = 0
+	}
 	pageSize, _ := strconv.Atoi(c.Query("pageSize", "10"))
 	begin, end := parseTimeRange(c)
 	return model.NoticeLogFilter{
@@ -514,6 +797,7 @@ func parseLogFilter(c *fiber.Ctx) model.NoticeLogFilter {
 		EndTime:   end,
 		Page:      page,
 		PageSize:  pageSize,
+		Cursor:    c.Query("cursor"),
 	}
 }
 
@@ -542,20 +826,35 @@ func parseTime(value string) *time.Time {
 	return nil
 }
 
-func (s *Server) requireAuth(c *fiber.Ctx) error {
-	if s.authSvc == nil || !s.authSvc.Enabled() {
+const (
+	errMustChangePassword = "请先修改默认密码"
+	errExternalAccount    = "单点登录账号请在身份提供方处管理"
+)
+
+// requireRole admits logged-in users whose role grants at least role.
+func (s *Server) requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if s.authSvc == nil || !s.authSvc.Enabled() {
+			return c.Next()
+		}
+		token := extractBearerToken(c.Get("Authorization"))
+		if token == "" {
+			return c.Status(http.StatusUnauthorized).JSON(model.Error("未登录"))
+		}
+		claims, err := s.authSvc.Validate(token)
+		if err != nil {
+			return c.Status(http.StatusUnauthorized).JSON(model.Error("登录已失效"))
+		}
+		if claims.MustChangePassword {
+			return c.Status(http.StatusForbidden).JSON(model.Error(errMustChangePassword))
+		}
+		if !model.RoleAllows(claims.Role, role) {
+			return c.Status(http.StatusForbidden).JSON(model.Error("权限不足"))
+		}
+		c.Locals("username", claims.Username)
+		c.Locals("role", claims.Role)
 		return c.Next()
 	}
-	token := extractBearerToken(c.Get("Authorization"))
-	if token == "" {
-		return c.Status(http.StatusUnauthorized).JSON(model.Error("未登录"))
-	}
-	claims, err := s.authSvc.Validate(token)
-	if err != nil {
-		return c.Status(http.StatusUnauthorized).JSON(model.Error("登录已失效"))
-	}
-	c.Locals("username", claims.Username)
-	return c.Next()
 }
 
 func extractBearerToken(header string) string {
@@ -572,13 +871,6 @@ func extractBearerToken(header string) string {
 	return strings.TrimSpace(parts[1])
 }
 
-func (s *Server) authSvcUsername() string {
-	if s.authSvc == nil {
-		return ""
-	}
-	return s.authSvc.Username()
-}
-
 func maskKey(value string) string {
 	value = strings.TrimSpace(value)
 	if value == "" {
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// clientContext records the caller on sessions opened by this request.
+func clientContext(c *fiber.Ctx) context.Context {
+	return service.WithClientInfo(context.Background(), strings.Clone(c.IP()), strings.Clone(c.Get(fiber.HeaderUserAgent)))
+}
+
+func (s *Server) handleRefresh(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.Enabled() {
+		return c.JSON(model.Error("未启用登录"))
+	}
+	var req refreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	result, err := s.authSvc.Refresh(context.Background(), req.RefreshToken)
+	if err != nil {
+		return c.Status(http.StatusUnauthorized).JSON(model.Error(err.Error()))
+	}
+	return c.JSON(loginResponse("ok", result))
+}
+
+// handleLogout ends the current session, identified by the access token or,
+// once that has expired, by the refresh token.
+func (s *Server) handleLogout(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.Enabled() {
+		return c.JSON(model.Success("已退出登录", nil))
+	}
+	var req refreshRequest
+	_ = c.BodyParser(&req)
+	ctx := clientContext(c)
+	if claims, err := s.authSvc.Validate(extractBearerToken(c.Get("Authorization"))); err == nil {
+		if err := s.authSvc.EndSession(service.WithActor(ctx, claims.Username, claims.Role), claims.SessionID); err != nil && err != storage.ErrNotFound {
+			return c.Status(http.StatusInternalServerError).JSON(model.Error(err.Error()))
+		}
+		return c.JSON(model.Success("已退出登录", nil))
+	}
+	if err := s.authSvc.Logout(ctx, req.RefreshToken); err != nil {
+		return c.Status(http.StatusUnauthorized).JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("已退出登录", nil))
+}
+
+func (s *Server) handleAdminListSessions(c *fiber.Ctx) error {
+	sessions, err := s.authSvc.ListSessions(context.Background(), c.Query("username"))
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	for _, session := range sessions {
+		redactSession(session)
+	}
+	return c.JSON(sessions)
+}
+
+func (s *Server) handleAdminRevokeSession(c *fiber.Ctx) error {
+	if err := s.authSvc.RevokeSession(actorContext(c), c.Params("id")); err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "session not found")
+		}
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminRevokeUserSessions(c *fiber.Ctx) error {
+	removed, err := s.authSvc.RevokeSessions(actorContext(c), c.Params("username"))
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"revoked": removed})
+}
+
+func (s *Server) handleAdminLoginAttempts(c *fiber.Ctx) error {
+	attempts, err := s.authSvc.LoginAttempts(context.Background())
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(attempts)
+}
+
+// handleAdminClearLoginAttempts lifts throttling for one counter, given as
+// ?key=user:alice@203.0.113.5 or ?key=ip:203.0.113.5.
+func (s *Server) handleAdminClearLoginAttempts(c *fiber.Ctx) error {
+	key := c.Query("key")
+	if key == "" {
+		return s.fail(c, http.StatusBadRequest, "key is required")
+	}
+	if err := s.authSvc.ClearLoginAttempts(actorContext(c), key); err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "login attempts not found")
+		}
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// redactSession strips refresh token hashes before a session is returned.
+func redactSession(session *model.Session) {
+	session.RefreshHash = ""
+	session.PreviousHash = ""
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) handleAdminStorageStats(c *fiber.Ctx) error {
+	stats, err := s.store.Stats(context.Background())
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(stats)
+}
+
+func (s *Server) handleAdminCompact(c *fiber.Ctx) error {
+	ctx := actorContext(c)
+	result, err := s.store.Compact(ctx)
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	s.auditSvc.RecordMeta(ctx, service.AuditStorageCompact, "", nil, nil, result)
+	return c.JSON(result)
+}
+
+type backupRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// handleAdminBackup streams a database snapshot as a file download. A
+// passphrase in the body, or else backup.passphrase, encrypts it.
+func (s *Server) handleAdminBackup(c *fiber.Ctx) error {
+	if !s.backupSvc.Enabled() {
+		return s.fail(c, http.StatusNotImplemented, "backups are not available with the memory storage driver")
+	}
+	var req backupRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return s.fail(c, http.StatusBadRequest, "invalid request body")
+		}
+	}
+	encrypted := req.Passphrase != "" || s.cfg.Backup.Passphrase != ""
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+s.backupSvc.FileName(time.Now(), encrypted)+`"`)
+
+	// The fiber context is recycled before the stream writer runs.
+	ctx := actorContext(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		n, encrypted, err := s.backupSvc.Write(ctx, w, req.Passphrase)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			// Headers are gone; the client sees a truncated file, which
+			// restore rejects.
+			log.Printf("backup download failed: %v", err)
+			return
+		}
+		s.auditSvc.RecordMeta(ctx, service.AuditStorageBackup, "", nil, nil, map[string]any{"bytes": n, "encrypted": encrypted})
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	streamSSE    = "sse"
+	streamNDJSON = "ndjson"
+)
+
+// streamFormat picks the progress stream requested through ?stream= or the
+// Accept header; an empty result means a regular buffered JSON response.
+func streamFormat(c *fiber.Ctx) string {
+	switch strings.ToLower(strings.TrimSpace(c.Query("stream"))) {
+	case streamSSE:
+		return streamSSE
+	case streamNDJSON:
+		return streamNDJSON
+	}
+	accept := strings.ToLower(c.Get(fiber.HeaderAccept))
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return streamSSE
+	case strings.Contains(accept, "application/x-ndjson"):
+		return streamNDJSON
+	}
+	return ""
+}
+
+// streamNotice broadcasts req and writes each device result as it completes,
+// followed by a final "summary" (or "error") event carrying the usual
+// BasicResponse envelope.
+func (s *Server) streamNotice(c *fiber.Ctx, req model.NoticeRequest, format string) error {
+	if format == streamSSE {
+		c.Set(fiber.HeaderContentType, "text/event-stream; charset=utf-8")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson; charset=utf-8")
+	}
+	c.Set("X-Accel-Buffering", "no")
+
+	// The fiber context is recycled before the stream writer runs.
+	ctx, manual := actorContext(c), consoleUser(c) != ""
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		emit := func(event string, data any) {
+			var err error
+			if format == streamSSE {
+				var payload []byte
+				if payload, err = json.Marshal(data); err == nil {
+					_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+				}
+			} else {
+				err = json.NewEncoder(w).Encode(fiber.Map{"type": event, "data": data})
+			}
+			if err == nil {
+				w.Flush()
+			}
+		}
+		summary, _, err := s.noticeSvc.BroadcastStream(ctx, req, func(result model.NoticeResult) {
+			emit("result", result)
+		})
+		if err != nil {
+			emit("error", model.Error(err.Error()))
+			return
+		}
+		if manual {
+			s.auditNotice(ctx, service.AuditNoticeBroadcast, req, summary)
+		}
+		emit("summary", model.Success("发送成功", summary))
+	})
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type twoFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Password  string `json:"password"`
+}
+
+func (s *Server) handleLoginTwoFactor(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.Enabled() {
+		return c.JSON(model.Error("未启用登录"))
+	}
+	var req twoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	result, err := s.authSvc.CompleteTwoFactor(clientContext(c), req.Challenge, req.Code)
+	if err != nil {
+		return loginFailed(c, err)
+	}
+	return c.JSON(loginResponse("登录成功", result))
+}
+
+func (s *Server) handleTOTPSetup(c *fiber.Ctx) error {
+	username, _ := c.Locals("username").(string)
+	setup, err := s.authSvc.BeginTOTP(context.Background(), username)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("请使用验证器扫描二维码后提交验证码", setup))
+}
+
+func (s *Server) handleTOTPEnable(c *fiber.Ctx) error {
+	username, _ := c.Locals("username").(string)
+	var req twoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	codes, err := s.authSvc.EnableTOTP(actorContext(c), username, req.Code)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("两步验证已启用，请妥善保存恢复码", fiber.Map{"recoveryCodes": codes}))
+}
+
+func (s *Server) handleTOTPDisable(c *fiber.Ctx) error {
+	username, _ := c.Locals("username").(string)
+	var req twoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	if err := s.authSvc.DisableTOTP(actorContext(c), username, req.Password, req.Code); err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("两步验证已关闭", nil))
+}
+
+func (s *Server) handleRecoveryCodes(c *fiber.Ctx) error {
+	username, _ := c.Locals("username").(string)
+	var req twoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(model.Error("参数格式错误"))
+	}
+	codes, err := s.authSvc.RegenerateRecoveryCodes(actorContext(c), username, req.Code)
+	if err != nil {
+		return c.JSON(model.Error(err.Error()))
+	}
+	return c.JSON(model.Success("恢复码已重新生成", fiber.Map{"recoveryCodes": codes}))
+}
+
+// requireSession admits any logged-in user to the self-service account
+// endpoints, regardless of role.
+func (s *Server) requireSession(c *fiber.Ctx) error {
+	if s.authSvc == nil || !s.authSvc.Enabled() {
+		return c.JSON(model.Error("未启用登录"))
+	}
+	claims, err := s.authSvc.Validate(extractBearerToken(c.Get("Authorization")))
+	if err != nil {
+		return c.Status(http.StatusUnauthorized).JSON(model.Error("登录已失效"))
+	}
+	if claims.MustChangePassword {
+		return c.Status(http.StatusForbidden).JSON(model.Error(errMustChangePassword))
+	}
+	if claims.Provider == service.ProviderOIDC {
+		return c.Status(http.StatusForbidden).JSON(model.Error(errExternalAccount))
+	}
+	c.Locals("username", claims.Username)
+	c.Locals("role", claims.Role)
+	return c.Next()
+}
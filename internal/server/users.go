@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/service"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) handleAdminListUsers(c *fiber.Ctx) error {
+	users, err := s.authSvc.ListUsers(context.Background())
+	if err != nil {
+		return s.fail(c, http.StatusInternalServerError, err.Error())
+	}
+	for _, user := range users {
+		redactUser(user)
+	}
+	return c.JSON(users)
+}
+
+func (s *Server) handleAdminCreateUser(c *fiber.Ctx) error {
+	var req service.UserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	user, err := s.authSvc.CreateUser(actorContext(c), req)
+	if err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	redactUser(user)
+	return c.JSON(user)
+}
+
+func (s *Server) handleAdminUpdateUser(c *fiber.Ctx) error {
+	var req service.UserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	user, err := s.authSvc.UpdateUser(actorContext(c), c.Params("username"), req)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "user not found")
+		}
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	redactUser(user)
+	return c.JSON(user)
+}
+
+func (s *Server) handleAdminDeleteUser(c *fiber.Ctx) error {
+	if err := s.authSvc.DeleteUser(actorContext(c), c.Params("username")); err != nil {
+		if err == storage.ErrNotFound {
+			return s.fail(c, http.StatusNotFound, "user not found")
+		}
+		return s.fail(c, http.StatusBadRequest, err.Error())
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// redactUser strips credentials before a user is returned to the console.
+func redactUser(user *model.User) {
+	user.PasswordHash = ""
+	user.TOTPSecret = ""
+	user.PendingTOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
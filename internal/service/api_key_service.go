@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/bark-labs/bark-secure-proxy/pkg/signer"
+)
+
+// APIKeyPrefix marks proxy API keys so they can be told apart from JWTs.
+const APIKeyPrefix = "bsp_"
+
+// lastUsedResolution throttles last-used writes to one per key per minute.
+const lastUsedResolution = time.Minute
+
+// Errors returned while authenticating API keys and signed requests.
+var (
+	ErrInvalidAPIKey    = errors.New("invalid api key")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrStaleSignature   = errors.New("request timestamp outside signature window")
+	ErrReplayedNonce    = errors.New("request nonce already used")
+)
+
+// APIKeyService manages scoped sender keys.
+type APIKeyService struct {
+	store  storage.Store
+	audit  *AuditService
+	strict bool
+	window time.Duration
+	nonces *NonceCache
+}
+
+// SignedRequest carries the signature headers plus the signed request parts.
+type SignedRequest struct {
+	KeyID      string
+	Timestamp  string
+	Nonce      string
+	Signature  string
+	Method     string
+	RequestURI string
+	Body       []byte
+}
+
+// APIKeyRequest describes a key to create.
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Devices   []string   `json:"devices"`
+	Groups    []string   `json:"groups"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	Signing   bool       `json:"signing"`
+}
+
+// NewAPIKeyService constructs APIKeyService.
+func NewAPIKeyService(store storage.Store, cfg *config.Config, audit *AuditService) *APIKeyService {
+	window := cfg.APIKeys.SignatureWindow
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	return &APIKeyService{
+		store:  store,
+		audit:  audit,
+		strict: cfg.APIKeys.Strict,
+		window: window,
+		// A nonce only needs remembering while its timestamp is acceptable,
+		// i.e. window on either side of now.
+		nonces: NewNonceCache(2 * window),
+	}
+}
+
+// Strict reports whether unauthenticated calls must be rejected.
+func (s *APIKeyService) Strict() bool {
+	return s != nil && s.strict
+}
+
+// Create stores a new key and returns it with the plaintext secret, which is
+// not recoverable afterwards.
+func (s *APIKeyService) Create(ctx context.Context, req APIKeyRequest) (*model.APIKey, string, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("expiresAt must be in the future")
+	}
+	id, err := crypto.RandomToken(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := crypto.RandomToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &model.APIKey{
+		ID:         id,
+		Name:       strings.TrimSpace(req.Name),
+		SecretHash: hashSecret(secret),
+		Scopes:     scopes,
+		Devices:    trimAll(req.Devices),
+		Groups:     trimAll(req.Groups),
+		ExpiresAt:  req.ExpiresAt,
+	}
+	if req.Signing {
+		signing, err := crypto.RandomToken(32)
+		if err != nil {
+			return nil, "", err
+		}
+		key.SigningSecret = signing
+	}
+	if err := s.store.SaveAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	s.audit.Record(ctx, AuditAPIKeyCreate, key.ID, nil, key)
+	return key, APIKeyPrefix + id + "." + secret, nil
+}
+
+// List returns all keys.
+func (s *APIKeyService) List(ctx context.Context) ([]*model.APIKey, error) {
+	return s.store.ListAPIKeys(ctx)
+}
+
+// Delete revokes a key.
+func (s *APIKeyService) Delete(ctx context.Context, id string) error {
+	key, err := s.store.GetAPIKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteAPIKey(ctx, id); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, AuditAPIKeyDelete, id, key, nil)
+	return nil
+}
+
+// Authenticate resolves a plaintext key and records its use.
+func (s *APIKeyService) Authenticate(ctx context.Context, raw string) (*model.APIKey, error) {
+	id, secret, ok := splitAPIKey(raw)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := s.store.GetAPIKey(ctx, id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now().UTC()
+	if key.Expired(now) {
+		return nil, ErrInvalidAPIKey
+	}
+	s.touch(ctx, key, now)
+	return key, nil
+}
+
+// AuthenticateSigned verifies an HMAC-signed request (see pkg/signer) and
+// rejects stale timestamps and replayed nonces.
+func (s *APIKeyService) AuthenticateSigned(ctx context.Context, req SignedRequest) (*model.APIKey, error) {
+	now := time.Now().UTC()
+	unix, err := strconv.ParseInt(strings.TrimSpace(req.Timestamp), 10, 64)
+	if err != nil {
+		return nil, ErrStaleSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > s.window || skew < -s.window {
+		return nil, ErrStaleSignature
+	}
+	if len(req.Nonce) < 8 || len(req.Nonce) > 128 {
+		return nil, ErrInvalidSignature
+	}
+	key, err := s.store.GetAPIKey(ctx, strings.TrimSpace(req.KeyID))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if key.SigningSecret == "" || key.Expired(now) {
+		return nil, ErrInvalidAPIKey
+	}
+	expected := signer.Signature(key.SigningSecret, req.Method, req.RequestURI, req.Timestamp, req.Nonce, req.Body)
+	if !signer.Equal(expected, req.Signature) {
+		return nil, ErrInvalidSignature
+	}
+	// Only remember nonces of correctly signed requests so forged traffic
+	// cannot fill the cache.
+	if !s.nonces.Use(key.ID+":"+req.Nonce, now) {
+		return nil, ErrReplayedNonce
+	}
+	s.touch(ctx, key, now)
+	return key, nil
+}
+
+func (s *APIKeyService) touch(ctx context.Context, key *model.APIKey, now time.Time) {
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedResolution {
+		return
+	}
+	key.LastUsedAt = &now
+	// Only the timestamp is written, and only while the key still exists,
+	// so a key deleted mid-request stays deleted.
+	if err := s.store.TouchAPIKey(ctx, key.ID, now); err != nil && err != storage.ErrNotFound {
+		log.Printf("update api key %s last used failed: %v", key.ID, err)
+	}
+}
+
+// IsAPIKey reports whether raw looks like a proxy API key.
+func IsAPIKey(raw string) bool {
+	return strings.HasPrefix(raw, APIKeyPrefix)
+}
+
+func splitAPIKey(raw string) (string, string, bool) {
+	raw = strings.TrimSpace(raw)
+	if !IsAPIKey(raw) {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, APIKeyPrefix), ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		switch scope {
+		case model.ScopeSend, model.ScopeDeviceRead, model.ScopeDeviceWrite:
+		default:
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			out = append(out, scope)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return out, nil
+}
+
+func trimAll(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// AttachmentService stores uploaded images on disk and serves them back
+// through unguessable, expiring URLs so they can be referenced by pushes.
+type AttachmentService struct {
+	store   storage.Store
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	gcEvery time.Duration
+	baseURL string
+	allowed map[string]bool
+}
+
+// NewAttachmentService builds AttachmentService from config.
+func NewAttachmentService(store storage.Store, cfg *config.Config) *AttachmentService {
+	attCfg := cfg.Attachments
+	allowed := make(map[string]bool, len(attCfg.AllowedTypes))
+	for _, t := range attCfg.AllowedTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			allowed[t] = true
+		}
+	}
+	return &AttachmentService{
+		store:   store,
+		dir:     strings.TrimSpace(attCfg.Dir),
+		maxSize: attCfg.MaxSize,
+		ttl:     attCfg.TTL,
+		gcEvery: attCfg.GCInterval,
+		baseURL: strings.TrimRight(strings.TrimSpace(attCfg.PublicBaseURL), "/"),
+		allowed: allowed,
+	}
+}
+
+// Enabled reports whether attachment hosting is configured.
+func (s *AttachmentService) Enabled() bool {
+	return s != nil && s.dir != ""
+}
+
+// MaxSize returns the per-file upload limit in bytes.
+func (s *AttachmentService) MaxSize() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.maxSize
+}
+
+// Save validates and persists an upload, returning its metadata.
+func (s *AttachmentService) Save(ctx context.Context, fileName string, size int64, r io.Reader) (*model.Attachment, error) {
+	if !s.Enabled() {
+		return nil, fmt.Errorf("attachments are disabled")
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		return nil, fmt.Errorf("attachment exceeds %d bytes", s.maxSize)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	if n == 0 {
+		return nil, fmt.Errorf("attachment is empty")
+	}
+	contentType := strings.ToLower(http.DetectContentType(head))
+	if idx := strings.Index(contentType, ";"); idx >= 0 {
+		contentType = strings.TrimSpace(contentType[:idx])
+	}
+	if len(s.allowed) > 0 && !s.allowed[contentType] {
+		return nil, fmt.Errorf("attachment type %s is not allowed", contentType)
+	}
+
+	id, err := crypto.RandomToken(24)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := s.path(id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	src := io.MultiReader(bytes.NewReader(head), r)
+	if s.maxSize > 0 {
+		// Guard against clients lying about the multipart size.
+		src = io.LimitReader(src, s.maxSize+1)
+	}
+	written, err := io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && s.maxSize > 0 && written > s.maxSize {
+		err = fmt.Errorf("attachment exceeds %d bytes", s.maxSize)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	attachment := &model.Attachment{
+		ID:          id,
+		FileName:    filepath.Base(strings.TrimSpace(fileName)),
+		ContentType: contentType,
+		Size:        written,
+		CreatedAt:   now,
+	}
+	if s.ttl > 0 {
+		attachment.ExpiresAt = now.Add(s.ttl)
+	}
+	if err := s.store.SaveAttachment(ctx, attachment); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// Open returns metadata plus an open file handle for a live attachment.
+func (s *AttachmentService) Open(ctx context.Context, id string) (*model.Attachment, *os.File, error) {
+	if !s.Enabled() || !isAttachmentID(id) {
+		return nil, nil, storage.ErrNotFound
+	}
+	attachment, err := s.store.GetAttachment(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attachment.Expired(time.Now()) {
+		return nil, nil, storage.ErrNotFound
+	}
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	return attachment, f, nil
+}
+
+// URL builds the public download URL, preferring the configured base URL
+// over the one derived from the incoming request.
+func (s *AttachmentService) URL(requestBase, id string) string {
+	base := s.baseURL
+	if base == "" {
+		base = strings.TrimRight(requestBase, "/")
+	}
+	return base + "/attachments/" + id
+}
+
+// CollectGarbage removes expired attachments from disk and storage.
+func (s *AttachmentService) CollectGarbage(ctx context.Context) (int, error) {
+	if !s.Enabled() {
+		return 0, nil
+	}
+	expired, err := s.store.ListExpiredAttachments(ctx, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, attachment := range expired {
+		if err := os.Remove(s.path(attachment.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove attachment %s failed: %v", attachment.ID, err)
+			continue
+		}
+		if err := s.store.DeleteAttachment(ctx, attachment.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Run periodically collects expired attachments until ctx is cancelled.
+func (s *AttachmentService) Run(ctx context.Context) {
+	if !s.Enabled() || s.gcEvery <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.gcEvery)
+	defer ticker.Stop()
+	for {
+		if n, err := s.CollectGarbage(ctx); err != nil {
+			log.Printf("attachment gc failed: %v", err)
+		} else if n > 0 {
+			log.Printf("attachment gc removed %d file(s)", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *AttachmentService) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func isAttachmentID(id string) bool {
+	if len(id) != 48 {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
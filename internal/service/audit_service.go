@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"reflect"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// Audit actions.
+const (
+	AuditDeviceRegister     = "device.register"
+	AuditDeviceUpsert       = "device.upsert"
+	AuditDeviceStatus       = "device.status"
+	AuditDeviceExport       = "device.export"
+	AuditDeviceImport       = "device.import"
+	AuditDeviceDelete       = "device.delete"
+	AuditDeviceRestore      = "device.restore"
+	AuditDevicePurge        = "device.purge"
+	AuditAPIKeyCreate       = "apikey.create"
+	AuditAPIKeyDelete       = "apikey.delete"
+	AuditUserCreate         = "user.create"
+	AuditUserUpdate         = "user.update"
+	AuditUserDelete         = "user.delete"
+	AuditLogin              = "auth.login"
+	AuditLogout             = "auth.logout"
+	AuditPasswordChange     = "auth.password"
+	AuditTOTPEnable         = "auth.totp.enable"
+	AuditTOTPDisable        = "auth.totp.disable"
+	AuditRecoveryCodes      = "auth.totp.recovery_codes"
+	AuditSessionRevoke      = "session.revoke"
+	AuditLoginAttemptsClear = "auth.lockout.clear"
+	AuditNoticeBroadcast    = "notice.broadcast"
+	AuditNoticeUpdate       = "notice.update"
+	AuditNoticeRecall       = "notice.recall"
+	AuditNoticeResend       = "notice.resend"
+	AuditStorageCompact     = "storage.compact"
+	AuditStorageBackup      = "storage.backup"
+)
+
+const (
+	auditRedacted        = "[redacted]"
+	auditAnonymous       = "anonymous"
+	auditDefaultPageSize = 20
+	auditMaxPageSize     = 200
+)
+
+// auditSecretFields are JSON field names whose values never reach the audit
+// trail; only the fact that they changed is kept.
+var auditSecretFields = map[string]bool{
+	"password":          true,
+	"passwordHash":      true,
+	"secret":            true,
+	"secretHash":        true,
+	"signingSecret":     true,
+	"totpSecret":        true,
+	"pendingTotpSecret": true,
+	"totpLastStep":      true,
+	"recoveryCodes":     true,
+	"refreshHash":       true,
+	"previousHash":      true,
+	"encodeKey":         true,
+	"iv":                true,
+}
+
+// auditIgnoredFields change on every write and would only add noise.
+var auditIgnoredFields = map[string]bool{
+	"createdAt":   true,
+	"updatedAt":   true,
+	"lastUsedAt":  true,
+	"refreshedAt": true,
+}
+
+type actorKey struct{}
+
+type actor struct {
+	name string
+	role string
+}
+
+// WithActor attaches the authenticated caller to ctx for auditing.
+func WithActor(ctx context.Context, name, role string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor{name: name, role: role})
+}
+
+func actorFrom(ctx context.Context) actor {
+	a, _ := ctx.Value(actorKey{}).(actor)
+	if a.name == "" {
+		a.name = auditAnonymous
+	}
+	return a
+}
+
+// AuditService records and queries the audit trail.
+type AuditService struct {
+	store storage.Store
+}
+
+// NewAuditService builds the audit service.
+func NewAuditService(store storage.Store) *AuditService {
+	return &AuditService{store: store}
+}
+
+// Record appends an entry for action on target. before and after are the
+// object's state around the change (either may be nil); only differing
+// fields are kept and secrets are redacted. Failures are logged rather than
+// returned so auditing never undoes a change that already happened.
+func (s *AuditService) Record(ctx context.Context, action, target string, before, after any) {
+	s.RecordMeta(ctx, action, target, before, after, nil)
+}
+
+// RecordMeta is Record with details that describe the action rather than
+// the object, such as how many records it affected. meta is kept as its
+// JSON fields, with secrets redacted.
+func (s *AuditService) RecordMeta(ctx context.Context, action, target string, before, after, meta any) {
+	if s == nil {
+		return
+	}
+	who := actorFrom(ctx)
+	entry := &model.AuditEntry{
+		Actor:   who.name,
+		Role:    who.role,
+		Action:  action,
+		Target:  target,
+		Changes: auditDiff(before, after),
+		Meta:    auditMeta(meta),
+		IP:      clientFrom(ctx).ip,
+	}
+	// The request context may already be cancelled once the response is out.
+	if err := s.store.AppendAuditEntry(context.WithoutCancel(ctx), entry); err != nil {
+		log.Printf("audit %s %s: %v", action, target, err)
+	}
+}
+
+// Query returns a page of audit entries matching filter, newest first.
+func (s *AuditService) Query(ctx context.Context, filter model.AuditFilter) (*model.AuditPage, error) {
+	if filter.PageSize <= 0 {
+		filter.PageSize = auditDefaultPageSize
+	}
+	if filter.PageSize > auditMaxPageSize {
+		filter.PageSize = auditMaxPageSize
+	}
+	if filter.Page <= 0 {
+		filter.Page = 1
+	}
+	return s.store.QueryAuditEntries(ctx, filter)
+}
+
+// auditDiff compares the JSON forms of before and after field by field.
+// Timestamps maintained by the store are ignored.
+func auditDiff(before, after any) map[string]model.AuditChange {
+	old, cur := auditFields(before), auditFields(after)
+	changes := make(map[string]model.AuditChange)
+	for name := range mergeKeys(old, cur) {
+		if auditIgnoredFields[name] {
+			continue
+		}
+		b, hadBefore := old[name]
+		a, hasAfter := cur[name]
+		if reflect.DeepEqual(b, a) {
+			continue
+		}
+		if auditSecretFields[name] {
+			change := model.AuditChange{}
+			if hadBefore && b != nil {
+				change.Before = auditRedacted
+			}
+			if hasAfter && a != nil {
+				change.After = auditRedacted
+			}
+			changes[name] = change
+			continue
+		}
+		changes[name] = model.AuditChange{Before: b, After: a}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func auditMeta(v any) map[string]any {
+	fields := auditFields(v)
+	for name := range fields {
+		if auditSecretFields[name] {
+			fields[name] = auditRedacted
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func auditFields(v any) map[string]any {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]any)
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+func mergeKeys(maps ...map[string]any) map[string]struct{} {
+	keys := make(map[string]struct{})
+	for _, m := range maps {
+		for k := range m {
+			keys[k] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// snapshot copies v so a later mutation of the original does not change the
+// "before" state captured for the audit trail.
+func snapshot[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
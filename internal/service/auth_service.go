@@ -1,32 +1,96 @@
 package service
 
 import (
-	"crypto/subtle"
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"strings"
 	"time"
 
 	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// AuthService handles admin authentication and JWT issuance.
+// minPasswordLength is enforced for passwords set through the API.
+const minPasswordLength = 8
+
+// minJWTSecretLength is the shortest jwt_secret accepted with auth enabled.
+const minJWTSecretLength = 16
+
+// defaultPassword is the shipped admin password; accounts using it must pick
+// a new one before doing anything else.
+const defaultPassword = "admin123"
+
+// defaultJWTSecrets are the placeholder secrets shipped in code and configs.
+var defaultJWTSecrets = []string{"change-me-secret", "replace-this-secret", "bark-secure-default-secret"}
+
+// dummyHash is compared against when a username is unknown so that login
+// timing does not reveal which accounts exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("bark-secure-proxy"), bcrypt.DefaultCost)
+
+// ErrInvalidCredentials is returned for unknown users, wrong passwords and
+// disabled accounts alike.
+var ErrInvalidCredentials = errors.New("用户名或密码错误")
+
+// AuthService handles admin authentication, JWT issuance and user accounts.
 type AuthService struct {
+	store    storage.Store
+	audit    *AuditService
 	enabled  bool
 	username string
 	password string
-	secret   []byte
+	keys     *signingKeys
+
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	challenges *challengeGuard
+	guard      *loginGuard
+	oidc       *oidcClient
 }
 
 // Claims represents JWT payload.
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role"`
+	// MustChangePassword limits the token to changing the password.
+	MustChangePassword bool `json:"mustChangePassword,omitempty"`
+	// Purpose is set on login challenges, which are not session tokens.
+	Purpose string `json:"purpose,omitempty"`
+	// Provider is ProviderOIDC for single sign-on sessions, which have no
+	// local account to manage.
+	Provider string `json:"idp,omitempty"`
+	// SessionID ties the token to a stored session so it can be revoked.
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// UserRequest describes a user to create or the fields to change. Empty
+// fields are left untouched on update.
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Disabled *bool  `json:"disabled"`
+	// ResetTOTP turns off two-factor login, e.g. after a lost phone.
+	ResetTOTP bool `json:"resetTotp"`
+}
+
+// LoginResult is the outcome of a login step. When the user has TOTP
+// enabled only Challenge is set and must be completed via CompleteTwoFactor.
+type LoginResult struct {
+	Token        string
+	RefreshToken string
+	ExpiresAt    time.Time
+	Challenge    string
+	User         *model.User
+}
+
 // NewAuthService builds AuthService from config.
-func NewAuthService(cfg *config.Config) *AuthService {
+func NewAuthService(store storage.Store, cfg *config.Config, audit *AuditService) *AuthService {
 	authCfg := cfg.Auth
 	username := strings.TrimSpace(authCfg.Username)
 	if username == "" {
@@ -34,17 +98,30 @@ func NewAuthService(cfg *config.Config) *AuthService {
 	}
 	password := strings.TrimSpace(authCfg.Password)
 	if password == "" {
-		password = "admin123"
+		password = defaultPassword
 	}
 	secret := strings.TrimSpace(authCfg.JWTSecret)
-	if secret == "" {
-		secret = "bark-secure-default-secret"
+	accessTTL := authCfg.AccessTokenTTL
+	if accessTTL <= 0 {
+		accessTTL = defaultAccessTokenTTL
+	}
+	refreshTTL := authCfg.RefreshTokenTTL
+	if refreshTTL <= 0 {
+		refreshTTL = defaultRefreshTokenTTL
 	}
 	return &AuthService{
+		store:    store,
+		audit:    audit,
 		enabled:  authCfg.Enabled,
 		username: username,
 		password: password,
-		secret:   []byte(secret),
+		keys:     newSigningKeys(secret, authCfg.PreviousJWTSecrets),
+
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		challenges: newChallengeGuard(),
+		guard:      newLoginGuard(store, cfg),
+		oidc:       newOIDCClient(cfg),
 	}
 }
 
@@ -53,61 +130,321 @@ func (a *AuthService) Enabled() bool {
 	return a != nil && a.enabled
 }
 
-// Username returns configured admin username.
-func (a *AuthService) Username() string {
-	if a == nil {
-		return ""
+// CheckSecrets refuses a missing, placeholder or short JWT secret while
+// authentication is enabled, since anyone knowing it can mint admin tokens.
+func (a *AuthService) CheckSecrets() error {
+	if !a.Enabled() {
+		return nil
+	}
+	secret := string(a.keys.secret)
+	for _, placeholder := range defaultJWTSecrets {
+		if secret == placeholder {
+			return fmt.Errorf("auth.jwt_secret is still the default %q; set a random value of at least %d characters", placeholder, minJWTSecretLength)
+		}
+	}
+	if len(secret) < minJWTSecretLength {
+		return fmt.Errorf("auth.jwt_secret must be at least %d characters", minJWTSecretLength)
 	}
-	return a.username
+	for _, previous := range a.keys.verify {
+		if len(previous) < minJWTSecretLength {
+			return fmt.Errorf("auth.previous_jwt_secrets entries must be at least %d characters", minJWTSecretLength)
+		}
+	}
+	return nil
 }
 
-// Authenticate validates user credentials and returns a JWT token.
-func (a *AuthService) Authenticate(username, password string) (string, error) {
+// EnsureAdmin seeds the account from auth.username/auth.password as an admin
+// when no users exist yet. Afterwards users are managed through the API.
+func (a *AuthService) EnsureAdmin(ctx context.Context) error {
+	users, err := a.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+	hash := a.password
+	if !isBcryptHash(hash) {
+		log.Printf("auth.password is plaintext; consider replacing it with the output of `bark-secure-proxy hash-password`")
+		generated, err := bcrypt.GenerateFromPassword([]byte(a.password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hash = string(generated)
+	}
+	log.Printf("seeding admin user %q from config", a.username)
+	return a.store.SaveUser(ctx, &model.User{
+		Username:           a.username,
+		PasswordHash:       hash,
+		Role:               model.RoleAdmin,
+		MustChangePassword: a.password == defaultPassword,
+	})
+}
+
+// Authenticate validates user credentials and returns a JWT token, or a
+// login challenge when the user has two-factor login enabled. Repeated
+// failures from the same username or IP are throttled with a LockoutError.
+func (a *AuthService) Authenticate(ctx context.Context, username, password string) (*LoginResult, error) {
 	if !a.Enabled() {
-		return "", nil
+		return &LoginResult{}, nil
+	}
+	ip := clientFrom(ctx).ip
+	release, err := a.guard.reserve(ctx, username, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		a.guard.fail(ctx, username, ip, "unknown user")
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		a.guard.fail(ctx, username, ip, "wrong password")
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		a.guard.fail(ctx, username, ip, "disabled")
+		return nil, ErrInvalidCredentials
 	}
-	if !a.matchUsername(username) || !a.matchPassword(password) {
-		return "", errors.New("用户名或密码错误")
+	if password == defaultPassword && !user.MustChangePassword {
+		user.MustChangePassword = true
+		if err := a.store.SaveUser(ctx, user); err != nil {
+			return nil, err
+		}
 	}
+	if user.TOTPEnabled {
+		challenge, err := a.issueChallenge(user)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{Challenge: challenge, User: user}, nil
+	}
+	a.guard.succeed(ctx, user.Username, ip)
+	return a.startSession(ctx, user, "")
+}
+
+// issue signs a short-lived access token for session.
+func (a *AuthService) issue(user *model.User, session *model.Session) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(a.accessTTL)
 	claims := Claims{
-		Username: a.username,
+		Provider:           session.Provider,
+		SessionID:          session.ID,
+		Username:           user.Username,
+		Role:               user.Role,
+		MustChangePassword: user.MustChangePassword,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(12 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString(a.secret)
-	if err != nil {
-		return "", err
-	}
-	return signed, nil
+	token, err := a.keys.sign(claims)
+	return token, expires, err
 }
 
 // Validate parses a token and returns its claims if valid.
 func (a *AuthService) Validate(token string) (*Claims, error) {
 	if !a.Enabled() {
-		return &Claims{Username: "anonymous"}, nil
+		return &Claims{Username: "anonymous", Role: model.RoleAdmin}, nil
 	}
-	parsed, err := jwt.ParseWithClaims(token, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		return a.secret, nil
-	})
+	claims := &Claims{}
+	parsed, err := a.keys.parse(token, claims)
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := parsed.Claims.(*Claims); ok && parsed.Valid {
-		return claims, nil
+	if !parsed.Valid || claims.Purpose != "" || claims.SessionID == "" || !model.ValidRole(claims.Role) {
+		return nil, errors.New("token 无效")
+	}
+	// Access tokens are short-lived, but checking the session makes logout
+	// and revocation take effect immediately.
+	session, err := a.store.GetSession(context.Background(), claims.SessionID)
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		return nil, errors.New("登录已失效")
 	}
-	return nil, errors.New("token 无效")
+	return claims, nil
 }
 
-func (a *AuthService) matchUsername(input string) bool {
-	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(input)), []byte(a.username)) == 1
+// ChangePassword replaces a user's password after verifying the current one,
+// ends the user's other sessions and returns a fresh login without the
+// password-change restriction.
+func (a *AuthService) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) (*LoginResult, error) {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	if user.Disabled || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(oldPassword)) != nil {
+		return nil, errors.New("原密码错误")
+	}
+	if newPassword == oldPassword {
+		return nil, errors.New("新密码不能与原密码相同")
+	}
+	if newPassword == defaultPassword {
+		return nil, errors.New("不能使用默认密码")
+	}
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	before := snapshot(user)
+	user.PasswordHash = hash
+	user.MustChangePassword = false
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.audit.Record(ctx, AuditPasswordChange, user.Username, before, user)
+	if _, err := a.revokeSessions(ctx, user.Username, ""); err != nil {
+		return nil, err
+	}
+	return a.startSession(ctx, user, "")
+}
+
+// HashPassword returns the bcrypt hash of password for use in config files.
+func HashPassword(password string) (string, error) {
+	return hashPassword(password)
+}
+
+// ListUsers returns all admin users.
+func (a *AuthService) ListUsers(ctx context.Context) ([]*model.User, error) {
+	return a.store.ListUsers(ctx)
+}
+
+// CreateUser adds a new admin user.
+func (a *AuthService) CreateUser(ctx context.Context, req UserRequest) (*model.User, error) {
+	username := strings.TrimSpace(req.Username)
+	if username == "" {
+		return nil, fmt.Errorf("username is required")
+	}
+	if strings.HasPrefix(model.NormalizeUsername(username), OIDCUsernamePrefix) {
+		return nil, fmt.Errorf("usernames starting with %q are reserved for single sign-on", OIDCUsernamePrefix)
+	}
+	if !model.ValidRole(req.Role) {
+		return nil, fmt.Errorf("unknown role %q", req.Role)
+	}
+	if _, err := a.store.GetUser(ctx, username); err == nil {
+		return nil, fmt.Errorf("user %s already exists", username)
+	} else if err != storage.ErrNotFound {
+		return nil, err
+	}
+	if req.Password == defaultPassword {
+		return nil, fmt.Errorf("the default password is not allowed")
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{Username: username, PasswordHash: hash, Role: req.Role}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.audit.Record(ctx, AuditUserCreate, user.Username, nil, user)
+	return user, nil
 }
 
-func (a *AuthService) matchPassword(input string) bool {
-	if strings.HasPrefix(a.password, "$2a$") || strings.HasPrefix(a.password, "$2b$") || strings.HasPrefix(a.password, "$2y$") {
-		return bcrypt.CompareHashAndPassword([]byte(a.password), []byte(input)) == nil
+// UpdateUser changes a user's password, role or disabled flag.
+func (a *AuthService) UpdateUser(ctx context.Context, username string, req UserRequest) (*model.User, error) {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	before := snapshot(user)
+	if req.Role != "" && !model.ValidRole(req.Role) {
+		return nil, fmt.Errorf("unknown role %q", req.Role)
+	}
+	demoted := req.Role != "" && req.Role != model.RoleAdmin
+	disabled := req.Disabled != nil && *req.Disabled
+	if user.Role == model.RoleAdmin && (demoted || disabled) {
+		if err := a.ensureOtherAdmin(ctx, user.Username); err != nil {
+			return nil, err
+		}
+	}
+	if req.Password != "" {
+		if req.Password == defaultPassword {
+			return nil, fmt.Errorf("the default password is not allowed")
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = hash
 	}
-	return subtle.ConstantTimeCompare([]byte(input), []byte(a.password)) == 1
+	roleChanged := req.Role != "" && req.Role != user.Role
+	if req.Role != "" {
+		user.Role = req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if req.ResetTOTP {
+		clearTOTP(user)
+	}
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.audit.Record(ctx, AuditUserUpdate, user.Username, before, user)
+	// Tokens carry the role, so a changed role must not outlive the
+	// sessions issued under the old one.
+	if user.Disabled || req.Password != "" || roleChanged {
+		if _, err := a.revokeSessions(ctx, user.Username, ""); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// DeleteUser removes a user. The last enabled admin cannot be removed.
+func (a *AuthService) DeleteUser(ctx context.Context, username string) error {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user.Role == model.RoleAdmin {
+		if err := a.ensureOtherAdmin(ctx, user.Username); err != nil {
+			return err
+		}
+	}
+	if err := a.store.DeleteUser(ctx, username); err != nil {
+		return err
+	}
+	a.audit.Record(ctx, AuditUserDelete, user.Username, user, nil)
+	_, err = a.revokeSessions(ctx, user.Username, "")
+	return err
+}
+
+func (a *AuthService) ensureOtherAdmin(ctx context.Context, username string) error {
+	users, err := a.store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Role == model.RoleAdmin && !u.Disabled && model.NormalizeUsername(u.Username) != model.NormalizeUsername(username) {
+			return nil
+		}
+	}
+	return fmt.Errorf("at least one enabled admin is required")
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isBcryptHash(value string) bool {
+	return strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$")
 }
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// EncryptedBackupExt is appended to the names of encrypted backup files.
+const EncryptedBackupExt = ".enc"
+
+// BackupService writes database snapshots, on demand or on a schedule into
+// a local directory that keeps the newest few.
+type BackupService struct {
+	store      storage.Store
+	dir        string
+	interval   time.Duration
+	keep       int
+	passphrase string
+	// prefix and ext name backup files after the database file, e.g.
+	// devices-20250101-120000.db.
+	prefix string
+	ext    string
+	// disabled is set for the memory driver, which has no file to back up.
+	disabled bool
+}
+
+// NewBackupService builds the backup service.
+func NewBackupService(store storage.Store, cfg *config.Config) *BackupService {
+	base := filepath.Base(cfg.Storage.Path)
+	ext := filepath.Ext(base)
+	return &BackupService{
+		store:      store,
+		dir:        cfg.Backup.Dir,
+		interval:   cfg.Backup.Interval,
+		keep:       cfg.Backup.Keep,
+		passphrase: cfg.Backup.Passphrase,
+		prefix:     strings.TrimSuffix(base, ext) + "-",
+		ext:        ext,
+		disabled:   strings.EqualFold(strings.TrimSpace(cfg.Storage.Driver), "memory"),
+	}
+}
+
+// Enabled reports whether the configured storage driver can be backed up.
+func (s *BackupService) Enabled() bool {
+	return !s.disabled
+}
+
+// Write streams a snapshot to w, encrypted with passphrase or, if that is
+// empty, with the configured one. It returns the snapshot size and whether
+// it was encrypted.
+func (s *BackupService) Write(ctx context.Context, w io.Writer, passphrase string) (int64, bool, error) {
+	if s.disabled {
+		return 0, false, storage.ErrNotSupported
+	}
+	if passphrase == "" {
+		passphrase = s.passphrase
+	}
+	if passphrase == "" {
+		n, err := s.store.Backup(ctx, w)
+		return n, false, err
+	}
+	enc, err := crypto.NewEncryptWriter(w, passphrase)
+	if err != nil {
+		return 0, true, err
+	}
+	n, err := s.store.Backup(ctx, enc)
+	if err != nil {
+		return n, true, err
+	}
+	return n, true, enc.Close()
+}
+
+// FileName is the name a backup taken at t is saved under.
+func (s *BackupService) FileName(t time.Time, encrypted bool) string {
+	name := s.prefix + t.UTC().Format("20060102-150405") + s.ext
+	if encrypted {
+		name += EncryptedBackupExt
+	}
+	return name
+}
+
+// Create writes a backup into the backup directory and removes the ones
+// beyond the configured count. It returns the new file's path.
+func (s *BackupService) Create(ctx context.Context) (string, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, encrypted, err := s.Write(ctx, tmp, "")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, s.FileName(time.Now(), encrypted))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	s.rotate()
+	return path, nil
+}
+
+// rotate deletes all but the newest keep backups. Names sort by time, so
+// the oldest come first.
+func (s *BackupService) rotate() {
+	if s.keep <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("list backups: %v", err)
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, s.prefix) &&
+			(strings.HasSuffix(name, s.ext) || strings.HasSuffix(name, s.ext+EncryptedBackupExt)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for len(names) > s.keep {
+		if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil {
+			log.Printf("remove old backup %s: %v", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+// Run takes a backup every interval until ctx is cancelled. It does nothing
+// when no interval is configured or the storage driver cannot be backed up.
+func (s *BackupService) Run(ctx context.Context) {
+	if s.interval <= 0 || s.disabled {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if path, err := s.Create(ctx); err != nil {
+			log.Printf("scheduled backup failed: %v", err)
+		} else {
+			log.Printf("scheduled backup written to %s", path)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// DeviceDeleteOptions controls how a device is deleted.
+type DeviceDeleteOptions struct {
+	// Logs is what happens to the device's push logs: keep, purge or
+	// anonymize. Empty uses devices.deleted_logs.
+	Logs string
+	// Permanent skips the restore window.
+	Permanent bool
+}
+
+// DeviceDeleteResult describes a deleted or purged device.
+type DeviceDeleteResult struct {
+	DeviceToken string `json:"deviceToken"`
+	DeviceKey   string `json:"deviceKey"`
+	Permanent   bool   `json:"permanent"`
+	// PurgeAt is when a soft-deleted device will be removed for good.
+	PurgeAt *time.Time `json:"purgeAt,omitempty"`
+	Logs    string     `json:"logs"`
+	// LogsAffected counts the push logs purged or anonymized. The logs of a
+	// soft-deleted device are left alone until it is purged.
+	LogsAffected int `json:"logsAffected"`
+}
+
+// Delete removes a device. Unless opts.Permanent is set or no restore
+// window is configured, the device is moved to the deleted list, from which
+// Restore can bring it back until the window ends; its push logs are only
+// purged or anonymized once it is removed for good.
+func (s *DeviceService) Delete(ctx context.Context, token string, opts DeviceDeleteOptions) (*DeviceDeleteResult, error) {
+	policy, err := s.deletedLogPolicy(opts.Logs)
+	if err != nil {
+		return nil, err
+	}
+	device, err := s.store.GetDevice(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	// A token deleted before, registered again and now deleted once more
+	// replaces its earlier entry, which is finalized first.
+	if earlier, err := s.store.GetDeletedDevice(ctx, token); err == nil {
+		if _, err := s.purge(ctx, earlier, earlier.LogPolicy); err != nil {
+			return nil, err
+		}
+	} else if err != storage.ErrNotFound {
+		return nil, err
+	}
+
+	window := s.cfg.Devices.RestoreWindow
+	if opts.Permanent || window <= 0 {
+		if err := s.store.DeleteDevice(ctx, token); err != nil {
+			return nil, err
+		}
+		result := &DeviceDeleteResult{DeviceToken: device.DeviceToken, DeviceKey: device.DeviceKey, Permanent: true, Logs: policy}
+		result.LogsAffected, err = s.applyLogPolicy(ctx, device.DeviceKey, policy)
+		s.audit.RecordMeta(ctx, AuditDeviceDelete, device.DeviceKey, device, nil, map[string]any{
+			"permanent":    true,
+			"logs":         policy,
+			"logsAffected": result.LogsAffected,
+		})
+		return result, err
+	}
+
+	now := time.Now().UTC()
+	deleted := &model.DeletedDevice{
+		Device:    device,
+		LogPolicy: policy,
+		DeletedBy: actorFrom(ctx).name,
+		DeletedAt: now,
+		PurgeAt:   now.Add(window),
+	}
+	if err := s.store.SaveDeletedDevice(ctx, deleted); err != nil {
+		return nil, err
+	}
+	if err := s.store.DeleteDevice(ctx, token); err != nil {
+		s.store.DeleteDeletedDevice(context.WithoutCancel(ctx), token)
+		return nil, err
+	}
+	s.audit.RecordMeta(ctx, AuditDeviceDelete, device.DeviceKey, device, nil, map[string]any{
+		"permanent": false,
+		"logs":      policy,
+		"purgeAt":   deleted.PurgeAt,
+	})
+	return &DeviceDeleteResult{DeviceToken: device.DeviceToken, DeviceKey: device.DeviceKey, PurgeAt: &deleted.PurgeAt, Logs: policy}, nil
+}
+
+// ListDeleted returns the soft-deleted devices, most recently deleted first.
+func (s *DeviceService) ListDeleted(ctx context.Context) ([]*model.DeletedDevice, error) {
+	list, err := s.store.ListDeletedDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list, nil
+}
+
+// GetDeleted returns a soft-deleted device by token.
+func (s *DeviceService) GetDeleted(ctx context.Context, token string) (*model.DeletedDevice, error) {
+	return s.store.GetDeletedDevice(ctx, token)
+}
+
+// Restore brings back a soft-deleted device with the status it had. It
+// fails if the token or device key has been registered again since.
+func (s *DeviceService) Restore(ctx context.Context, token string) (*model.Device, error) {
+	deleted, err := s.store.GetDeletedDevice(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	device := deleted.Device
+	if _, err := s.store.GetDevice(ctx, token); err == nil {
+		return nil, fmt.Errorf("deviceToken %s has been registered again", token)
+	} else if err != storage.ErrNotFound {
+		return nil, err
+	}
+	if device.DeviceKey != "" {
+		if _, err := s.store.GetDeviceByKey(ctx, device.DeviceKey); err == nil {
+			return nil, fmt.Errorf("deviceKey %s is in use by another device", device.DeviceKey)
+		} else if err != storage.ErrNotFound {
+			return nil, err
+		}
+	}
+	if err := s.store.UpsertDevice(ctx, device); err != nil {
+		return nil, err
+	}
+	if err := s.store.DeleteDeletedDevice(ctx, token); err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	s.audit.Record(ctx, AuditDeviceRestore, device.DeviceKey, nil, device)
+	return device, nil
+}
+
+// Purge removes a soft-deleted device for good without waiting for its
+// restore window. A non-empty logs overrides the policy chosen when it was
+// deleted.
+func (s *DeviceService) Purge(ctx context.Context, token, logs string) (*DeviceDeleteResult, error) {
+	deleted, err := s.store.GetDeletedDevice(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	policy := deleted.LogPolicy
+	if strings.TrimSpace(logs) != "" {
+		if policy, err = s.deletedLogPolicy(logs); err != nil {
+			return nil, err
+		}
+	}
+	return s.purge(ctx, deleted, policy)
+}
+
+// PurgeExpired purges the soft-deleted devices whose restore window has
+// ended and returns how many were removed.
+func (s *DeviceService) PurgeExpired(ctx context.Context) (int, error) {
+	list, err := s.store.ListDeletedDevices(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	purged := 0
+	for _, deleted := range list {
+		if deleted.PurgeAt.After(now) {
+			continue
+		}
+		if _, err := s.purge(ctx, deleted, deleted.LogPolicy); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunPurge purges expired deleted devices every devices.purge_interval
+// until ctx is cancelled.
+func (s *DeviceService) RunPurge(ctx context.Context) {
+	interval := s.cfg.Devices.PurgeInterval
+	if interval <= 0 {
+		return
+	}
+	ctx = WithActor(ctx, "system", "")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.PurgeExpired(ctx); err != nil {
+			log.Printf("purge deleted devices failed: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted devices", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *DeviceService) purge(ctx context.Context, deleted *model.DeletedDevice, policy string) (*DeviceDeleteResult, error) {
+	device := deleted.Device
+	if err := s.store.DeleteDeletedDevice(ctx, device.DeviceToken); err != nil {
+		return nil, err
+	}
+	result := &DeviceDeleteResult{DeviceToken: device.DeviceToken, DeviceKey: device.DeviceKey, Permanent: true, Logs: policy}
+	var err error
+	result.LogsAffected, err = s.applyLogPolicy(ctx, device.DeviceKey, policy)
+	s.audit.RecordMeta(ctx, AuditDevicePurge, device.DeviceKey, nil, nil, map[string]any{
+		"logs":         policy,
+		"logsAffected": result.LogsAffected,
+	})
+	return result, err
+}
+
+// applyLogPolicy purges or anonymizes the push logs of deviceKey. Logs are
+// left alone if another device has taken the key over in the meantime.
+func (s *DeviceService) applyLogPolicy(ctx context.Context, deviceKey, policy string) (int, error) {
+	if policy == model.DeviceLogsKeep || strings.TrimSpace(deviceKey) == "" {
+		return 0, nil
+	}
+	if _, err := s.store.GetDeviceByKey(ctx, deviceKey); err == nil {
+		return 0, nil
+	} else if err != storage.ErrNotFound {
+		return 0, err
+	}
+	if policy == model.DeviceLogsPurge {
+		return s.store.DeleteDeviceNoticeLogs(ctx, deviceKey)
+	}
+	return s.store.AnonymizeDeviceNoticeLogs(ctx, deviceKey)
+}
+
+func (s *DeviceService) deletedLogPolicy(logs string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(firstNonEmpty(logs, s.cfg.Devices.DeletedLogs, model.DeviceLogsKeep)))
+	switch policy {
+	case model.DeviceLogsKeep, model.DeviceLogsPurge, model.DeviceLogsAnonymize:
+		return policy, nil
+	}
+	return "", fmt.Errorf("logs must be keep, purge or anonymize")
+}
@@ -17,6 +17,7 @@ type DeviceService struct {
 	store storage.Store
 	cfg   *config.Config
 	bark  *barkclient.Client
+	audit *AuditService
 }
 
 // DeviceRequest describes upsert payload.
@@ -34,8 +35,8 @@ type DeviceRequest struct {
 }
 
 // NewDeviceService constructs DeviceService.
-func NewDeviceService(store storage.Store, cfg *config.Config, bark *barkclient.Client) *DeviceService {
-	return &DeviceService{store: store, cfg: cfg, bark: bark}
+func NewDeviceService(store storage.Store, cfg *config.Config, bark *barkclient.Client, audit *AuditService) *DeviceService {
+	return &DeviceService{store: store, cfg: cfg, bark: bark, audit: audit}
 }
 
 // RegisterDevice proxies Bark /register and caches the device key.
@@ -60,6 +61,10 @@ func (s *DeviceService) RegisterDevice(ctx context.Context, deviceToken, key str
 		}
 		device = &model.Device{DeviceToken: resp.Data.DeviceToken}
 	}
+	before := snapshot(device)
+	if before.DeviceKey == "" {
+		before = nil
+	}
 	device.DeviceKey = resp.Data.DeviceKey
 	if device.Status == "" {
 		device.Status = model.DeviceStatusActive
@@ -67,6 +72,7 @@ func (s *DeviceService) RegisterDevice(ctx context.Context, deviceToken, key str
 	if err := s.store.UpsertDevice(ctx, device); err != nil {
 		return nil, err
 	}
+	s.audit.Record(ctx, AuditDeviceRegister, device.DeviceKey, before, device)
 	return resp, nil
 }
 
@@ -94,6 +100,10 @@ func (s *DeviceService) Upsert(ctx context.Context, req DeviceRequest) (*model.D
 		}
 		device = &model.Device{DeviceToken: req.DeviceToken}
 	}
+	var before *model.Device
+	if !device.CreatedAt.IsZero() {
+		before = snapshot(device)
+	}
 
 	device.Name = req.Name
 	device.Status = firstNonEmpty(strings.ToUpper(req.Status), model.DeviceStatusActive)
@@ -153,6 +163,7 @@ func (s *DeviceService) Upsert(ctx context.Context, req DeviceRequest) (*model.D
 	if err := s.store.UpsertDevice(ctx, device); err != nil {
 		return nil, err
 	}
+	s.audit.Record(ctx, AuditDeviceUpsert, device.DeviceKey, before, device)
 
 	return device, nil
 }
@@ -164,17 +175,30 @@ func (s *DeviceService) List(ctx context.Context) ([]*model.Device, error) {
 
 // ListViews returns masked device views.
 func (s *DeviceService) ListViews(ctx context.Context) ([]*model.DeviceView, error) {
+	return s.ListViewsMatching(ctx, nil)
+}
+
+// ListViewsMatching returns masked views of devices accepted by match; a nil
+// match accepts every device.
+func (s *DeviceService) ListViewsMatching(ctx context.Context, match func(*model.Device) bool) ([]*model.DeviceView, error) {
 	devices, err := s.List(ctx)
 	if err != nil {
 		return nil, err
 	}
 	views := make([]*model.DeviceView, 0, len(devices))
 	for _, device := range devices {
-		views = append(views, toView(device))
+		if match == nil || match(device) {
+			views = append(views, toView(device))
+		}
 	}
 	return views, nil
 }
 
+// ListActive returns devices that receive broadcasts.
+func (s *DeviceService) ListActive(ctx context.Context) ([]*model.Device, error) {
+	return s.store.ListActiveDevices(ctx)
+}
+
 // Get returns device by token.
 func (s *DeviceService) Get(ctx context.Context, token string) (*model.Device, error) {
 	return s.store.GetDevice(ctx, token)
@@ -186,6 +210,7 @@ func (s *DeviceService) UpdateStatus(ctx context.Context, token, status string)
 	if err != nil {
 		return nil, err
 	}
+	before := snapshot(device)
 	device.Status = strings.ToUpper(strings.TrimSpace(status))
 	if device.Status == "" {
 		device.Status = model.DeviceStatusActive
@@ -193,6 +218,7 @@ func (s *DeviceService) UpdateStatus(ctx context.Context, token, status string)
 	if err := s.store.UpsertDevice(ctx, device); err != nil {
 		return nil, err
 	}
+	s.audit.Record(ctx, AuditDeviceStatus, device.DeviceKey, before, device)
 	return device, nil
 }
 
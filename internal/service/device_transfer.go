@@ -0,0 +1,580 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// Device export/import formats. DeviceFormatBarkAPI reads the device table
+// of the Java bark-api, exported as CSV or JSON (a bare array or its
+// BasicResponse envelope).
+const (
+	DeviceFormatJSON    = "json"
+	DeviceFormatCSV     = "csv"
+	DeviceFormatBarkAPI = "bark-api"
+)
+
+// Conflict policies for importing a device whose token already exists.
+const (
+	// ConflictSkip keeps the existing device.
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces it with the imported one.
+	ConflictOverwrite = "overwrite"
+	// ConflictMerge fills in the imported fields that are not empty.
+	ConflictMerge = "merge"
+)
+
+// Import actions reported per row.
+const (
+	ImportCreate    = "create"
+	ImportOverwrite = "overwrite"
+	ImportMerge     = "merge"
+	ImportSkip      = "skip"
+	ImportUnchanged = "unchanged"
+	ImportError     = "error"
+)
+
+// deviceColumns is the CSV header of exported devices; the names match the
+// JSON fields of model.Device.
+var deviceColumns = []string{"deviceToken", "deviceKey", "name", "algorithm", "model", "padding", "encodeKey", "iv", "status", "createdAt", "updatedAt"}
+
+// deviceFieldAliases maps normalized column names (lower-case, without "_"
+// and "-") to a deviceColumns entry. It covers our own export and the
+// snake_case and camelCase columns of bark-api.
+var deviceFieldAliases = map[string]string{
+	"devicetoken": "deviceToken",
+	"token":       "deviceToken",
+	"devicekey":   "deviceKey",
+	"name":        "name",
+	"devicename":  "name",
+	"algorithm":   "algorithm",
+	"model":       "model",
+	"mode":        "model",
+	"padding":     "padding",
+	"encodekey":   "encodeKey",
+	"iv":          "iv",
+	"status":      "status",
+	"createdat":   "createdAt",
+	"createtime":  "createdAt",
+	"gmtcreate":   "createdAt",
+	"updatedat":   "updatedAt",
+	"updatetime":  "updatedAt",
+	"gmtmodified": "updatedAt",
+}
+
+// DeviceImportOptions controls Import.
+type DeviceImportOptions struct {
+	Conflict string `json:"conflict"`
+	DryRun   bool   `json:"dryRun"`
+}
+
+// DeviceImportItem is the outcome for one imported row. Tokens and keys are
+// masked.
+type DeviceImportItem struct {
+	Row         int    `json:"row"`
+	DeviceToken string `json:"deviceToken"`
+	DeviceKey   string `json:"deviceKey"`
+	Action      string `json:"action"`
+	Error       string `json:"error,omitempty"`
+}
+
+// DeviceImportReport summarizes an import. With DryRun set nothing was
+// written and the counts say what would have happened.
+type DeviceImportReport struct {
+	DryRun    bool               `json:"dryRun"`
+	Conflict  string             `json:"conflict"`
+	Total     int                `json:"total"`
+	Created   int                `json:"created"`
+	Updated   int                `json:"updated"`
+	Skipped   int                `json:"skipped"`
+	Unchanged int                `json:"unchanged"`
+	Failed    int                `json:"failed"`
+	Items     []DeviceImportItem `json:"items"`
+}
+
+// Export writes every device, including keys, in format and returns how
+// many were written.
+func (s *DeviceService) Export(ctx context.Context, w io.Writer, format string) (int, error) {
+	devices, err := s.store.ListDevices(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if devices == nil {
+		devices = []*model.Device{}
+	}
+	switch format {
+	case DeviceFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(devices); err != nil {
+			return 0, err
+		}
+	case DeviceFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(deviceColumns); err != nil {
+			return 0, err
+		}
+		for _, d := range devices {
+			record := []string{d.DeviceToken, d.DeviceKey, d.Name, d.Algorithm, d.Mode, d.Padding, d.EncodeKey, d.IV, d.Status, formatTime(d.CreatedAt), formatTime(d.UpdatedAt)}
+			if err := cw.Write(record); err != nil {
+				return 0, err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported export format %q", format)
+	}
+	s.audit.RecordMeta(ctx, AuditDeviceExport, format, nil, nil, map[string]any{"devices": len(devices)})
+	return len(devices), nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ParseDevices reads devices in format. Columns are matched by name, so
+// their order does not matter and unknown columns are ignored.
+func ParseDevices(r io.Reader, format string) ([]*model.Device, error) {
+	var rows []map[string]string
+	var err error
+	switch format {
+	case DeviceFormatJSON:
+		rows, err = parseJSONRows(r)
+	case DeviceFormatCSV:
+		rows, err = parseCSVRows(r)
+	case DeviceFormatBarkAPI:
+		br := bufio.NewReader(r)
+		if looksLikeJSON(br) {
+			rows, err = parseJSONRows(br)
+		} else {
+			rows, err = parseCSVRows(br)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*model.Device, 0, len(rows))
+	for i, row := range rows {
+		device, err := deviceFromRow(row)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+func looksLikeJSON(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		case 0xEF:
+			// UTF-8 byte order mark, as written by some database tools.
+			if bom, err := r.Peek(3); err == nil && bytes.Equal(bom, []byte{0xEF, 0xBB, 0xBF}) {
+				r.Discard(3)
+				continue
+			}
+			return false
+		default:
+			return b[0] == '[' || b[0] == '{'
+		}
+	}
+}
+
+// parseJSONRows accepts an array of objects or a BasicResponse whose data
+// is one, either directly or as a page with a records/list/data array.
+func parseJSONRows(r io.Reader) ([]map[string]string, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	items, ok := findRows(doc, 0)
+	if !ok {
+		return nil, fmt.Errorf("expected an array of devices")
+	}
+	rows := make([]map[string]string, 0, len(items))
+	for i, item := range items {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("row %d: expected an object", i+1)
+		}
+		row := make(map[string]string, len(obj))
+		for k, v := range obj {
+			// Nested values are never device fields and are dropped.
+			switch v := v.(type) {
+			case string:
+				row[k] = v
+			case json.Number:
+				row[k] = v.String()
+			case bool:
+				row[k] = strconv.FormatBool(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func findRows(doc any, depth int) ([]any, bool) {
+	switch v := doc.(type) {
+	case []any:
+		return v, true
+	case map[string]any:
+		if depth > 2 {
+			return nil, false
+		}
+		for _, key := range []string{"data", "records", "list", "rows"} {
+			if inner, ok := v[key]; ok {
+				return findRows(inner, depth+1)
+			}
+		}
+	}
+	return nil, false
+}
+
+func parseCSVRows(r io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	var rows []map[string]string
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		row := make(map[string]string, len(header))
+		for i, value := range record {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func deviceFromRow(row map[string]string) (*model.Device, error) {
+	fields := make(map[string]string, len(row))
+	for column, value := range row {
+		normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(column))
+		if field, ok := deviceFieldAliases[normalized]; ok {
+			fields[field] = strings.TrimSpace(value)
+		}
+	}
+	device := &model.Device{
+		DeviceToken: fields["deviceToken"],
+		DeviceKey:   fields["deviceKey"],
+		Name:        fields["name"],
+		Algorithm:   fields["algorithm"],
+		Mode:        fields["model"],
+		Padding:     fields["padding"],
+		EncodeKey:   fields["encodeKey"],
+		IV:          fields["iv"],
+		Status:      strings.ToUpper(fields["status"]),
+	}
+	var err error
+	if device.CreatedAt, err = parseImportTime(fields["createdAt"]); err != nil {
+		return nil, fmt.Errorf("createdAt: %w", err)
+	}
+	if device.UpdatedAt, err = parseImportTime(fields["updatedAt"]); err != nil {
+		return nil, fmt.Errorf("updatedAt: %w", err)
+	}
+	return device, nil
+}
+
+// parseImportTime accepts RFC 3339, bark-api's "2006-01-02 15:04:05" (taken
+// as UTC) and Unix milliseconds.
+func parseImportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// Import stores devices according to opts. Every row is validated; invalid
+// rows, repeated tokens and keys owned by another device are reported and
+// skipped without stopping the import. Devices are never registered with
+// Bark here, so each needs its deviceKey.
+func (s *DeviceService) Import(ctx context.Context, devices []*model.Device, opts DeviceImportOptions) (*DeviceImportReport, error) {
+	conflict := strings.ToLower(strings.TrimSpace(opts.Conflict))
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+	if conflict != ConflictSkip && conflict != ConflictOverwrite && conflict != ConflictMerge {
+		return nil, fmt.Errorf("unknown conflict policy %q", opts.Conflict)
+	}
+	report := &DeviceImportReport{DryRun: opts.DryRun, Conflict: conflict, Total: len(devices), Items: make([]DeviceImportItem, 0, len(devices))}
+	seen := make(map[string]int, len(devices))
+	for i, imported := range devices {
+		item := DeviceImportItem{Row: i + 1, DeviceToken: maskValue(imported.DeviceToken), DeviceKey: maskValue(imported.DeviceKey)}
+		action, err := s.importDevice(ctx, imported, conflict, opts.DryRun, seen, i+1)
+		if err != nil {
+			item.Action, item.Error = ImportError, err.Error()
+			report.Failed++
+		} else {
+			item.Action = action
+			switch action {
+			case ImportCreate:
+				report.Created++
+			case ImportOverwrite, ImportMerge:
+				report.Updated++
+			case ImportSkip:
+				report.Skipped++
+			case ImportUnchanged:
+				report.Unchanged++
+			}
+		}
+		report.Items = append(report.Items, item)
+	}
+	if !opts.DryRun && report.Created+report.Updated > 0 {
+		s.audit.RecordMeta(ctx, AuditDeviceImport, conflict, nil, nil, map[string]any{
+			"created": report.Created,
+			"updated": report.Updated,
+			"skipped": report.Skipped,
+			"failed":  report.Failed,
+		})
+	}
+	return report, nil
+}
+
+func (s *DeviceService) importDevice(ctx context.Context, imported *model.Device, conflict string, dryRun bool, seen map[string]int, row int) (string, error) {
+	if imported.DeviceToken == "" {
+		return "", fmt.Errorf("deviceToken is required")
+	}
+	if prev, ok := seen[imported.DeviceToken]; ok {
+		return "", fmt.Errorf("deviceToken repeats row %d", prev)
+	}
+	seen[imported.DeviceToken] = row
+
+	existing, err := s.store.GetDevice(ctx, imported.DeviceToken)
+	if err != nil && err != storage.ErrNotFound {
+		return "", err
+	}
+	action := ImportCreate
+	device := &model.Device{}
+	if existing != nil {
+		switch conflict {
+		case ConflictSkip:
+			return ImportSkip, nil
+		case ConflictOverwrite:
+			action = ImportOverwrite
+			device.CreatedAt = existing.CreatedAt
+		case ConflictMerge:
+			action = ImportMerge
+			*device = *existing
+		}
+	}
+	mergeDevice(device, imported)
+	device.Algorithm = firstNonEmpty(device.Algorithm, s.cfg.Crypto.DefaultAlgorithm)
+	device.Mode = firstNonEmpty(device.Mode, s.cfg.Crypto.DefaultMode)
+	device.Padding = firstNonEmpty(device.Padding, s.cfg.Crypto.DefaultPadding)
+	device.Status = firstNonEmpty(device.Status, model.DeviceStatusActive)
+	if device.DeviceKey == "" {
+		return "", fmt.Errorf("deviceKey is required")
+	}
+	if owner, err := s.store.GetDeviceByKey(ctx, device.DeviceKey); err == nil && owner.DeviceToken != device.DeviceToken {
+		return "", fmt.Errorf("deviceKey is in use by another device")
+	} else if err != nil && err != storage.ErrNotFound {
+		return "", err
+	}
+	if !isValidKeyLength(device.EncodeKey) {
+		return "", fmt.Errorf("encodeKey must be 16, 24 or 32 characters")
+	}
+	if len(device.IV) != s.cfg.Crypto.IVBytes {
+		return "", fmt.Errorf("iv must be %d characters", s.cfg.Crypto.IVBytes)
+	}
+	if existing != nil && sameDevice(existing, device) {
+		return ImportUnchanged, nil
+	}
+	if dryRun {
+		return action, nil
+	}
+	if err := s.store.UpsertDevice(ctx, device); err != nil {
+		return "", err
+	}
+	return action, nil
+}
+
+// mergeDevice copies the non-empty fields of src onto dst.
+func mergeDevice(dst, src *model.Device) {
+	dst.DeviceToken = src.DeviceToken
+	for _, f := range []struct{ dst, src *string }{
+		{&dst.DeviceKey, &src.DeviceKey},
+		{&dst.Name, &src.Name},
+		{&dst.Algorithm, &src.Algorithm},
+		{&dst.Mode, &src.Mode},
+		{&dst.Padding, &src.Padding},
+		{&dst.EncodeKey, &src.EncodeKey},
+		{&dst.IV, &src.IV},
+		{&dst.Status, &src.Status},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if !src.CreatedAt.IsZero() {
+		dst.CreatedAt = src.CreatedAt
+	}
+}
+
+func sameDevice(a, b *model.Device) bool {
+	return a.DeviceKey == b.DeviceKey && a.Name == b.Name && a.Algorithm == b.Algorithm &&
+		a.Mode == b.Mode && a.Padding == b.Padding && a.EncodeKey == b.EncodeKey &&
+		a.IV == b.IV && a.Status == b.Status && a.CreatedAt.Equal(b.CreatedAt)
+}
+
+// DeviceHandout is the per-device result of a bark-server import. Created
+// devices carry the generated key material the device's owner has to enter
+// in the Bark app; the token is masked.
+type DeviceHandout struct {
+	DeviceKey   string `json:"deviceKey"`
+	DeviceToken string `json:"deviceToken"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason,omitempty"`
+	Algorithm   string `json:"algorithm,omitempty"`
+	Mode        string `json:"model,omitempty"`
+	Padding     string `json:"padding,omitempty"`
+	EncodeKey   string `json:"encodeKey,omitempty"`
+	IV          string `json:"iv,omitempty"`
+}
+
+// BarkServerImportReport summarizes ImportBarkServer.
+type BarkServerImportReport struct {
+	DryRun  bool            `json:"dryRun"`
+	Total   int             `json:"total"`
+	Created int             `json:"created"`
+	Skipped int             `json:"skipped"`
+	Failed  int             `json:"failed"`
+	Devices []DeviceHandout `json:"devices"`
+}
+
+// ImportBarkServer adopts the key-to-token pairs of a bark-server database.
+// Each new device gets fresh encryption material and the PENDING status, so
+// it receives no broadcasts until its owner has entered the key in the Bark
+// app and it is activated. Devices the proxy already knows, by token or by
+// key, are left alone. bark-server keeps old keys after a re-registration,
+// so a token can appear several times; the first key wins. A dry run
+// generates no keys.
+func (s *DeviceService) ImportBarkServer(ctx context.Context, entries []*model.Device, dryRun bool) (*BarkServerImportReport, error) {
+	report := &BarkServerImportReport{DryRun: dryRun, Total: len(entries), Devices: make([]DeviceHandout, 0, len(entries))}
+	seen := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		handout := DeviceHandout{DeviceKey: entry.DeviceKey, DeviceToken: maskValue(entry.DeviceToken)}
+		device, reason, err := s.adoptBarkServerDevice(ctx, entry, dryRun, seen)
+		switch {
+		case err != nil:
+			handout.Action, handout.Reason = ImportError, err.Error()
+			report.Failed++
+		case reason != "":
+			handout.Action, handout.Reason = ImportSkip, reason
+			report.Skipped++
+		default:
+			handout.Action = ImportCreate
+			handout.Algorithm = device.Algorithm
+			handout.Mode = device.Mode
+			handout.Padding = device.Padding
+			handout.EncodeKey = device.EncodeKey
+			handout.IV = device.IV
+			report.Created++
+		}
+		report.Devices = append(report.Devices, handout)
+	}
+	if !dryRun && report.Created > 0 {
+		s.audit.RecordMeta(ctx, AuditDeviceImport, "bark-server", nil, nil, map[string]any{
+			"created": report.Created,
+			"skipped": report.Skipped,
+			"failed":  report.Failed,
+		})
+	}
+	return report, nil
+}
+
+// adoptBarkServerDevice returns the stored device, or a reason for skipping
+// the entry.
+func (s *DeviceService) adoptBarkServerDevice(ctx context.Context, entry *model.Device, dryRun bool, seen map[string]string) (*model.Device, string, error) {
+	if entry.DeviceKey == "" || entry.DeviceToken == "" {
+		return nil, "", fmt.Errorf("empty device key or token")
+	}
+	if key, ok := seen[entry.DeviceToken]; ok {
+		return nil, fmt.Sprintf("token already imported under key %s", key), nil
+	}
+	seen[entry.DeviceToken] = entry.DeviceKey
+	if _, err := s.store.GetDevice(ctx, entry.DeviceToken); err == nil {
+		return nil, "device already exists", nil
+	} else if err != storage.ErrNotFound {
+		return nil, "", err
+	}
+	if _, err := s.store.GetDeviceByKey(ctx, entry.DeviceKey); err == nil {
+		return nil, "device key already used by another device", nil
+	} else if err != storage.ErrNotFound {
+		return nil, "", err
+	}
+	device := &model.Device{
+		DeviceToken: entry.DeviceToken,
+		DeviceKey:   entry.DeviceKey,
+		Algorithm:   s.cfg.Crypto.DefaultAlgorithm,
+		Mode:        s.cfg.Crypto.DefaultMode,
+		Padding:     s.cfg.Crypto.DefaultPadding,
+		Status:      model.DeviceStatusPending,
+	}
+	if dryRun {
+		return device, "", nil
+	}
+	var err error
+	if device.EncodeKey, err = crypto.GenerateString(s.cfg.Crypto.KeyBytes); err != nil {
+		return nil, "", err
+	}
+	if device.IV, err = crypto.GenerateString(s.cfg.Crypto.IVBytes); err != nil {
+		return nil, "", err
+	}
+	if err := s.store.UpsertDevice(ctx, device); err != nil {
+		return nil, "", err
+	}
+	return device, "", nil
+}
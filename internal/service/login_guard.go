@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+const (
+	// recentFailureCount is how many failures are kept per counter for admins
+	// to inspect.
+	recentFailureCount = 10
+	// attemptPruneInterval throttles the sweep of stale counters.
+	attemptPruneInterval = 10 * time.Minute
+)
+
+// LockoutError is returned while logins for a username or IP are throttled.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("登录失败次数过多，请 %d 秒后重试", int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// loginGuard slows down password guessing. Each failure increments counters
+// for the username as tried from the client IP, for the username from any
+// IP, and for the IP alone; past free_attempts the next try must wait an
+// exponentially growing delay, and past the failure limit the subject is
+// locked out. The username-wide counter only delays and never locks, so it
+// throttles guesses spread over many addresses without letting anyone lock
+// an account out. Counters live in the store so restarts don't reset them.
+type loginGuard struct {
+	store           storage.Store
+	enabled         bool
+	freeAttempts    int
+	baseDelay       time.Duration
+	maxDelay        time.Duration
+	maxUserFailures int
+	maxIPFailures   int
+	lockout         time.Duration
+	resetAfter      time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	// inflight counts attempts that passed reserve and have not finished,
+	// per counter key.
+	inflight map[string]int
+}
+
+func newLoginGuard(store storage.Store, cfg *config.Config) *loginGuard {
+	c := cfg.Auth.Lockout
+	return &loginGuard{
+		store:           store,
+		enabled:         c.Enabled,
+		freeAttempts:    c.FreeAttempts,
+		baseDelay:       c.BaseDelay,
+		maxDelay:        c.MaxDelay,
+		maxUserFailures: c.MaxUserFailures,
+		maxIPFailures:   c.MaxIPFailures,
+		lockout:         c.Duration,
+		resetAfter:      c.ResetAfter,
+		inflight:        make(map[string]int),
+	}
+}
+
+func (g *loginGuard) keys(username, ip string) []*model.LoginAttempt {
+	keys := []*model.LoginAttempt{
+		{Kind: model.LoginAttemptUser, Subject: model.LoginAttemptUserSubject(username, ip)},
+		{Kind: model.LoginAttemptAccount, Subject: model.NormalizeUsername(username)},
+	}
+	if ip != "" {
+		keys = append(keys, &model.LoginAttempt{Kind: model.LoginAttemptIP, Subject: ip})
+	}
+	return keys
+}
+
+// reserve returns a LockoutError if any counter still requires waiting,
+// and otherwise admits the attempt. Attempts still in flight count as
+// failures, so concurrent requests cannot all slip past the same check. The
+// caller must call release once the attempt has been recorded.
+func (g *loginGuard) reserve(ctx context.Context, username, ip string) (release func(), err error) {
+	if !g.enabled {
+		return func() {}, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	keys := g.keys(username, ip)
+	var wait time.Duration
+	for _, key := range keys {
+		attempt, err := g.load(ctx, key, now)
+		if err != nil {
+			return nil, err
+		}
+		if n := g.inflight[key.Key()]; n > 0 {
+			pending := *attempt
+			pending.Failures += n
+			pending.LastFailure = now
+			attempt = &pending
+		}
+		if d := g.wait(attempt, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return nil, &LockoutError{RetryAfter: wait}
+	}
+	for _, key := range keys {
+		g.inflight[key.Key()]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for _, key := range keys {
+				if g.inflight[key.Key()]--; g.inflight[key.Key()] <= 0 {
+					delete(g.inflight, key.Key())
+				}
+			}
+		})
+	}, nil
+}
+
+// fail records a rejected login against the username and IP counters.
+func (g *loginGuard) fail(ctx context.Context, username, ip, reason string) {
+	if !g.enabled {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now().UTC()
+	for _, key := range g.keys(username, ip) {
+		attempt, err := g.load(ctx, key, now)
+		if err != nil {
+			log.Printf("load login attempts %s: %v", key.Key(), err)
+			continue
+		}
+		attempt.Failures++
+		attempt.LastFailure = now
+		attempt.Recent = append(attempt.Recent, model.LoginFailure{At: now, Username: username, IP: ip, Reason: reason})
+		if len(attempt.Recent) > recentFailureCount {
+			attempt.Recent = attempt.Recent[len(attempt.Recent)-recentFailureCount:]
+		}
+		if limit := g.limit(attempt.Kind); limit > 0 && attempt.Failures >= limit {
+			if !attempt.Locked(now) {
+				log.Printf("login locked for %s after %d failures", attempt.Key(), attempt.Failures)
+			}
+			until := now.Add(g.lockout)
+			attempt.LockedUntil = &until
+		}
+		if err := g.store.SaveLoginAttempt(ctx, attempt); err != nil {
+			log.Printf("save login attempts %s: %v", attempt.Key(), err)
+		}
+	}
+	if now.Sub(g.lastPrune) > attemptPruneInterval {
+		g.lastPrune = now
+		g.prune(ctx, now)
+	}
+}
+
+// succeed clears the username counters. The IP counter is left to expire so
+// that one valid account cannot be used to reset it.
+func (g *loginGuard) succeed(ctx context.Context, username, ip string) {
+	if !g.enabled {
+		return
+	}
+	for _, key := range g.keys(username, ip) {
+		if key.Kind == model.LoginAttemptIP {
+			continue
+		}
+		if err := g.store.DeleteLoginAttempt(ctx, key.Key()); err != nil && err != storage.ErrNotFound {
+			log.Printf("clear login attempts %s: %v", key.Key(), err)
+		}
+	}
+}
+
+// load returns the stored counter for key, or key itself when there is none
+// or it has gone stale.
+func (g *loginGuard) load(ctx context.Context, key *model.LoginAttempt, now time.Time) (*model.LoginAttempt, error) {
+	attempt, err := g.store.GetLoginAttempt(ctx, key.Key())
+	if err == storage.ErrNotFound {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.stale(attempt, now) {
+		return key, nil
+	}
+	return attempt, nil
+}
+
+func (g *loginGuard) stale(attempt *model.LoginAttempt, now time.Time) bool {
+	return !attempt.Locked(now) && now.Sub(attempt.LastFailure) > g.resetAfter
+}
+
+func (g *loginGuard) limit(kind string) int {
+	switch kind {
+	case model.LoginAttemptIP:
+		return g.maxIPFailures
+	case model.LoginAttemptAccount:
+		return 0
+	}
+	return g.maxUserFailures
+}
+
+// wait is how long the subject must hold off before the next attempt.
+func (g *loginGuard) wait(attempt *model.LoginAttempt, now time.Time) time.Duration {
+	var wait time.Duration
+	if attempt.Locked(now) {
+		wait = attempt.LockedUntil.Sub(now)
+	}
+	if extra := attempt.Failures - g.freeAttempts; extra > 0 && g.baseDelay > 0 {
+		delay := g.maxDelay
+		if extra <= 30 {
+			if d := g.baseDelay << (extra - 1); d < g.maxDelay || g.maxDelay <= 0 {
+				delay = d
+			}
+		}
+		if d := attempt.LastFailure.Add(delay).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (g *loginGuard) prune(ctx context.Context, now time.Time) {
+	attempts, err := g.store.ListLoginAttempts(ctx)
+	if err != nil {
+		return
+	}
+	for _, attempt := range attempts {
+		if g.stale(attempt, now) {
+			_ = g.store.DeleteLoginAttempt(ctx, attempt.Key())
+		}
+	}
+}
+
+// LoginAttempt is a failed-login counter as shown to admins.
+type LoginAttempt struct {
+	*model.LoginAttempt
+	Key        string `json:"key"`
+	Locked     bool   `json:"locked"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// LoginAttempts lists the active failed-login counters, throttled ones
+// first.
+func (a *AuthService) LoginAttempts(ctx context.Context) ([]LoginAttempt, error) {
+	attempts, err := a.store.ListLoginAttempts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := make([]LoginAttempt, 0, len(attempts))
+	for _, attempt := range attempts {
+		if a.guard.stale(attempt, now) {
+			continue
+		}
+		wait := a.guard.wait(attempt, now)
+		result = append(result, LoginAttempt{
+			LoginAttempt: attempt,
+			Key:          attempt.Key(),
+			Locked:       attempt.Locked(now),
+			RetryAfter:   int(math.Ceil(wait.Seconds())),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RetryAfter != result[j].RetryAfter {
+			return result[i].RetryAfter > result[j].RetryAfter
+		}
+		return result[i].LastFailure.After(result[j].LastFailure)
+	})
+	return result, nil
+}
+
+// ClearLoginAttempts resets the counter stored under key, lifting any
+// lockout.
+func (a *AuthService) ClearLoginAttempts(ctx context.Context, key string) error {
+	attempt, err := a.store.GetLoginAttempt(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := a.store.DeleteLoginAttempt(ctx, key); err != nil {
+		return err
+	}
+	a.audit.Record(ctx, AuditLoginAttemptsClear, key, attempt, nil)
+	return nil
+}
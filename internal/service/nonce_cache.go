@@ -0,0 +1,39 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers recently used request nonces so signed requests
+// cannot be replayed within the signature window.
+type NonceCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewNonceCache builds a cache that forgets nonces after ttl.
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	return &NonceCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// Use records nonce and reports whether it was unused.
+func (c *NonceCache) Use(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > c.ttl/4 {
+		for k, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if expires, ok := c.seen[nonce]; ok && !now.After(expires) {
+		return false
+	}
+	c.seen[nonce] = now.Add(c.ttl)
+	return true
+}
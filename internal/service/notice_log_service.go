@@ -21,123 +21,66 @@ func NewNoticeLogService(store storage.Store, deviceSvc *DeviceService) *NoticeL
 	return &NoticeLogService{store: store, deviceSvc: deviceSvc}
 }
 
-// Query returns paginated logs.
+// Query returns paginated logs. Without a page number it returns the page
+// after filter.Cursor instead.
 func (s *NoticeLogService) Query(ctx context.Context, filter model.NoticeLogFilter) (*model.NoticeLogPage, error) {
-	logs, err := s.filteredLogs(ctx, filter)
-	if err != nil {
-		return nil, err
-	}
-
-	total := len(logs)
 	if filter.PageSize <= 0 {
 		filter.PageSize = 10
 	}
 	if filter.PageSize > 100 {
 		filter.PageSize = 100
 	}
-	if filter.Page <= 0 {
-		filter.Page = 1
-	}
-
-	start := (filter.Page - 1) * filter.PageSize
-	if start > total {
-		start = total
-	}
-	end := start + filter.PageSize
-	if end > total {
-		end = total
-	}
-
-	pageLogs := logs[start:end]
-	pages := (total + filter.PageSize - 1) / filter.PageSize
-
-	return &model.NoticeLogPage{
-		Data:     pageLogs,
-		Total:    total,
-		Pages:    pages,
-		PageNum:  filter.Page,
-		PageSize: filter.PageSize,
-	}, nil
+	return s.store.QueryNoticeLogs(ctx, filter)
 }
 
 // CountByDate aggregates logs per day/month/year.
 func (s *NoticeLogService) CountByDate(ctx context.Context, dateType string, begin, end *time.Time) ([]map[string]any, error) {
-	filter := model.NoticeLogFilter{
-		BeginTime: begin,
-		EndTime:   end,
-	}
-	logs, err := s.filteredLogs(ctx, filter)
-	if err != nil {
-		return nil, err
-	}
-
-	layout := "2006-01-02"
+	groupBy := model.NoticeLogByDay
 	switch strings.ToLower(dateType) {
 	case "year":
-		layout = "2006"
+		groupBy = model.NoticeLogByYear
 	case "month":
-		layout = "2006-01"
+		groupBy = model.NoticeLogByMonth
 	}
-
-	counter := make(map[string]int)
-	for _, log := range logs {
-		key := log.CreatedAt.Format(layout)
-		counter[key]++
-	}
-
-	var result []map[string]any
-	for key, count := range counter {
-		result = append(result, map[string]any{
-			"date":  key,
-			"count": count,
-		})
+	counter, err := s.store.CountNoticeLogs(ctx, groupBy, begin, end)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i]["date"].(string) < result[j]["date"].(string)
-	})
-	return result, nil
+	return mapToKV(counter, "date"), nil
 }
 
 // CountByStatus aggregates by log status.
 func (s *NoticeLogService) CountByStatus(ctx context.Context, begin, end *time.Time) ([]map[string]any, error) {
-	filter := model.NoticeLogFilter{BeginTime: begin, EndTime: end}
-	logs, err := s.filteredLogs(ctx, filter)
+	counter, err := s.store.CountNoticeLogs(ctx, model.NoticeLogByStatus, begin, end)
 	if err != nil {
 		return nil, err
 	}
-	counter := make(map[string]int)
-	for _, log := range logs {
-		status := log.Status
-		if status == "" {
-			status = "UNKNOWN"
-		}
-		counter[status]++
+	if n, ok := counter[""]; ok {
+		delete(counter, "")
+		counter["UNKNOWN"] += n
 	}
 	return mapToKV(counter, "status"), nil
 }
 
 // CountByGroup aggregates by notification group.
 func (s *NoticeLogService) CountByGroup(ctx context.Context, begin, end *time.Time) ([]map[string]any, error) {
-	filter := model.NoticeLogFilter{BeginTime: begin, EndTime: end}
-	logs, err := s.filteredLogs(ctx, filter)
+	counter, err := s.store.CountNoticeLogs(ctx, model.NoticeLogByGroup, begin, end)
 	if err != nil {
 		return nil, err
 	}
-	counter := make(map[string]int)
-	for _, log := range logs {
-		group := strings.TrimSpace(log.Group)
-		if group == "" {
+	result := make(map[string]int, len(counter))
+	for group, n := range counter {
+		if group = strings.TrimSpace(group); group == "" {
 			group = "DEFAULT"
 		}
-		counter[group]++
+		result[group] += n
 	}
-	return mapToKV(counter, "group"), nil
+	return mapToKV(result, "group"), nil
 }
 
 // CountByDevice aggregates using device names when available.
 func (s *NoticeLogService) CountByDevice(ctx context.Context, begin, end *time.Time) ([]map[string]any, error) {
-	filter := model.NoticeLogFilter{BeginTime: begin, EndTime: end}
-	logs, err := s.filteredLogs(ctx, filter)
+	perKey, err := s.store.CountNoticeLogs(ctx, model.NoticeLogByDevice, begin, end)
 	if err != nil {
 		return nil, err
 	}
@@ -155,44 +98,32 @@ func (s *NoticeLogService) CountByDevice(ctx context.Context, begin, end *time.T
 			}
 		}
 	}
-	for _, log := range logs {
-		name := deviceName[log.DeviceKey]
+	for key, n := range perKey {
+		name := deviceName[key]
 		if name == "" {
-			name = log.DeviceKey
+			name = key
 		}
-		counter[name]++
+		counter[name] += n
 	}
 	return mapToKV(counter, "device"), nil
 }
 
-func (s *NoticeLogService) filteredLogs(ctx context.Context, filter model.NoticeLogFilter) ([]*model.NoticeLog, error) {
-	all, err := s.store.ListNoticeLogs(ctx)
+// Get returns a single log entry.
+func (s *NoticeLogService) Get(ctx context.Context, id uint64) (*model.NoticeLog, error) {
+	return s.store.GetNoticeLog(ctx, id)
+}
+
+// Retryable returns FAILED entries matching filter that have not been
+// retried yet, so each failed chain is only resent from its latest attempt.
+func (s *NoticeLogService) Retryable(ctx context.Context, filter model.NoticeLogFilter) ([]*model.NoticeLog, error) {
+	filter.Status = "FAILED"
+	filter.Unretried = true
+	filter.Page, filter.PageSize, filter.Cursor = 1, 0, ""
+	page, err := s.store.QueryNoticeLogs(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
-	matches := make([]*model.NoticeLog, 0, len(all))
-	for _, log := range all {
-		if filter.DeviceKey != "" && !strings.EqualFold(log.DeviceKey, filter.DeviceKey) {
-			continue
-		}
-		if filter.Group != "" && !strings.EqualFold(log.Group, filter.Group) {
-			continue
-		}
-		if filter.Status != "" && !strings.EqualFold(log.Status, filter.Status) {
-			continue
-		}
-		if filter.BeginTime != nil && log.CreatedAt.Before(filter.BeginTime.UTC()) {
-			continue
-		}
-		if filter.EndTime != nil && log.CreatedAt.After(filter.EndTime.UTC()) {
-			continue
-		}
-		matches = append(matches, log)
-	}
-	sort.Slice(matches, func(i, j int) bool {
-		return matches[i].CreatedAt.After(matches[j].CreatedAt)
-	})
-	return matches, nil
+	return page.Data, nil
 }
 
 func mapToKV(counter map[string]int, key string) []map[string]any {
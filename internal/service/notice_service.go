@@ -7,6 +7,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bark-labs/bark-secure-proxy/internal/barkclient"
 	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
@@ -14,6 +15,12 @@ import (
 	"github.com/bark-labs/bark-secure-proxy/internal/storage"
 )
 
+const (
+	resendConcurrency = 8
+	// apnsPayloadLimit is the maximum notification payload APNs accepts.
+	apnsPayloadLimit = 4096
+)
+
 // NoticeService encrypts plaintext payloads and forwards them to Bark.
 type NoticeService struct {
 	store storage.Store
@@ -27,6 +34,12 @@ func NewNoticeService(store storage.Store, bark *barkclient.Client) *NoticeServi
 
 // Broadcast encrypts and pushes notifications.
 func (s *NoticeService) Broadcast(ctx context.Context, req model.NoticeRequest) (model.NoticeSummary, []model.NoticeResult, error) {
+	return s.BroadcastStream(ctx, req, nil)
+}
+
+// BroadcastStream behaves like Broadcast but also reports every device result
+// to onResult as soon as it completes. Calls to onResult are serialised.
+func (s *NoticeService) BroadcastStream(ctx context.Context, req model.NoticeRequest, onResult func(model.NoticeResult)) (model.NoticeSummary, []model.NoticeResult, error) {
 	if strings.TrimSpace(req.Body) == "" {
 		return model.NoticeSummary{}, nil, fmt.Errorf("body is required")
 	}
@@ -39,72 +52,355 @@ func (s *NoticeService) Broadcast(ctx context.Context, req model.NoticeRequest)
 		return model.NoticeSummary{}, lookupFailures, fmt.Errorf("no target devices resolved")
 	}
 
-	payload := map[string]string{
-		"title":    req.Title,
-		"subtitle": req.Subtitle,
-		"body":     req.Body,
-		"group":    req.Group,
-		"url":      req.Url,
+	req.ID = strings.TrimSpace(req.ID)
+	if req.ID == "" {
+		id, err := crypto.RandomToken(16)
+		if err != nil {
+			return model.NoticeSummary{}, nil, err
+		}
+		req.ID = id
 	}
-	if strings.TrimSpace(req.Icon) != "" {
-		payload["icon"] = req.Icon
+
+	if onResult != nil {
+		for _, failure := range lookupFailures {
+			onResult(failure)
+		}
 	}
-	if strings.TrimSpace(req.Image) != "" {
-		payload["image"] = req.Image
+	summary, results := s.deliver(ctx, req, targets, buildPayload(req), map[string]string{"id": req.ID}, onResult)
+	record := &model.NoticeRecord{
+		ID:         req.ID,
+		Request:    req,
+		DeviceKeys: deviceKeysOf(targets),
+	}
+	if existing, err := s.store.GetNotice(ctx, req.ID); err == nil {
+		record.CreatedAt = existing.CreatedAt
+	}
+	if err := s.store.SaveNotice(ctx, record); err != nil {
+		log.Printf("save notice %s failed: %v", req.ID, err)
+	}
+	return summary, append(lookupFailures, results...), nil
+}
+
+// Preview resolves targets and builds the exact plaintext and per-device
+// ciphertext a Broadcast would send, without contacting bark-server.
+func (s *NoticeService) Preview(ctx context.Context, req model.NoticeRequest) *model.NoticePreview {
+	preview := &model.NoticePreview{Targets: []model.NoticePreviewTarget{}}
+	decide := func(format string, args ...any) {
+		preview.Decisions = append(preview.Decisions, fmt.Sprintf(format, args...))
+	}
+
+	if strings.TrimSpace(req.Body) == "" {
+		preview.Errors = append(preview.Errors, "body is required")
+	}
+	if s.bark == nil {
+		preview.Errors = append(preview.Errors, "bark client not configured")
+	}
+
+	req.ID = strings.TrimSpace(req.ID)
+	if req.ID == "" {
+		if id, err := crypto.RandomToken(16); err == nil {
+			req.ID = id
+		}
+		decide("no id supplied: a random id is generated on every send, %s is used for this preview", req.ID)
+	} else if _, err := s.store.GetNotice(ctx, req.ID); err == nil {
+		decide("id %s already exists: sending would replace the earlier notification on devices that received it", req.ID)
+	}
+	preview.ID = req.ID
+
+	if len(req.DeviceKeys) == 0 {
+		decide("no deviceKeys supplied: broadcasting to all ACTIVE devices")
+	} else {
+		decide("targeting %d requested deviceKey(s)", len(req.DeviceKeys))
+	}
+	targets, lookupFailures := s.pickTargets(ctx, req.DeviceKeys)
+	for _, failure := range lookupFailures {
+		decide("device %q skipped: %s", failure.DeviceKey, failure.Message)
+	}
+	if len(targets) == 0 {
+		preview.Errors = append(preview.Errors, "no target devices resolved")
+	}
+
+	payload := buildPayload(req)
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+	preview.Plaintext = string(plaintext)
+	preview.PayloadBytes = len(plaintext)
+	for _, field := range []string{"icon", "image"} {
+		if _, ok := payload[field]; ok {
+			decide("%s is sent as a URL the Bark app downloads itself", field)
+		}
+	}
+
+	params := map[string]string{"id": req.ID}
+	for _, device := range targets {
+		target := model.NoticePreviewTarget{
+			DeviceKey: device.DeviceKey,
+			Name:      device.Name,
+			Status:    device.Status,
+			IV:        device.IV,
+		}
+		if s.bark != nil {
+			target.Endpoint = s.bark.DeviceEndpoint(device.DeviceKey)
+		}
+		ciphertext, err := s.encryptPayload(payload, device)
+		if err != nil {
+			target.Error = err.Error()
+			preview.Errors = append(preview.Errors, fmt.Sprintf("device %q: %v", device.DeviceKey, err))
+			preview.Targets = append(preview.Targets, target)
+			continue
+		}
+		target.Ciphertext = ciphertext
+		if body, err := barkclient.EncryptedPushBody(ciphertext, device.IV, params); err == nil {
+			target.RequestBody = string(body)
+			target.RequestBytes = len(body)
+			if len(body) > apnsPayloadLimit {
+				decide("device %q: request is %d bytes, above the %d byte APNs payload limit", device.DeviceKey, len(body), apnsPayloadLimit)
+			}
+		}
+		preview.Targets = append(preview.Targets, target)
+	}
+	preview.Valid = len(preview.Errors) == 0
+	return preview
+}
+
+// Get returns the stored broadcast record for a message ID.
+func (s *NoticeService) Get(ctx context.Context, id string) (*model.NoticeRecord, error) {
+	return s.store.GetNotice(ctx, strings.TrimSpace(id))
+}
+
+// Update replaces a delivered notification by re-sending it to the same
+// devices under the same id. Empty fields in patch keep their old value.
+func (s *NoticeService) Update(ctx context.Context, id string, patch model.NoticeRequest) (model.NoticeSummary, []model.NoticeResult, error) {
+	record, targets, lookupFailures, err := s.loadRecord(ctx, id)
+	if err != nil {
+		return model.NoticeSummary{}, lookupFailures, err
+	}
+	req := mergeNotice(record.Request, patch)
+	req.ID = record.ID
+	if strings.TrimSpace(req.Body) == "" {
+		return model.NoticeSummary{}, nil, fmt.Errorf("body is required")
+	}
+
+	summary, results := s.deliver(ctx, req, targets, buildPayload(req), map[string]string{"id": req.ID}, nil)
+	record.Request = req
+	if err := s.store.SaveNotice(ctx, record); err != nil {
+		log.Printf("save notice %s failed: %v", req.ID, err)
+	}
+	return summary, append(lookupFailures, results...), nil
+}
+
+// Recall sends a deletion push so Bark removes the notification with the
+// given id from every device it was delivered to.
+func (s *NoticeService) Recall(ctx context.Context, id string) (model.NoticeSummary, []model.NoticeResult, error) {
+	record, targets, lookupFailures, err := s.loadRecord(ctx, id)
+	if err != nil {
+		return model.NoticeSummary{}, lookupFailures, err
+	}
+	params := map[string]string{"id": record.ID, "delete": "1"}
+	summary, results := s.deliver(ctx, record.Request, targets, params, params, nil)
+	now := time.Now().UTC()
+	record.RecalledAt = &now
+	if err := s.store.SaveNotice(ctx, record); err != nil {
+		log.Printf("save notice %s failed: %v", record.ID, err)
+	}
+	return summary, append(lookupFailures, results...), nil
+}
+
+func (s *NoticeService) loadRecord(ctx context.Context, id string) (*model.NoticeRecord, []*model.Device, []model.NoticeResult, error) {
+	if s.bark == nil {
+		return nil, nil, nil, fmt.Errorf("bark client not configured")
+	}
+	record, err := s.store.GetNotice(ctx, strings.TrimSpace(id))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if record.RecalledAt != nil {
+		return nil, nil, nil, fmt.Errorf("notice %s has been recalled", record.ID)
 	}
+	targets, lookupFailures := s.pickTargets(ctx, record.DeviceKeys)
+	if len(targets) == 0 {
+		return nil, nil, lookupFailures, fmt.Errorf("no target devices resolved")
+	}
+	return record, targets, lookupFailures, nil
+}
 
+// deliver encrypts payload for every target concurrently and logs each attempt.
+func (s *NoticeService) deliver(ctx context.Context, req model.NoticeRequest, targets []*model.Device, payload, params map[string]string, onResult func(model.NoticeResult)) (model.NoticeSummary, []model.NoticeResult) {
 	var (
-		results    = make([]model.NoticeResult, 0, len(targets)+len(lookupFailures))
+		results    = make([]model.NoticeResult, 0, len(targets))
 		mu         sync.Mutex
 		wg         sync.WaitGroup
 		successNum int
 	)
 
-	results = append(results, lookupFailures...)
-
 	wg.Add(len(targets))
 	for _, device := range targets {
 		device := device
 		go func() {
 			defer wg.Done()
-			deviceResults := model.NoticeResult{DeviceKey: device.DeviceKey}
-			ciphertext, err := s.encryptPayload(payload, device)
-			if err != nil {
-				deviceResults.Status = "FAILED"
-				deviceResults.Message = err.Error()
-				s.appendLog(ctx, device, req, deviceResults.Status, err.Error())
-			} else {
-				resp, pushErr := s.bark.SendEncryptedPush(ctx, device.DeviceKey, ciphertext, device.IV)
-				if pushErr != nil {
-					deviceResults.Status = "FAILED"
-					deviceResults.Message = pushErr.Error()
-					s.appendLog(ctx, device, req, "FAILED", pushErr.Error())
-				} else {
-					if resp != nil && resp.Code == 200 {
-						deviceResults.Status = "SUCCESS"
-					} else {
-						deviceResults.Status = "FAILED"
-					}
-					if resp != nil {
-						deviceResults.Message = resp.Message
-					}
-					s.appendLog(ctx, device, req, deviceResults.Status, deviceResults.Message)
-				}
-			}
+			deviceResults := s.pushOne(ctx, device, req, payload, params, 0)
 			mu.Lock()
 			if deviceResults.Status == "SUCCESS" {
 				successNum++
 			}
 			results = append(results, deviceResults)
+			if onResult != nil {
+				onResult(deviceResults)
+			}
 			mu.Unlock()
 		}()
 	}
 	wg.Wait()
 	summary := model.NoticeSummary{
+		ID:         req.ID,
 		SendNum:    len(targets),
 		SuccessNum: successNum,
 	}
-	return summary, results, nil
+	return summary, results
+}
+
+// pushOne encrypts and sends payload to a single device, recording the
+// attempt in the notice log. retryOf links the log to an earlier attempt.
+func (s *NoticeService) pushOne(ctx context.Context, device *model.Device, req model.NoticeRequest, payload, params map[string]string, retryOf uint64) model.NoticeResult {
+	deviceResults := model.NoticeResult{DeviceKey: device.DeviceKey}
+	ciphertext, err := s.encryptPayload(payload, device)
+	if err != nil {
+		deviceResults.Status = "FAILED"
+		deviceResults.Message = err.Error()
+	} else {
+		resp, pushErr := s.bark.SendEncryptedPush(ctx, device.DeviceKey, ciphertext, device.IV, params)
+		if pushErr != nil {
+			deviceResults.Status = "FAILED"
+			deviceResults.Message = pushErr.Error()
+		} else {
+			if resp != nil && resp.Code == 200 {
+				deviceResults.Status = "SUCCESS"
+			} else {
+				deviceResults.Status = "FAILED"
+			}
+			if resp != nil {
+				deviceResults.Message = resp.Message
+			}
+		}
+	}
+	s.appendLog(ctx, device, req, deviceResults.Status, deviceResults.Message, params["delete"] == "1", retryOf)
+	return deviceResults
+}
+
+// Resend retries a logged push attempt: the original request is rebuilt from
+// the log entry and encrypted with the device's current key material.
+func (s *NoticeService) Resend(ctx context.Context, entry *model.NoticeLog) (model.NoticeResult, error) {
+	if s.bark == nil {
+		return model.NoticeResult{}, fmt.Errorf("bark client not configured")
+	}
+	if !strings.EqualFold(entry.Status, "FAILED") {
+		return model.NoticeResult{}, fmt.Errorf("only FAILED entries can be resent")
+	}
+	device, err := s.store.GetDeviceByKey(ctx, entry.DeviceKey)
+	if err != nil {
+		return model.NoticeResult{DeviceKey: entry.DeviceKey, Status: "FAILED", Message: err.Error()}, err
+	}
+	if err := checkDeviceActive(device); err != nil {
+		return model.NoticeResult{DeviceKey: entry.DeviceKey, Status: "FAILED", Message: err.Error()}, err
+	}
+	req := model.NoticeRequest{
+		ID:       entry.NoticeID,
+		Title:    entry.Title,
+		Subtitle: entry.Subtitle,
+		Body:     entry.Body,
+		Group:    entry.Group,
+		Url:      entry.Link,
+		Icon:     entry.Icon,
+		Image:    entry.Image,
+	}
+	if entry.Recall {
+		params := map[string]string{"id": req.ID, "delete": "1"}
+		return s.pushOne(ctx, device, req, params, params, entry.ID), nil
+	}
+	params := map[string]string{"id": req.ID}
+	return s.pushOne(ctx, device, req, buildPayload(req), params, entry.ID), nil
+}
+
+// ResendAll retries entries with bounded concurrency and summarises the outcome.
+func (s *NoticeService) ResendAll(ctx context.Context, entries []*model.NoticeLog) (model.NoticeSummary, []model.NoticeResult) {
+	var (
+		results    = make([]model.NoticeResult, 0, len(entries))
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		successNum int
+		slots      = make(chan struct{}, resendConcurrency)
+	)
+	for _, entry := range entries {
+		entry := entry
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			result, _ := s.Resend(ctx, entry)
+			mu.Lock()
+			if result.Status == "SUCCESS" {
+				successNum++
+			}
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return model.NoticeSummary{SendNum: len(entries), SuccessNum: successNum}, results
+}
+
+func buildPayload(req model.NoticeRequest) map[string]string {
+	payload := map[string]string{
+		"title":    req.Title,
+		"subtitle": req.Subtitle,
+		"body":     req.Body,
+		"group":    req.Group,
+		"url":      req.Url,
+	}
+	if strings.TrimSpace(req.Icon) != "" {
+		payload["icon"] = req.Icon
+	}
+	if strings.TrimSpace(req.Image) != "" {
+		payload["image"] = req.Image
+	}
+	if req.ID != "" {
+		payload["id"] = req.ID
+	}
+	return payload
+}
+
+func mergeNotice(base, patch model.NoticeRequest) model.NoticeRequest {
+	merged := base
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&merged.Title, patch.Title},
+		{&merged.Subtitle, patch.Subtitle},
+		{&merged.Body, patch.Body},
+		{&merged.Group, patch.Group},
+		{&merged.Url, patch.Url},
+		{&merged.Icon, patch.Icon},
+		{&merged.Image, patch.Image},
+	} {
+		if strings.TrimSpace(field.src) != "" {
+			*field.dst = field.src
+		}
+	}
+	return merged
+}
+
+func deviceKeysOf(devices []*model.Device) []string {
+	keys := make([]string, 0, len(devices))
+	for _, device := range devices {
+		keys = append(keys, device.DeviceKey)
+	}
+	return keys
 }
 
 func (s *NoticeService) encryptPayload(payload map[string]string, device *model.Device) (string, error) {
@@ -140,18 +436,42 @@ func (s *NoticeService) pickTargets(ctx context.Context, deviceKeys []string) ([
 			})
 			continue
 		}
+		if err := checkDeviceActive(device); err != nil {
+			result = append(result, model.NoticeResult{
+				DeviceKey: key,
+				Status:    "FAILED",
+				Message:   err.Error(),
+			})
+			continue
+		}
 		devices = append(devices, device)
 	}
 	return devices, result
 }
 
-func (s *NoticeService) appendLog(ctx context.Context, device *model.Device, req model.NoticeRequest, status, result string) {
+// checkDeviceActive rejects pushes to devices that are stopped or whose key
+// has not been entered in the Bark app yet.
+func checkDeviceActive(device *model.Device) error {
+	if device.Status == "" || strings.EqualFold(device.Status, model.DeviceStatusActive) {
+		return nil
+	}
+	return fmt.Errorf("device %s is %s", device.DeviceKey, strings.ToUpper(device.Status))
+}
+
+func (s *NoticeService) appendLog(ctx context.Context, device *model.Device, req model.NoticeRequest, status, result string, recall bool, retryOf uint64) {
 	logEntry := &model.NoticeLog{
+		NoticeID:  req.ID,
+		RetryOf:   retryOf,
+		Recall:    recall,
 		DeviceKey: device.DeviceKey,
 		URL:       s.bark.DeviceEndpoint(device.DeviceKey),
 		Title:     req.Title,
+		Subtitle:  req.Subtitle,
 		Body:      req.Body,
 		Group:     req.Group,
+		Link:      req.Url,
+		Icon:      req.Icon,
+		Image:     req.Image,
 		Result:    result,
 		Status:    status,
 	}
@@ -0,0 +1,477 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// ProviderOIDC marks sessions issued after an OIDC login.
+	ProviderOIDC = "oidc"
+	// OIDCUsernamePrefix namespaces single sign-on users so that an IdP
+	// account can never act as, or revoke the sessions of, the local
+	// account of the same name. Local usernames may not start with it.
+	OIDCUsernamePrefix = "oidc:"
+	// oidcLoginTTL bounds how long a user may spend at the identity provider.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcMaxPending caps the logins waiting for the identity provider, so
+	// that unauthenticated login starts cannot grow memory without bound.
+	oidcMaxPending = 1000
+	// jwksRefreshInterval throttles key refetches triggered by unknown kids.
+	jwksRefreshInterval = time.Minute
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// oidcClient runs the authorization-code + PKCE flow against one provider.
+// Discovery and signing keys are fetched lazily and cached.
+type oidcClient struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURL   string
+	scopes        []string
+	usernameClaim string
+	groupsClaim   string
+	allowedGroups map[string]bool
+	roleMapping   map[string]string
+	defaultRole   string
+	http          *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]any
+	keysFetched time.Time
+	pending     map[string]oidcPending
+}
+
+func newOIDCClient(cfg *config.Config) *oidcClient {
+	oidcCfg := cfg.Auth.OIDC
+	if !oidcCfg.Enabled {
+		return nil
+	}
+	allowed := make(map[string]bool, len(oidcCfg.AllowedGroups))
+	for _, g := range oidcCfg.AllowedGroups {
+		if g = strings.ToLower(strings.TrimSpace(g)); g != "" {
+			allowed[g] = true
+		}
+	}
+	mapping := make(map[string]string, len(oidcCfg.RoleMapping))
+	for g, role := range oidcCfg.RoleMapping {
+		mapping[strings.ToLower(strings.TrimSpace(g))] = strings.ToLower(strings.TrimSpace(role))
+	}
+	scopes := oidcCfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid"}
+	}
+	return &oidcClient{
+		issuer:        strings.TrimRight(strings.TrimSpace(oidcCfg.Issuer), "/"),
+		clientID:      strings.TrimSpace(oidcCfg.ClientID),
+		clientSecret:  strings.TrimSpace(oidcCfg.ClientSecret),
+		redirectURL:   strings.TrimSpace(oidcCfg.RedirectURL),
+		scopes:        scopes,
+		usernameClaim: strings.TrimSpace(firstNonEmpty(oidcCfg.UsernameClaim, "preferred_username")),
+		groupsClaim:   strings.TrimSpace(firstNonEmpty(oidcCfg.GroupsClaim, "groups")),
+		allowedGroups: allowed,
+		roleMapping:   mapping,
+		defaultRole:   strings.ToLower(strings.TrimSpace(oidcCfg.DefaultRole)),
+		http:          &http.Client{Timeout: 10 * time.Second},
+		keys:          make(map[string]any),
+		pending:       make(map[string]oidcPending),
+	}
+}
+
+// OIDCEnabled reports whether single sign-on is configured.
+func (a *AuthService) OIDCEnabled() bool {
+	return a.Enabled() && a.oidc != nil
+}
+
+// CheckOIDC validates the OIDC settings when single sign-on is enabled.
+func (a *AuthService) CheckOIDC() error {
+	if !a.OIDCEnabled() {
+		return nil
+	}
+	o := a.oidc
+	switch {
+	case o.issuer == "":
+		return fmt.Errorf("auth.oidc.issuer is required")
+	case o.clientID == "":
+		return fmt.Errorf("auth.oidc.client_id is required")
+	case o.redirectURL == "":
+		return fmt.Errorf("auth.oidc.redirect_url is required")
+	}
+	for group, role := range o.roleMapping {
+		if !model.ValidRole(role) {
+			return fmt.Errorf("auth.oidc.role_mapping: unknown role %q for group %q", role, group)
+		}
+	}
+	if o.defaultRole != "" && !model.ValidRole(o.defaultRole) {
+		return fmt.Errorf("auth.oidc.default_role: unknown role %q", o.defaultRole)
+	}
+	return nil
+}
+
+// OIDCLoginTTL is how long a started login may take to complete.
+func (a *AuthService) OIDCLoginTTL() time.Duration {
+	return oidcLoginTTL
+}
+
+// OIDCLoginURL starts a login and returns the provider's authorization URL
+// together with its state, which the caller must bind to the browser and
+// present again to OIDCCallback.
+func (a *AuthService) OIDCLoginURL(ctx context.Context) (string, string, error) {
+	if !a.OIDCEnabled() {
+		return "", "", errors.New("未启用 OIDC 登录")
+	}
+	o := a.oidc
+	disc, err := o.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := crypto.RandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := crypto.RandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := crypto.RandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	o.mu.Lock()
+	now := time.Now()
+	// Expired logins are only swept once the map is full, which keeps the
+	// common case O(1) under the lock.
+	if len(o.pending) >= oidcMaxPending {
+		for k, p := range o.pending {
+			if now.After(p.expires) {
+				delete(o.pending, k)
+			}
+		}
+	}
+	if len(o.pending) >= oidcMaxPending {
+		o.mu.Unlock()
+		return "", "", errors.New("登录请求过多，请稍后再试")
+	}
+	o.pending[state] = oidcPending{verifier: verifier, nonce: nonce, expires: now.Add(oidcLoginTTL)}
+	o.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.clientID)
+	q.Set("redirect_uri", o.redirectURL)
+	q.Set("scope", strings.Join(o.scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return disc.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// OIDCCallback completes a login: it exchanges the code, verifies the ID
+// token and maps the user's groups to a console role.
+func (a *AuthService) OIDCCallback(ctx context.Context, state, code string) (*LoginResult, error) {
+	if !a.OIDCEnabled() {
+		return nil, errors.New("未启用 OIDC 登录")
+	}
+	o := a.oidc
+	o.mu.Lock()
+	pending, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return nil, errors.New("登录请求已过期，请重试")
+	}
+	rawIDToken, err := o.exchange(ctx, code, pending.verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.verifyIDToken(ctx, rawIDToken, pending.nonce)
+	if err != nil {
+		return nil, err
+	}
+	username, _ := claims[o.usernameClaim].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+	if username == "" {
+		return nil, errors.New("身份令牌缺少用户名")
+	}
+	role, err := o.roleFor(stringsClaim(claims[o.groupsClaim]))
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{Username: OIDCUsernamePrefix + username, Role: role}
+	return a.startSession(ctx, user, ProviderOIDC)
+}
+
+func (o *oidcClient) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	disc := o.discovery
+	o.mu.Unlock()
+	if disc != nil {
+		return disc, nil
+	}
+	disc = &oidcDiscovery{}
+	if err := o.getJSON(ctx, o.issuer+"/.well-known/openid-configuration", disc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(disc.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", disc.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+	o.mu.Lock()
+	o.discovery = disc
+	o.mu.Unlock()
+	return disc, nil
+}
+
+func (o *oidcClient) exchange(ctx context.Context, code, verifier string) (string, error) {
+	disc, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL)
+	form.Set("client_id", o.clientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	}
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("oidc token exchange failed: %s %s", body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+func (o *oidcClient) verifyIDToken(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return o.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "PS256"}),
+		jwt.WithAudience(o.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	// Compared by hand because some providers add a trailing slash.
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != o.issuer {
+		return nil, errors.New("invalid id token: issuer mismatch")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// key returns the verification key for kid, refetching the JWKS once per
+// interval when the provider has rotated keys.
+func (o *oidcClient) key(ctx context.Context, kid string) (any, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	stale := time.Since(o.keysFetched) > jwksRefreshInterval
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	disc, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(ctx, disc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	o.mu.Lock()
+	o.keys = keys
+	o.keysFetched = time.Now()
+	o.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// roleFor applies allowed_groups and role_mapping; the most privileged mapped
+// role wins and default_role applies when nothing matches.
+func (o *oidcClient) roleFor(groups []string) (string, error) {
+	allowed := len(o.allowedGroups) == 0
+	best := ""
+	for _, g := range groups {
+		g = strings.ToLower(g)
+		if o.allowedGroups[g] {
+			allowed = true
+		}
+		if role := o.roleMapping[g]; role != "" && (best == "" || (model.RoleAllows(role, best) && role != best)) {
+			best = role
+		}
+	}
+	if !allowed {
+		return "", errors.New("当前账号不在允许登录的用户组中")
+	}
+	if best == "" {
+		best = o.defaultRole
+	}
+	if !model.ValidRole(best) {
+		return "", errors.New("当前账号未分配后台角色")
+	}
+	return best, nil
+}
+
+func (o *oidcClient) getJSON(ctx context.Context, target string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// stringsClaim reads a claim that may be a single string or a list.
+func stringsClaim(v any) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []any:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
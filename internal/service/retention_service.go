@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/config"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// RetentionService deletes push logs past the configured age or count, and
+// audit entries past audit.max_age.
+type RetentionService struct {
+	store       storage.Store
+	interval    time.Duration
+	global      config.RetentionRule
+	statuses    map[string]config.RetentionRule
+	auditMaxAge time.Duration
+}
+
+// NewRetentionService builds the log and audit retention job.
+func NewRetentionService(store storage.Store, cfg *config.Config) *RetentionService {
+	c := cfg.LogRetention
+	statuses := make(map[string]config.RetentionRule, len(c.Statuses))
+	for status, rule := range c.Statuses {
+		// Viper lower-cases map keys; statuses are stored upper-case.
+		statuses[strings.ToUpper(strings.TrimSpace(status))] = rule
+	}
+	return &RetentionService{
+		store:    store,
+		interval: c.Interval,
+		global:   config.RetentionRule{MaxAge: c.MaxAge, MaxEntries: c.MaxEntries},
+		statuses: statuses,
+
+		auditMaxAge: cfg.Audit.MaxAge,
+	}
+}
+
+// Enabled reports whether any limit is configured.
+func (s *RetentionService) Enabled() bool {
+	if s.global.MaxAge > 0 || s.global.MaxEntries > 0 || s.auditMaxAge > 0 {
+		return true
+	}
+	for _, rule := range s.statuses {
+		if rule.MaxAge > 0 || rule.MaxEntries > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune applies the per-status rules and then the global one, returning how
+// many logs were deleted. The global rule leaves statuses with a limit of
+// their own alone, so a longer per-status limit is not cut short by it; a
+// status rule without limits falls back to the global one.
+func (s *RetentionService) Prune(ctx context.Context) (int, error) {
+	now := time.Now()
+	statuses := make([]string, 0, len(s.statuses))
+	for status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	removed := 0
+	for _, status := range statuses {
+		n, err := s.store.PruneNoticeLogs(ctx, pruneRule(status, s.statuses[status], now))
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	global := pruneRule("", s.global, now)
+	for _, status := range statuses {
+		if rule := s.statuses[status]; rule.MaxAge > 0 || rule.MaxEntries > 0 {
+			global.ExceptStatuses = append(global.ExceptStatuses, status)
+		}
+	}
+	n, err := s.store.PruneNoticeLogs(ctx, global)
+	return removed + n, err
+}
+
+func pruneRule(status string, rule config.RetentionRule, now time.Time) model.NoticeLogPrune {
+	prune := model.NoticeLogPrune{Status: status, Keep: rule.MaxEntries}
+	if rule.MaxAge > 0 {
+		prune.Before = now.Add(-rule.MaxAge)
+	}
+	return prune
+}
+
+// PruneAudit deletes audit entries older than audit.max_age and returns how
+// many were removed.
+func (s *RetentionService) PruneAudit(ctx context.Context) (int, error) {
+	if s.auditMaxAge <= 0 {
+		return 0, nil
+	}
+	return s.store.PruneAuditEntries(ctx, time.Now().Add(-s.auditMaxAge))
+}
+
+// Run prunes logs and audit entries periodically until ctx is cancelled.
+func (s *RetentionService) Run(ctx context.Context) {
+	if !s.Enabled() || s.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.Prune(ctx); err != nil {
+			log.Printf("log retention failed: %v", err)
+		} else if n > 0 {
+			log.Printf("log retention removed %d entries", n)
+		}
+		if n, err := s.PruneAudit(ctx); err != nil {
+			log.Printf("audit retention failed: %v", err)
+		} else if n > 0 {
+			log.Printf("audit retention removed %d entries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// ErrInvalidRefreshToken is returned for unknown, expired, revoked or
+// replayed refresh tokens.
+var ErrInvalidRefreshToken = errors.New("登录已失效，请重新登录")
+
+type clientInfoKey struct{}
+
+type clientInfo struct {
+	ip        string
+	userAgent string
+}
+
+// WithClientInfo attaches the caller's address and user agent to ctx so new
+// sessions can record where they were opened.
+func WithClientInfo(ctx context.Context, ip, userAgent string) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, clientInfo{ip: ip, userAgent: userAgent})
+}
+
+func clientFrom(ctx context.Context) clientInfo {
+	info, _ := ctx.Value(clientInfoKey{}).(clientInfo)
+	return info
+}
+
+// signingKeys holds the current JWT secret and the retired ones that are
+// still accepted. Keys are identified by the kid header.
+type signingKeys struct {
+	kid    string
+	secret []byte
+	verify map[string][]byte
+}
+
+func newSigningKeys(current string, previous []string) *signingKeys {
+	keys := &signingKeys{kid: keyID(current), secret: []byte(current), verify: make(map[string][]byte)}
+	for _, secret := range previous {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			keys.verify[keyID(secret)] = []byte(secret)
+		}
+	}
+	keys.verify[keys.kid] = keys.secret
+	return keys
+}
+
+// keyID derives a stable, non-secret identifier for a signing secret.
+func keyID(secret string) string {
+	sum := sha256.Sum256([]byte("bark-secure-proxy/jwt/" + secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (k *signingKeys) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.secret)
+}
+
+// keyFunc picks the verification secret by kid. Tokens without a kid were
+// issued before key rotation and are checked against the current secret.
+func (k *signingKeys) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return k.secret, nil
+	}
+	if secret, ok := k.verify[kid]; ok {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k *signingKeys) parse(token string, claims *Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(token, claims, k.keyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+}
+
+// startSession opens a session for user and returns its first token pair.
+func (a *AuthService) startSession(ctx context.Context, user *model.User, provider string) (*LoginResult, error) {
+	id, err := crypto.RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	session := &model.Session{
+		ID:          id,
+		Username:    user.Username,
+		Role:        user.Role,
+		Provider:    provider,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(a.refreshTTL),
+	}
+	info := clientFrom(ctx)
+	session.IP = info.ip
+	session.UserAgent = info.userAgent
+	a.pruneSessions(ctx, now)
+	result, err := a.rotate(ctx, session, user)
+	if err != nil {
+		return nil, err
+	}
+	a.audit.Record(WithActor(ctx, user.Username, user.Role), AuditLogin, user.Username, nil, session)
+	return result, nil
+}
+
+// rotate replaces the session's refresh secret and issues a new token pair.
+// An existing session is only updated if its secret is still the one that
+// was presented; a new session is created outright.
+func (a *AuthService) rotate(ctx context.Context, session *model.Session, user *model.User) (*LoginResult, error) {
+	secret, err := crypto.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	previous := session.RefreshHash
+	session.PreviousHash = previous
+	session.RefreshHash = hashSecret(secret)
+	if previous == "" {
+		err = a.store.SaveSession(ctx, session)
+	} else {
+		// Only swap in the new secret if nobody rotated or revoked the
+		// session since it was read, so a concurrent logout stays final.
+		err = a.store.RotateSession(ctx, session, previous)
+	}
+	switch {
+	case err == storage.ErrNotFound:
+		return nil, ErrInvalidRefreshToken
+	case err == storage.ErrConflict:
+		// Another refresh with the same token won the race: treat it as
+		// reuse, like presenting an already rotated token.
+		_ = a.store.DeleteSession(ctx, session.ID)
+		return nil, ErrInvalidRefreshToken
+	case err != nil:
+		return nil, err
+	}
+	token, expires, err := a.issue(user, session)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		Token:        token,
+		RefreshToken: session.ID + "." + secret,
+		ExpiresAt:    expires,
+		User:         user,
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. The refresh token
+// is single-use: presenting a previously rotated one revokes the session,
+// since it means the token was copied.
+func (a *AuthService) Refresh(ctx context.Context, refreshToken string) (*LoginResult, error) {
+	if !a.Enabled() {
+		return nil, errors.New("未启用登录")
+	}
+	session, secret, err := a.lookupRefresh(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(session.RefreshHash)) != 1 {
+		if session.PreviousHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(session.PreviousHash)) == 1 {
+			_ = a.store.DeleteSession(ctx, session.ID)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	user := &model.User{Username: session.Username, Role: session.Role}
+	if session.Provider == "" {
+		// Local accounts pick up role changes and are cut off once disabled.
+		user, err = a.store.GetUser(ctx, session.Username)
+		if err != nil || user.Disabled {
+			_ = a.store.DeleteSession(ctx, session.ID)
+			return nil, ErrInvalidRefreshToken
+		}
+		session.Role = user.Role
+	}
+	session.RefreshedAt = time.Now().UTC()
+	return a.rotate(ctx, session, user)
+}
+
+// Logout revokes the session a refresh token belongs to.
+func (a *AuthService) Logout(ctx context.Context, refreshToken string) error {
+	session, secret, err := a.lookupRefresh(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(session.RefreshHash)) != 1 {
+		return ErrInvalidRefreshToken
+	}
+	return a.EndSession(WithActor(ctx, session.Username, session.Role), session.ID)
+}
+
+// EndSession is a user logging out of their own session.
+func (a *AuthService) EndSession(ctx context.Context, id string) error {
+	session, err := a.store.GetSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := a.store.DeleteSession(ctx, id); err != nil {
+		return err
+	}
+	a.audit.Record(ctx, AuditLogout, session.Username, session, nil)
+	return nil
+}
+
+func (a *AuthService) lookupRefresh(ctx context.Context, refreshToken string) (*model.Session, string, error) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(refreshToken), ".")
+	if !ok || id == "" || secret == "" {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	session, err := a.store.GetSession(ctx, id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, "", ErrInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		_ = a.store.DeleteSession(ctx, session.ID)
+		return nil, "", ErrInvalidRefreshToken
+	}
+	return session, secret, nil
+}
+
+// ListSessions returns the live sessions of username, or of every user when
+// username is empty, newest first.
+func (a *AuthService) ListSessions(ctx context.Context, username string) ([]*model.Session, error) {
+	sessions, err := a.store.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := make([]*model.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if now.After(session.ExpiresAt) {
+			continue
+		}
+		if username != "" && model.NormalizeUsername(session.Username) != model.NormalizeUsername(username) {
+			continue
+		}
+		result = append(result, session)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// RevokeSession ends one session; its access tokens stop working at once.
+func (a *AuthService) RevokeSession(ctx context.Context, id string) error {
+	session, err := a.store.GetSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := a.store.DeleteSession(ctx, id); err != nil {
+		return err
+	}
+	a.audit.Record(ctx, AuditSessionRevoke, session.Username, session, nil)
+	return nil
+}
+
+// RevokeSessions ends every session of username and returns how many were
+// removed.
+func (a *AuthService) RevokeSessions(ctx context.Context, username string) (int, error) {
+	removed, err := a.revokeSessions(ctx, username, "")
+	if removed > 0 {
+		a.audit.RecordMeta(ctx, AuditSessionRevoke, model.NormalizeUsername(username), nil, nil, map[string]any{"sessions": removed})
+	}
+	return removed, err
+}
+
+func (a *AuthService) revokeSessions(ctx context.Context, username, keep string) (int, error) {
+	sessions, err := a.store.ListSessions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, session := range sessions {
+		if session.ID == keep || model.NormalizeUsername(session.Username) != model.NormalizeUsername(username) {
+			continue
+		}
+		if err := a.store.DeleteSession(ctx, session.ID); err != nil && err != storage.ErrNotFound {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// pruneSessions drops expired sessions. Failures are ignored; the next
+// login tries again.
+func (a *AuthService) pruneSessions(ctx context.Context, now time.Time) {
+	sessions, err := a.store.ListSessions(ctx)
+	if err != nil {
+		return
+	}
+	for _, session := range sessions {
+		if now.After(session.ExpiresAt) {
+			_ = a.store.DeleteSession(ctx, session.ID)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/crypto"
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer = "Bark Secure Proxy"
+	// totpSkew accepts codes from one step before/after to absorb clock drift.
+	totpSkew = 1
+	// recoveryCodeCount is how many one-time recovery codes are issued.
+	recoveryCodeCount = 10
+	// challengeTTL bounds the second login step.
+	challengeTTL = 5 * time.Minute
+	// challengeMaxFailures invalidates a login challenge after this many wrong
+	// codes.
+	challengeMaxFailures = 5
+	// purposeTwoFactor marks tokens that only allow completing the login.
+	purposeTwoFactor = "2fa"
+)
+
+// ErrInvalidTwoFactorCode is returned for wrong, reused or expired codes.
+var ErrInvalidTwoFactorCode = errors.New("验证码错误")
+
+// TOTPSetup is returned when enrollment starts.
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// challengeGuard counts failed second-step attempts per login challenge and
+// remembers challenges that were already used.
+type challengeGuard struct {
+	mu       sync.Mutex
+	failures map[string]int
+	expires  map[string]time.Time
+}
+
+func newChallengeGuard() *challengeGuard {
+	return &challengeGuard{failures: make(map[string]int), expires: make(map[string]time.Time)}
+}
+
+func (g *challengeGuard) blocked(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.failures[id] >= challengeMaxFailures
+}
+
+func (g *challengeGuard) fail(id string, expires time.Time) {
+	g.add(id, expires, 1)
+}
+
+// consume blocks a challenge once it has been exchanged for a session.
+func (g *challengeGuard) consume(id string, expires time.Time) {
+	g.add(id, expires, challengeMaxFailures)
+}
+
+func (g *challengeGuard) add(id string, expires time.Time, n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for k, exp := range g.expires {
+		if now.After(exp) {
+			delete(g.expires, k)
+			delete(g.failures, k)
+		}
+	}
+	g.failures[id] += n
+	g.expires[id] = expires
+}
+
+// User returns the stored account for username.
+func (a *AuthService) User(ctx context.Context, username string) (*model.User, error) {
+	return a.store.GetUser(ctx, username)
+}
+
+// issueChallenge returns a short-lived token that can only be exchanged for a
+// session by supplying a valid second factor.
+func (a *AuthService) issueChallenge(user *model.User) (string, error) {
+	id, err := crypto.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		Username: user.Username,
+		Purpose:  purposeTwoFactor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return a.keys.sign(claims)
+}
+
+// CompleteTwoFactor exchanges a login challenge and a TOTP or recovery code
+// for a session.
+func (a *AuthService) CompleteTwoFactor(ctx context.Context, challenge, code string) (*LoginResult, error) {
+	claims := &Claims{}
+	parsed, err := a.keys.parse(challenge, claims)
+	if err != nil || !parsed.Valid || claims.Purpose != purposeTwoFactor || claims.ID == "" {
+		return nil, errors.New("登录已超时，请重新登录")
+	}
+	if a.challenges.blocked(claims.ID) {
+		return nil, errors.New("验证码错误次数过多，请重新登录")
+	}
+	ip := clientFrom(ctx).ip
+	release, err := a.guard.reserve(ctx, claims.Username, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	user, err := a.store.GetUser(ctx, claims.Username)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled || !user.TOTPEnabled {
+		return nil, ErrInvalidCredentials
+	}
+	if err := a.checkSecondFactor(ctx, user, code); err != nil {
+		a.challenges.fail(claims.ID, claims.ExpiresAt.Time)
+		a.guard.fail(ctx, user.Username, ip, "wrong two-factor code")
+		return nil, err
+	}
+	a.challenges.consume(claims.ID, claims.ExpiresAt.Time)
+	a.guard.succeed(ctx, user.Username, ip)
+	return a.startSession(ctx, user, "")
+}
+
+// BeginTOTP generates a pending secret for username. It only becomes active
+// once EnableTOTP confirms a code from it.
+func (a *AuthService) BeginTOTP(ctx context.Context, username string) (*TOTPSetup, error) {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, errors.New("已启用两步验证")
+	}
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	user.PendingTOTPSecret = secret
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return &TOTPSetup{Secret: secret, URI: crypto.TOTPURI(totpIssuer, user.Username, secret)}, nil
+}
+
+// EnableTOTP verifies a code from the pending secret, activates two-factor
+// login and returns freshly generated recovery codes.
+func (a *AuthService) EnableTOTP(ctx context.Context, username, code string) ([]string, error) {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.PendingTOTPSecret == "" {
+		return nil, errors.New("请先获取两步验证密钥")
+	}
+	step, ok := crypto.VerifyTOTP(user.PendingTOTPSecret, code, time.Now(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	before := snapshot(user)
+	user.TOTPEnabled = true
+	user.TOTPSecret = user.PendingTOTPSecret
+	user.PendingTOTPSecret = ""
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.audit.Record(ctx, AuditTOTPEnable, user.Username, before, user)
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor login off after re-checking the password and a
+// current code.
+func (a *AuthService) DisableTOTP(ctx context.Context, username, password, code string) error {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return errors.New("未启用两步验证")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return errors.New("密码错误")
+	}
+	if err := a.checkSecondFactor(ctx, user, code); err != nil {
+		return err
+	}
+	before := snapshot(user)
+	clearTOTP(user)
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return err
+	}
+	a.audit.Record(ctx, AuditTOTPDisable, user.Username, before, user)
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func (a *AuthService) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	user, err := a.store.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, errors.New("未启用两步验证")
+	}
+	if err := a.checkSecondFactor(ctx, user, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	before := snapshot(user)
+	user.RecoveryCodes = hashes
+	if err := a.store.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.audit.Record(ctx, AuditRecoveryCodes, user.Username, before, user)
+	return codes, nil
+}
+
+// checkSecondFactor accepts a TOTP code newer than the last one used, or
+// consumes a recovery code. The user is saved when its state changes.
+func (a *AuthService) checkSecondFactor(ctx context.Context, user *model.User, code string) error {
+	code = strings.TrimSpace(code)
+	if step, ok := crypto.VerifyTOTP(user.TOTPSecret, code, time.Now(), totpSkew); ok {
+		if step <= user.TOTPLastStep {
+			return ErrInvalidTwoFactorCode
+		}
+		user.TOTPLastStep = step
+		return a.store.SaveUser(ctx, user)
+	}
+	hash := hashSecret(normalizeRecoveryCode(code))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return a.store.SaveUser(ctx, user)
+		}
+	}
+	return ErrInvalidTwoFactorCode
+}
+
+func clearTOTP(user *model.User) {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.PendingTOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+// generateRecoveryCodes returns plaintext codes (xxxxx-xxxxx) and their
+// hashes for storage.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := crypto.RandomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, hashSecret(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", "")
+}
@@ -0,0 +1,36 @@
+package bolt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bark-server keeps one bucket mapping each device key to its APNs device
+// token, both stored as plain strings.
+var barkServerBucket = []byte("device")
+
+// ReadBarkServerDevices lists the devices in the bark-server database at
+// path, in key order, with only DeviceKey and DeviceToken set. The file is
+// opened read-only, so bark-server must not be holding it open.
+func ReadBarkServerDevices(path string) ([]*model.Device, error) {
+	db, err := bolt.Open(path, 0o400, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var devices []*model.Device
+	err = db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(barkServerBucket)
+		if bkt == nil {
+			return fmt.Errorf("not a bark-server database: missing bucket %q", barkServerBucket)
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			devices = append(devices, &model.Device{DeviceKey: string(k), DeviceToken: string(v)})
+			return nil
+		})
+	})
+	return devices, err
+}
@@ -1,13 +1,16 @@
 package bolt
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bark-labs/bark-secure-proxy/internal/model"
@@ -20,11 +23,50 @@ var _ storage.Store = (*Store)(nil)
 var (
 	bucketDevices   = []byte("devices")
 	bucketNoticeLog = []byte("notice_logs")
-	errStop         = errors.New("stop iteration")
+	bucketNotices   = []byte("notices")
+	bucketAttach    = []byte("attachments")
+	bucketAPIKeys   = []byte("api_keys")
+	bucketUsers     = []byte("users")
+	bucketSessions  = []byte("sessions")
+	bucketAttempts  = []byte("login_attempts")
+	bucketAudit     = []byte("audit")
+	// bucketDeletedDevices holds soft-deleted devices keyed by token.
+	bucketDeletedDevices = []byte("deleted_devices")
+
+	// Secondary indexes over devices. bucketDeviceKeys maps deviceKey to
+	// device token; bucketDeviceStatus holds "<STATUS>\x00<token>" keys with
+	// empty values so a status can be listed with a prefix scan.
+	bucketDeviceKeys   = []byte("idx_device_key")
+	bucketDeviceStatus = []byte("idx_device_status")
+
+	// Push log indexes. Keys end in the entry's CreatedAt (Unix nanoseconds)
+	// and ID, both big-endian, so each index iterates in time order.
+	// bucketLogTime holds just that suffix; the others prefix it with the
+	// lower-cased field value and a NUL separator and store the original
+	// value. bucketLogRetries maps a log ID to the ID of its retry.
+	bucketLogTime    = []byte("idx_log_time")
+	bucketLogDevice  = []byte("idx_log_device")
+	bucketLogGroup   = []byte("idx_log_group")
+	bucketLogStatus  = []byte("idx_log_status")
+	bucketLogRetries = []byte("idx_log_retry")
+	logIndexBuckets  = [][]byte{bucketLogTime, bucketLogDevice, bucketLogGroup, bucketLogStatus, bucketLogRetries}
+
+	// bucketAuditTime indexes audit entries by CreatedAt and ID, with keys
+	// laid out like bucketLogTime.
+	bucketAuditTime = []byte("idx_audit_time")
 )
 
+// compactTxSize caps the transactions used to copy data during compaction.
+const compactTxSize = 64 << 20
+
 // Store is a BoltDB-backed Store implementation.
 type Store struct {
+	path string
+	// writeMu is held exclusively while Compact copies the database, so
+	// no write lands in the old file after the copy started. Reads go on.
+	writeMu sync.RWMutex
+	// mu is held exclusively while Compact swaps the underlying file.
+	mu sync.RWMutex
 	db *bolt.DB
 }
 
@@ -37,23 +79,246 @@ func New(path string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(bucketDevices); err != nil {
-			return err
-		}
-		_, err := tx.CreateBucketIfNotExists(bucketNoticeLog)
-		return err
-	}); err != nil {
+	if _, err := migrate(db, false); err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &Store{db: db}, nil
+	return &Store{path: path, db: db}, nil
 }
 
 // Close closes underlying Bolt DB.
 func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.db.Close()
 }
 
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(fn)
+}
+
+// Stats reports the file size and the size of every bucket.
+func (s *Store) Stats(ctx context.Context) (*model.StoreStats, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	stats := &model.StoreStats{Path: s.path, Buckets: []model.BucketStats{}}
+	err := s.view(func(tx *bolt.Tx) error {
+		stats.FileSize = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			st := b.Stats()
+			inuse := st.BranchInuse + st.LeafInuse
+			if inuse == 0 {
+				// Small buckets are stored inline in their parent's page.
+				inuse = st.InlineBucketInuse
+			}
+			stats.Buckets = append(stats.Buckets, model.BucketStats{
+				Name:      string(name),
+				Keys:      st.KeyN,
+				Bytes:     int64(inuse),
+				Allocated: int64(st.BranchAlloc + st.LeafAlloc),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		stats.FileSize = info.Size()
+	}
+	return stats, nil
+}
+
+// Compact copies the database into a fresh file and swaps it in, returning
+// the space freed by deleted data to the file system. The copy is read from
+// a single read transaction: reads carry on meanwhile and writes wait. Only
+// the swap itself blocks every call. If the swap fails the original file is
+// put back and reopened.
+func (s *Store) Compact(ctx context.Context) (*model.CompactResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	start := time.Now()
+	result := &model.CompactResult{}
+	if info, err := os.Stat(s.path); err == nil {
+		result.BeforeSize = info.Size()
+	}
+	tmpPath := s.path + ".compact"
+	_ = os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	err = bolt.Compact(dst, s.db, compactTxSize)
+	s.mu.RUnlock()
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.swap(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		result.AfterSize = info.Size()
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// swap replaces the open database with the file at newPath. The original is
+// kept aside until the new file opens, and restored and reopened otherwise.
+// The caller holds s.mu exclusively.
+func (s *Store) swap(newPath string) error {
+	oldPath := s.path + ".precompact"
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	reopen := func(cause error) error {
+		db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return fmt.Errorf("%w; reopening the original database also failed: %v", cause, err)
+		}
+		s.db = db
+		return cause
+	}
+	if err := os.Rename(s.path, oldPath); err != nil {
+		return reopen(err)
+	}
+	restore := func(cause error) error {
+		if err := os.Rename(oldPath, s.path); err != nil {
+			return fmt.Errorf("%w; restoring the original database also failed: %v (it is at %s)", cause, err, oldPath)
+		}
+		return reopen(cause)
+	}
+	if err := os.Rename(newPath, s.path); err != nil {
+		return restore(err)
+	}
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		os.Remove(s.path)
+		return restore(fmt.Errorf("open compacted database: %w", err))
+	}
+	s.db = db
+	os.Remove(oldPath)
+	return nil
+}
+
+// Backup writes a consistent snapshot of the database to w. The snapshot is
+// copied to a temporary file next to the database first and streamed from
+// there, so a slow reader does not keep a read transaction open: that would
+// stop Bolt from reusing freed pages and hold off Compact until it finished.
+func (s *Store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	err = s.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(tmp)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, tmp)
+}
+
+// Verify checks that the file at path is a readable Bolt database with the
+// layout this store expects: the page structure is consistent, the schema
+// version is not newer than this build, the devices bucket exists, and every
+// device and user record decodes. Older snapshots are migrated by New.
+func Verify(path string) error {
+	db, err := bolt.Open(path, 0o400, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		// A truncated file still has valid meta pages; reading the missing
+		// pages would crash, so compare against the high-water mark first.
+		if info.Size() < tx.Size() {
+			return fmt.Errorf("truncated database: %d of %d bytes", info.Size(), tx.Size())
+		}
+		// Drain the channel so the checking goroutine can finish.
+		var corrupt error
+		for err := range tx.Check() {
+			if corrupt == nil {
+				corrupt = err
+			}
+		}
+		if corrupt != nil {
+			return fmt.Errorf("corrupt database: %w", corrupt)
+		}
+		if v := schemaVersion(tx); v > len(migrations) {
+			return fmt.Errorf("schema version %d is newer than this build supports (%d)", v, len(migrations))
+		}
+		devices := tx.Bucket(bucketDevices)
+		if devices == nil {
+			return fmt.Errorf("missing bucket %q", bucketDevices)
+		}
+		if err := devices.ForEach(func(k, v []byte) error {
+			var device model.Device
+			if err := json.Unmarshal(v, &device); err != nil {
+				return fmt.Errorf("device %q: %w", k, err)
+			}
+			if device.DeviceToken != string(k) {
+				return fmt.Errorf("device %q stored under wrong key", k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if users := tx.Bucket(bucketUsers); users != nil {
+			return users.ForEach(func(k, v []byte) error {
+				var user model.User
+				if err := json.Unmarshal(v, &user); err != nil {
+					return fmt.Errorf("user %q: %w", k, err)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
 // UpsertDevice stores or updates a device record.
 func (s *Store) UpsertDevice(ctx context.Context, device *model.Device) error {
 	select {
@@ -70,54 +335,129 @@ func (s *Store) UpsertDevice(ctx context.Context, device *model.Device) error {
 	if err != nil {
 		return err
 	}
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(bucketDevices)
-		return bkt.Put([]byte(device.DeviceToken), payload)
+		if old := bkt.Get([]byte(device.DeviceToken)); old != nil {
+			var previous model.Device
+			if err := json.Unmarshal(old, &previous); err != nil {
+				return err
+			}
+			if err := unindexDevice(tx, &previous); err != nil {
+				return err
+			}
+		}
+		if err := bkt.Put([]byte(device.DeviceToken), payload); err != nil {
+			return err
+		}
+		return indexDevice(tx, device)
 	})
 }
 
 // GetDevice fetches device by token.
 func (s *Store) GetDevice(ctx context.Context, token string) (*model.Device, error) {
-	return s.getByKey(ctx, token, func(d *model.Device) bool { return true })
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var device *model.Device
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		device, err = getDevice(tx, []byte(token))
+		return err
+	})
+	return device, err
 }
 
 // GetDeviceByKey fetches device by Bark device key.
 func (s *Store) GetDeviceByKey(ctx context.Context, key string) (*model.Device, error) {
-	return s.getByKey(ctx, key, func(d *model.Device) bool {
-		return d.DeviceKey == key
-	})
-}
-
-func (s *Store) getByKey(ctx context.Context, key string, matcher func(*model.Device) bool) (*model.Device, error) {
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
-	var (
-		result *model.Device
-	)
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(bucketDevices)
-		return bkt.ForEach(func(k, v []byte) error {
-			var device model.Device
-			if err := json.Unmarshal(v, &device); err != nil {
-				return err
-			}
-			if matcher(&device) {
-				result = &device
-				return errStop
-			}
-			return nil
-		})
+	var device *model.Device
+	err := s.view(func(tx *bolt.Tx) error {
+		token := tx.Bucket(bucketDeviceKeys).Get([]byte(key))
+		if token == nil {
+			return storage.ErrNotFound
+		}
+		var err error
+		device, err = getDevice(tx, token)
+		return err
 	})
-	if err != nil && !errors.Is(err, errStop) {
+	return device, err
+}
+
+func getDevice(tx *bolt.Tx, token []byte) (*model.Device, error) {
+	v := tx.Bucket(bucketDevices).Get(token)
+	if v == nil {
+		return nil, storage.ErrNotFound
+	}
+	var device model.Device
+	if err := json.Unmarshal(v, &device); err != nil {
 		return nil, err
 	}
-	if result == nil {
-		return nil, storage.ErrNotFound
+	return &device, nil
+}
+
+// statusIndexKey is the bucketDeviceStatus key of a device. An empty status
+// is kept as is; it counts as ACTIVE.
+func statusIndexKey(status, token string) []byte {
+	return []byte(strings.ToUpper(strings.TrimSpace(status)) + "\x00" + token)
+}
+
+func indexDevice(tx *bolt.Tx, device *model.Device) error {
+	if device.DeviceKey != "" {
+		if err := tx.Bucket(bucketDeviceKeys).Put([]byte(device.DeviceKey), []byte(device.DeviceToken)); err != nil {
+			return err
+		}
 	}
-	return result, nil
+	return tx.Bucket(bucketDeviceStatus).Put(statusIndexKey(device.Status, device.DeviceToken), nil)
+}
+
+func unindexDevice(tx *bolt.Tx, device *model.Device) error {
+	keys := tx.Bucket(bucketDeviceKeys)
+	// Another device may have claimed the same key since; leave its entry.
+	if device.DeviceKey != "" && string(keys.Get([]byte(device.DeviceKey))) == device.DeviceToken {
+		if err := keys.Delete([]byte(device.DeviceKey)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketDeviceStatus).Delete(statusIndexKey(device.Status, device.DeviceToken))
+}
+
+// reindexDevices rebuilds the device indexes from the devices bucket and
+// returns how many devices were indexed.
+func reindexDevices(tx *bolt.Tx) (int, error) {
+	if err := recreateBuckets(tx, bucketDeviceKeys, bucketDeviceStatus); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := tx.Bucket(bucketDevices).ForEach(func(_, v []byte) error {
+		var device model.Device
+		if err := json.Unmarshal(v, &device); err != nil {
+			return err
+		}
+		n++
+		return indexDevice(tx, &device)
+	})
+	return n, err
+}
+
+// recreateBuckets replaces each named bucket with an empty one.
+func recreateBuckets(tx *bolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ListDevices returns all devices.
@@ -127,9 +467,120 @@ func (s *Store) ListDevices(ctx context.Context) ([]*model.Device, error) {
 
 // ListActiveDevices returns ACTIVE devices only.
 func (s *Store) ListActiveDevices(ctx context.Context) ([]*model.Device, error) {
-	return s.list(ctx, func(d *model.Device) bool {
-		status := strings.ToUpper(strings.TrimSpace(d.Status))
-		return status == "" || status == model.DeviceStatusActive
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var devices []*model.Device
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketDeviceStatus).Cursor()
+		for _, status := range []string{"", model.DeviceStatusActive} {
+			prefix := statusIndexKey(status, "")
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				device, err := getDevice(tx, k[len(prefix):])
+				if err != nil {
+					return err
+				}
+				devices = append(devices, device)
+			}
+		}
+		return nil
+	})
+	return devices, err
+}
+
+// DeleteDevice removes a device and its index entries.
+func (s *Store) DeleteDevice(ctx context.Context, token string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		device, err := getDevice(tx, []byte(token))
+		if err != nil {
+			return err
+		}
+		if err := unindexDevice(tx, device); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketDevices).Delete([]byte(token))
+	})
+}
+
+// SaveDeletedDevice stores a soft-deleted device keyed by its token,
+// replacing any earlier entry for the same token.
+func (s *Store) SaveDeletedDevice(ctx context.Context, deleted *model.DeletedDevice) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	payload, err := json.Marshal(deleted)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDeletedDevices).Put([]byte(deleted.Device.DeviceToken), payload)
+	})
+}
+
+// GetDeletedDevice fetches a soft-deleted device by token.
+func (s *Store) GetDeletedDevice(ctx context.Context, token string) (*model.DeletedDevice, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var deleted model.DeletedDevice
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketDeletedDevices).Get([]byte(token))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		return json.Unmarshal(v, &deleted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deleted, nil
+}
+
+// ListDeletedDevices returns all soft-deleted devices.
+func (s *Store) ListDeletedDevices(ctx context.Context) ([]*model.DeletedDevice, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var list []*model.DeletedDevice
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDeletedDevices).ForEach(func(_, v []byte) error {
+			var deleted model.DeletedDevice
+			if err := json.Unmarshal(v, &deleted); err != nil {
+				return err
+			}
+			list = append(list, &deleted)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// DeleteDeletedDevice drops a soft-deleted device.
+func (s *Store) DeleteDeletedDevice(ctx context.Context, token string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketDeletedDevices)
+		if bkt.Get([]byte(token)) == nil {
+			return storage.ErrNotFound
+		}
+		return bkt.Delete([]byte(token))
 	})
 }
 
@@ -140,7 +591,7 @@ func (s *Store) list(ctx context.Context, filter func(*model.Device) bool) ([]*m
 	default:
 	}
 	var devices []*model.Device
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(bucketDevices)
 		return bkt.ForEach(func(_, v []byte) error {
 			var device model.Device
@@ -169,7 +620,7 @@ func (s *Store) AppendNoticeLog(ctx context.Context, log *model.NoticeLog) error
 		log.CreatedAt = now
 	}
 	log.UpdatedAt = now
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(bucketNoticeLog)
 		id, err := bkt.NextSequence()
 		if err != nil {
@@ -182,7 +633,10 @@ func (s *Store) AppendNoticeLog(ctx context.Context, log *model.NoticeLog) error
 		}
 		key := make([]byte, 8)
 		binary.BigEndian.PutUint64(key, id)
-		return bkt.Put(key, payload)
+		if err := bkt.Put(key, payload); err != nil {
+			return err
+		}
+		return indexNoticeLog(tx, log)
 	})
 }
 
@@ -194,7 +648,7 @@ func (s *Store) ListNoticeLogs(ctx context.Context) ([]*model.NoticeLog, error)
 	default:
 	}
 	var logs []*model.NoticeLog
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(bucketNoticeLog)
 		return bkt.ForEach(func(_, v []byte) error {
 			var log model.NoticeLog
@@ -208,3 +662,1157 @@ func (s *Store) ListNoticeLogs(ctx context.Context) ([]*model.NoticeLog, error)
 	})
 	return logs, err
 }
+
+// GetNoticeLog fetches a single push log entry by ID.
+func (s *Store) GetNoticeLog(ctx context.Context, id uint64) (*model.NoticeLog, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	var log *model.NoticeLog
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketNoticeLog).Get(key)
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		log = &model.NoticeLog{}
+		return json.Unmarshal(v, log)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// QueryNoticeLogs returns logs matching filter, newest first. It walks the
+// most selective index over the requested time range and only decodes the
+// entries it has to check or return. A PageSize of zero returns every match.
+func (s *Store) QueryNoticeLogs(ctx context.Context, filter model.NoticeLogFilter) (*model.NoticeLogPage, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var after []byte
+	if filter.Page <= 0 && filter.Cursor != "" {
+		at, id, err := storage.DecodeLogCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = make([]byte, logSuffixLen)
+		binary.BigEndian.PutUint64(after, uint64(at))
+		binary.BigEndian.PutUint64(after[8:], id)
+	}
+	page := &model.NoticeLogPage{Data: []*model.NoticeLog{}, PageNum: filter.Page, PageSize: filter.PageSize}
+	skip := 0
+	if filter.Page > 0 {
+		skip = (filter.Page - 1) * filter.PageSize
+	}
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket, prefix, checks := logIndexFor(filter)
+		retries := tx.Bucket(bucketLogRetries)
+		matched := 0
+		var last []byte
+		return scanLogRange(tx.Bucket(bucket), prefix, filter.BeginTime, filter.EndTime, after, func(suffix []byte) (bool, error) {
+			id := suffix[8:]
+			if filter.Unretried && retries.Get(id) != nil {
+				return true, nil
+			}
+			var log *model.NoticeLog
+			if checks {
+				var err error
+				if log, err = getNoticeLog(tx, id); err != nil {
+					return false, err
+				}
+				if !logMatches(log, filter) {
+					return true, nil
+				}
+			}
+			matched++
+			if filter.PageSize > 0 && matched > skip+filter.PageSize {
+				if filter.Page <= 0 {
+					// One past the page: there is more to fetch.
+					page.NextCursor = suffixCursor(last)
+					return false, nil
+				}
+				if page.NextCursor == "" {
+					page.NextCursor = suffixCursor(last)
+				}
+				page.Total++
+				return true, nil
+			}
+			if matched > skip {
+				if log == nil {
+					var err error
+					if log, err = getNoticeLog(tx, id); err != nil {
+						return false, err
+					}
+				}
+				page.Data = append(page.Data, log)
+				last = append(last[:0], suffix...)
+			}
+			page.Total++
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if filter.Page <= 0 {
+		page.Total = 0
+	} else if filter.PageSize > 0 {
+		page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+	}
+	return page, nil
+}
+
+// CountNoticeLogs counts the logs created within [begin, end] per day, month
+// or year (UTC), or per status, group or device key. Entries with an empty
+// status or group are counted under "".
+func (s *Store) CountNoticeLogs(ctx context.Context, groupBy string, begin, end *time.Time) (map[string]int, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	counts := make(map[string]int)
+	err := s.view(func(tx *bolt.Tx) error {
+		var layout string
+		var bucket []byte
+		switch groupBy {
+		case model.NoticeLogByDay:
+			layout = "2006-01-02"
+		case model.NoticeLogByMonth:
+			layout = "2006-01"
+		case model.NoticeLogByYear:
+			layout = "2006"
+		case model.NoticeLogByStatus:
+			bucket = bucketLogStatus
+		case model.NoticeLogByGroup:
+			bucket = bucketLogGroup
+		case model.NoticeLogByDevice:
+			bucket = bucketLogDevice
+		default:
+			return fmt.Errorf("unknown log grouping %q", groupBy)
+		}
+		if layout != "" {
+			return scanLogRange(tx.Bucket(bucketLogTime), nil, begin, end, nil, func(suffix []byte) (bool, error) {
+				at := time.Unix(0, int64(binary.BigEndian.Uint64(suffix))).UTC()
+				counts[at.Format(layout)]++
+				return true, nil
+			})
+		}
+		// Visit each distinct value, counting only its slice of the range.
+		bkt := tx.Bucket(bucket)
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Seek(nextLogPrefix(k)) {
+			prefix := append([]byte(nil), k[:len(k)-logSuffixLen]...)
+			label, n := "", 0
+			err := scanLogRange(bkt, prefix, begin, end, nil, func(suffix []byte) (bool, error) {
+				if n == 0 {
+					label = string(bkt.Get(append(prefix, suffix...)))
+				}
+				n++
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				counts[label] += n
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// pruneBatch bounds how many logs are deleted per transaction.
+const pruneBatch = 1000
+
+// PruneNoticeLogs deletes the logs selected by rule and returns how many were
+// removed.
+func (s *Store) PruneNoticeLogs(ctx context.Context, rule model.NoticeLogPrune) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	if rule.Before.IsZero() && rule.Keep <= 0 {
+		return 0, nil
+	}
+	var ids [][]byte
+	except := make(map[string]bool, len(rule.ExceptStatuses))
+	if rule.Status == "" {
+		for _, status := range rule.ExceptStatuses {
+			except[strings.ToLower(strings.TrimSpace(status))] = true
+		}
+	}
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket, prefix, _ := logIndexFor(model.NoticeLogFilter{Status: rule.Status})
+		seen := 0
+		return scanLogRange(tx.Bucket(bucket), prefix, nil, nil, nil, func(suffix []byte) (bool, error) {
+			if len(except) > 0 {
+				log, err := getNoticeLog(tx, suffix[8:])
+				if err != nil {
+					return false, err
+				}
+				if except[strings.ToLower(strings.TrimSpace(log.Status))] {
+					return true, nil
+				}
+			}
+			seen++
+			at := int64(binary.BigEndian.Uint64(suffix))
+			if (rule.Keep > 0 && seen > rule.Keep) || (!rule.Before.IsZero() && at < rule.Before.UnixNano()) {
+				ids = append(ids, append([]byte(nil), suffix[8:]...))
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.updateNoticeLogs(ctx, ids, deleteNoticeLog)
+}
+
+// DeleteDeviceNoticeLogs deletes every push log sent to deviceKey, matched
+// case-insensitively, and returns how many were removed.
+func (s *Store) DeleteDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	ids, err := s.deviceNoticeLogIDs(ctx, deviceKey)
+	if err != nil {
+		return 0, err
+	}
+	return s.updateNoticeLogs(ctx, ids, deleteNoticeLog)
+}
+
+// AnonymizeDeviceNoticeLogs replaces deviceKey with model.AnonymizedDeviceKey
+// in every push log sent to it and returns how many were changed.
+func (s *Store) AnonymizeDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	ids, err := s.deviceNoticeLogIDs(ctx, deviceKey)
+	if err != nil {
+		return 0, err
+	}
+	return s.updateNoticeLogs(ctx, ids, func(tx *bolt.Tx, log *model.NoticeLog) error {
+		if err := unindexNoticeLog(tx, log); err != nil {
+			return err
+		}
+		log.DeviceKey = model.AnonymizedDeviceKey
+		payload, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketNoticeLog).Put(uint64Key(log.ID), payload); err != nil {
+			return err
+		}
+		return indexNoticeLog(tx, log)
+	})
+}
+
+func (s *Store) deviceNoticeLogIDs(ctx context.Context, deviceKey string) ([][]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if strings.TrimSpace(deviceKey) == "" {
+		return nil, nil
+	}
+	var ids [][]byte
+	err := s.view(func(tx *bolt.Tx) error {
+		return scanLogRange(tx.Bucket(bucketLogDevice), logIndexPrefix(deviceKey), nil, nil, nil, func(suffix []byte) (bool, error) {
+			ids = append(ids, append([]byte(nil), suffix[8:]...))
+			return true, nil
+		})
+	})
+	return ids, err
+}
+
+// updateNoticeLogs applies fn to the logs with the given IDs in batches of
+// pruneBatch, so large deletions don't hold one long write transaction, and
+// returns how many logs it was applied to. Logs that no longer exist are
+// skipped.
+func (s *Store) updateNoticeLogs(ctx context.Context, ids [][]byte, fn func(*bolt.Tx, *model.NoticeLog) error) (int, error) {
+	done := 0
+	for len(ids) > 0 {
+		select {
+		case <-ctx.Done():
+			return done, ctx.Err()
+		default:
+		}
+		batch := ids[:min(pruneBatch, len(ids))]
+		ids = ids[len(batch):]
+		err := s.update(func(tx *bolt.Tx) error {
+			for _, id := range batch {
+				log, err := getNoticeLog(tx, id)
+				if err == storage.ErrNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := fn(tx, log); err != nil {
+					return err
+				}
+				done++
+			}
+			return nil
+		})
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// deleteNoticeLog removes a log and its index entries. A retry entry pointing
+// at it is kept so its original still counts as retried.
+func deleteNoticeLog(tx *bolt.Tx, log *model.NoticeLog) error {
+	if err := tx.Bucket(bucketNoticeLog).Delete(uint64Key(log.ID)); err != nil {
+		return err
+	}
+	if err := unindexNoticeLog(tx, log); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketLogRetries).Delete(uint64Key(log.ID))
+}
+
+// logSuffixLen is the length of the CreatedAt+ID suffix of log index keys.
+const logSuffixLen = 16
+
+func logSuffix(log *model.NoticeLog) []byte {
+	suffix := make([]byte, logSuffixLen)
+	binary.BigEndian.PutUint64(suffix, uint64(log.CreatedAt.UnixNano()))
+	binary.BigEndian.PutUint64(suffix[8:], log.ID)
+	return suffix
+}
+
+func suffixCursor(suffix []byte) string {
+	return storage.EncodeLogCursor(time.Unix(0, int64(binary.BigEndian.Uint64(suffix))), binary.BigEndian.Uint64(suffix[8:]))
+}
+
+func logIndexPrefix(value string) []byte {
+	return append([]byte(strings.ToLower(strings.TrimSpace(value))), 0)
+}
+
+// nextLogPrefix returns the first key past every entry sharing k's value.
+func nextLogPrefix(k []byte) []byte {
+	next := append([]byte(nil), k[:len(k)-logSuffixLen]...)
+	next[len(next)-1] = 1
+	return next
+}
+
+func indexNoticeLog(tx *bolt.Tx, log *model.NoticeLog) error {
+	suffix := logSuffix(log)
+	if err := tx.Bucket(bucketLogTime).Put(suffix, nil); err != nil {
+		return err
+	}
+	for bucket, value := range map[string]string{
+		string(bucketLogDevice): log.DeviceKey,
+		string(bucketLogGroup):  log.Group,
+		string(bucketLogStatus): log.Status,
+	} {
+		if err := tx.Bucket([]byte(bucket)).Put(append(logIndexPrefix(value), suffix...), []byte(value)); err != nil {
+			return err
+		}
+	}
+	if log.RetryOf != 0 {
+		return tx.Bucket(bucketLogRetries).Put(uint64Key(log.RetryOf), uint64Key(log.ID))
+	}
+	return nil
+}
+
+// unindexNoticeLog removes a log from the field indexes. Retry entries are
+// left alone, so a log can be re-indexed in place without losing them.
+func unindexNoticeLog(tx *bolt.Tx, log *model.NoticeLog) error {
+	suffix := logSuffix(log)
+	if err := tx.Bucket(bucketLogTime).Delete(suffix); err != nil {
+		return err
+	}
+	for bucket, value := range map[string]string{
+		string(bucketLogDevice): log.DeviceKey,
+		string(bucketLogGroup):  log.Group,
+		string(bucketLogStatus): log.Status,
+	} {
+		if err := tx.Bucket([]byte(bucket)).Delete(append(logIndexPrefix(value), suffix...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexNoticeLogs rebuilds the push log indexes and returns how many logs
+// were indexed.
+func reindexNoticeLogs(tx *bolt.Tx) (int, error) {
+	if err := recreateBuckets(tx, logIndexBuckets...); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := tx.Bucket(bucketNoticeLog).ForEach(func(_, v []byte) error {
+		var log model.NoticeLog
+		if err := json.Unmarshal(v, &log); err != nil {
+			return err
+		}
+		n++
+		return indexNoticeLog(tx, &log)
+	})
+	return n, err
+}
+
+// logIndexFor picks the index that narrows filter the most and reports
+// whether entries still have to be decoded to check the other fields.
+func logIndexFor(filter model.NoticeLogFilter) ([]byte, []byte, bool) {
+	fields := 0
+	for _, v := range []string{filter.DeviceKey, filter.Group, filter.Status} {
+		if v != "" {
+			fields++
+		}
+	}
+	checks := fields > 1
+	switch {
+	case filter.DeviceKey != "":
+		return bucketLogDevice, logIndexPrefix(filter.DeviceKey), checks
+	case filter.Group != "":
+		return bucketLogGroup, logIndexPrefix(filter.Group), checks
+	case filter.Status != "":
+		return bucketLogStatus, logIndexPrefix(filter.Status), checks
+	}
+	return bucketLogTime, nil, false
+}
+
+func logMatches(log *model.NoticeLog, filter model.NoticeLogFilter) bool {
+	if filter.DeviceKey != "" && !strings.EqualFold(log.DeviceKey, strings.TrimSpace(filter.DeviceKey)) {
+		return false
+	}
+	if filter.Group != "" && !strings.EqualFold(strings.TrimSpace(log.Group), strings.TrimSpace(filter.Group)) {
+		return false
+	}
+	if filter.Status != "" && !strings.EqualFold(log.Status, strings.TrimSpace(filter.Status)) {
+		return false
+	}
+	return true
+}
+
+// scanLogRange calls fn with the suffix of every key under prefix whose time
+// falls within [begin, end] and, if after is set, that sorts before after.
+// Keys are visited newest first until fn returns false.
+func scanLogRange(bkt *bolt.Bucket, prefix []byte, begin, end *time.Time, after []byte, fn func(suffix []byte) (bool, error)) error {
+	lower := append(append([]byte(nil), prefix...), make([]byte, logSuffixLen)...)
+	if begin != nil {
+		binary.BigEndian.PutUint64(lower[len(prefix):], uint64(begin.UnixNano()))
+	}
+	// upper is exclusive.
+	upper := append(append([]byte(nil), prefix...), bytes.Repeat([]byte{0xff}, logSuffixLen)...)
+	if end != nil {
+		binary.BigEndian.PutUint64(upper[len(prefix):], uint64(end.UnixNano())+1)
+		binary.BigEndian.PutUint64(upper[len(prefix)+8:], 0)
+	}
+	if after != nil {
+		if bound := append(append([]byte(nil), prefix...), after...); bytes.Compare(bound, upper) < 0 {
+			upper = bound
+		}
+	}
+	c := bkt.Cursor()
+	k, _ := c.Seek(upper)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for ; k != nil && bytes.Compare(k, lower) >= 0; k, _ = c.Prev() {
+		more, err := fn(k[len(prefix):])
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func getNoticeLog(tx *bolt.Tx, id []byte) (*model.NoticeLog, error) {
+	v := tx.Bucket(bucketNoticeLog).Get(id)
+	if v == nil {
+		return nil, storage.ErrNotFound
+	}
+	log := &model.NoticeLog{}
+	if err := json.Unmarshal(v, log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func uint64Key(v uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, v)
+	return key
+}
+
+// SaveNotice stores a broadcast record keyed by its message ID.
+func (s *Store) SaveNotice(ctx context.Context, notice *model.NoticeRecord) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	now := time.Now().UTC()
+	if notice.CreatedAt.IsZero() {
+		notice.CreatedAt = now
+	}
+	notice.UpdatedAt = now
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketNotices).Put([]byte(notice.ID), payload)
+	})
+}
+
+// GetNotice fetches a broadcast record by message ID.
+func (s *Store) GetNotice(ctx context.Context, id string) (*model.NoticeRecord, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var notice *model.NoticeRecord
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketNotices).Get([]byte(id))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		notice = &model.NoticeRecord{}
+		return json.Unmarshal(v, notice)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+// SaveAttachment stores attachment metadata keyed by its ID.
+func (s *Store) SaveAttachment(ctx context.Context, attachment *model.Attachment) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if attachment.CreatedAt.IsZero() {
+		attachment.CreatedAt = time.Now().UTC()
+	}
+	payload, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttach).Put([]byte(attachment.ID), payload)
+	})
+}
+
+// GetAttachment fetches attachment metadata by ID.
+func (s *Store) GetAttachment(ctx context.Context, id string) (*model.Attachment, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var attachment *model.Attachment
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAttach).Get([]byte(id))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		attachment = &model.Attachment{}
+		return json.Unmarshal(v, attachment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// ListExpiredAttachments returns attachments whose expiry is not after before.
+func (s *Store) ListExpiredAttachments(ctx context.Context, before time.Time) ([]*model.Attachment, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var expired []*model.Attachment
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttach).ForEach(func(_, v []byte) error {
+			var attachment model.Attachment
+			if err := json.Unmarshal(v, &attachment); err != nil {
+				return err
+			}
+			if attachment.Expired(before) {
+				expired = append(expired, &attachment)
+			}
+			return nil
+		})
+	})
+	return expired, err
+}
+
+// DeleteAttachment removes attachment metadata; missing IDs are ignored.
+func (s *Store) DeleteAttachment(ctx context.Context, id string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttach).Delete([]byte(id))
+	})
+}
+
+// SaveAPIKey stores or updates an API key record.
+func (s *Store) SaveAPIKey(ctx context.Context, key *model.APIKey) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	now := time.Now().UTC()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = now
+	}
+	key.UpdatedAt = now
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).Put([]byte(key.ID), payload)
+	})
+}
+
+// GetAPIKey fetches an API key by ID.
+func (s *Store) GetAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var key *model.APIKey
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAPIKeys).Get([]byte(id))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		key = &model.APIKey{}
+		return json.Unmarshal(v, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all API keys.
+func (s *Store) ListAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var keys []*model.APIKey
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).ForEach(func(_, v []byte) error {
+			var key model.APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, &key)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// DeleteAPIKey removes an API key.
+func (s *Store) DeleteAPIKey(ctx context.Context, id string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketAPIKeys)
+		if bkt.Get([]byte(id)) == nil {
+			return storage.ErrNotFound
+		}
+		return bkt.Delete([]byte(id))
+	})
+}
+
+// TouchAPIKey records that an existing API key was used at at.
+func (s *Store) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	var key model.APIKey
+	return s.updateRecord(ctx, bucketAPIKeys, id, &key, func() error {
+		key.LastUsedAt = &at
+		return nil
+	})
+}
+
+// updateRecord decodes key from bucket into v, lets fn change it and stores
+// the result in one transaction. It returns ErrNotFound if key does not
+// exist and fn's error, writing nothing, if fn fails.
+func (s *Store) updateRecord(ctx context.Context, bucket []byte, key string, v any, fn func() error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+		payload := bkt.Get([]byte(key))
+		if payload == nil {
+			return storage.ErrNotFound
+		}
+		if err := json.Unmarshal(payload, v); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		updated, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), updated)
+	})
+}
+
+// SaveUser stores or updates an admin user keyed by normalized username.
+func (s *Store) SaveUser(ctx context.Context, user *model.User) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	now := time.Now().UTC()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	payload, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).Put([]byte(model.NormalizeUsername(user.Username)), payload)
+	})
+}
+
+// GetUser fetches an admin user by username.
+func (s *Store) GetUser(ctx context.Context, username string) (*model.User, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var user *model.User
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketUsers).Get([]byte(model.NormalizeUsername(username)))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		user = &model.User{}
+		return json.Unmarshal(v, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListUsers returns all admin users.
+func (s *Store) ListUsers(ctx context.Context) ([]*model.User, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var users []*model.User
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(_, v []byte) error {
+			var user model.User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			users = append(users, &user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// DeleteUser removes an admin user.
+func (s *Store) DeleteUser(ctx context.Context, username string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	key := []byte(model.NormalizeUsername(username))
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketUsers)
+		if bkt.Get(key) == nil {
+			return storage.ErrNotFound
+		}
+		return bkt.Delete(key)
+	})
+}
+
+// SaveSession stores or updates a login session.
+func (s *Store) SaveSession(ctx context.Context, session *model.Session) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Put([]byte(session.ID), payload)
+	})
+}
+
+// GetSession fetches a login session by ID.
+func (s *Store) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var session *model.Session
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketSessions).Get([]byte(id))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		session = &model.Session{}
+		return json.Unmarshal(v, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ListSessions returns all login sessions, including expired ones.
+func (s *Store) ListSessions(ctx context.Context) ([]*model.Session, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var sessions []*model.Session
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(_, v []byte) error {
+			var session model.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			sessions = append(sessions, &session)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+// RotateSession replaces a session, but only while its stored RefreshHash is
+// still previousHash. It returns ErrNotFound if the session was deleted and
+// ErrConflict if it was rotated in the meantime; it never creates one.
+func (s *Store) RotateSession(ctx context.Context, session *model.Session, previousHash string) error {
+	var current model.Session
+	return s.updateRecord(ctx, bucketSessions, session.ID, &current, func() error {
+		if current.RefreshHash != previousHash {
+			return storage.ErrConflict
+		}
+		current = *session
+		return nil
+	})
+}
+
+// DeleteSession removes a login session.
+func (s *Store) DeleteSession(ctx context.Context, id string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketSessions)
+		if bkt.Get([]byte(id)) == nil {
+			return storage.ErrNotFound
+		}
+		return bkt.Delete([]byte(id))
+	})
+}
+
+// SaveLoginAttempt stores the failed-login counter for a username or IP.
+func (s *Store) SaveLoginAttempt(ctx context.Context, attempt *model.LoginAttempt) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	payload, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttempts).Put([]byte(attempt.Key()), payload)
+	})
+}
+
+// GetLoginAttempt fetches a failed-login counter by key.
+func (s *Store) GetLoginAttempt(ctx context.Context, key string) (*model.LoginAttempt, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var attempt *model.LoginAttempt
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAttempts).Get([]byte(key))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		attempt = &model.LoginAttempt{}
+		return json.Unmarshal(v, attempt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// ListLoginAttempts returns all failed-login counters.
+func (s *Store) ListLoginAttempts(ctx context.Context) ([]*model.LoginAttempt, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var attempts []*model.LoginAttempt
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttempts).ForEach(func(_, v []byte) error {
+			var attempt model.LoginAttempt
+			if err := json.Unmarshal(v, &attempt); err != nil {
+				return err
+			}
+			attempts = append(attempts, &attempt)
+			return nil
+		})
+	})
+	return attempts, err
+}
+
+// DeleteLoginAttempt removes a failed-login counter.
+func (s *Store) DeleteLoginAttempt(ctx context.Context, key string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketAttempts)
+		if bkt.Get([]byte(key)) == nil {
+			return storage.ErrNotFound
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+// AppendAuditEntry stores an audit entry under the next sequence ID.
+func (s *Store) AppendAuditEntry(ctx context.Context, entry *model.AuditEntry) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketAudit)
+		id, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := bkt.Put(uint64Key(id), payload); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketAuditTime).Put(auditSuffix(entry), nil)
+	})
+}
+
+// ListAuditEntries returns all audit entries in insertion order.
+func (s *Store) ListAuditEntries(ctx context.Context) ([]*model.AuditEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var entries []*model.AuditEntry
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAudit).ForEach(func(_, v []byte) error {
+			var entry model.AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, &entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// QueryAuditEntries returns a page of the entries matching filter, newest
+// first. It walks the time index over the requested range and only decodes
+// entries it has to check or return. A PageSize of zero returns every match.
+func (s *Store) QueryAuditEntries(ctx context.Context, filter model.AuditFilter) (*model.AuditPage, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	page := &model.AuditPage{Data: []*model.AuditEntry{}, PageNum: filter.Page, PageSize: filter.PageSize}
+	skip := 0
+	if filter.Page > 0 {
+		skip = (filter.Page - 1) * filter.PageSize
+	}
+	checks := filter.Actor != "" || filter.Action != "" || filter.Target != ""
+	err := s.view(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketAudit)
+		return scanLogRange(tx.Bucket(bucketAuditTime), nil, filter.BeginTime, filter.EndTime, nil, func(suffix []byte) (bool, error) {
+			var entry *model.AuditEntry
+			if checks {
+				var err error
+				if entry, err = getAuditEntry(bkt, suffix[8:]); err != nil {
+					return false, err
+				}
+				if !filter.Matches(entry) {
+					return true, nil
+				}
+			}
+			page.Total++
+			if page.Total <= skip || (filter.PageSize > 0 && len(page.Data) >= filter.PageSize) {
+				return true, nil
+			}
+			if entry == nil {
+				var err error
+				if entry, err = getAuditEntry(bkt, suffix[8:]); err != nil {
+					return false, err
+				}
+			}
+			page.Data = append(page.Data, entry)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if filter.PageSize > 0 {
+		page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+	}
+	return page, nil
+}
+
+// PruneAuditEntries deletes the entries created before before and returns
+// how many were removed.
+func (s *Store) PruneAuditEntries(ctx context.Context, before time.Time) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	var suffixes [][]byte
+	end := before.Add(-time.Nanosecond)
+	err := s.view(func(tx *bolt.Tx) error {
+		return scanLogRange(tx.Bucket(bucketAuditTime), nil, nil, &end, nil, func(suffix []byte) (bool, error) {
+			suffixes = append(suffixes, append([]byte(nil), suffix...))
+			return true, nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	done := 0
+	for len(suffixes) > 0 {
+		select {
+		case <-ctx.Done():
+			return done, ctx.Err()
+		default:
+		}
+		batch := suffixes[:min(pruneBatch, len(suffixes))]
+		suffixes = suffixes[len(batch):]
+		err := s.update(func(tx *bolt.Tx) error {
+			for _, suffix := range batch {
+				if err := tx.Bucket(bucketAudit).Delete(suffix[8:]); err != nil {
+					return err
+				}
+				if err := tx.Bucket(bucketAuditTime).Delete(suffix); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return done, err
+		}
+		done += len(batch)
+	}
+	return done, nil
+}
+
+func auditSuffix(entry *model.AuditEntry) []byte {
+	suffix := make([]byte, logSuffixLen)
+	binary.BigEndian.PutUint64(suffix, uint64(entry.CreatedAt.UnixNano()))
+	binary.BigEndian.PutUint64(suffix[8:], entry.ID)
+	return suffix
+}
+
+func getAuditEntry(bkt *bolt.Bucket, id []byte) (*model.AuditEntry, error) {
+	v := bkt.Get(id)
+	if v == nil {
+		return nil, storage.ErrNotFound
+	}
+	entry := &model.AuditEntry{}
+	if err := json.Unmarshal(v, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// reindexAuditEntries rebuilds the audit time index and returns how many
+// entries were indexed.
+func reindexAuditEntries(tx *bolt.Tx) (int, error) {
+	if err := recreateBuckets(tx, bucketAuditTime); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := tx.Bucket(bucketAudit).ForEach(func(_, v []byte) error {
+		var entry model.AuditEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		n++
+		return tx.Bucket(bucketAuditTime).Put(auditSuffix(&entry), nil)
+	})
+	return n, err
+}
@@ -0,0 +1,123 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage/storetest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storage.Store {
+		store, err := New(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+var benchmarkSizes = []int{100, 1000, 10000}
+
+// benchmarkStore returns a store holding n devices, only a quarter of them
+// active. They are written in one transaction to keep setup fast.
+func benchmarkStore(b *testing.B, n int) *Store {
+	b.Helper()
+	store, err := New(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { store.Close() })
+	now := time.Now().UTC()
+	err = store.update(func(tx *bolt.Tx) error {
+		for i := range n {
+			device := &model.Device{
+				DeviceToken: fmt.Sprintf("token-%06d", i),
+				DeviceKey:   fmt.Sprintf("key-%06d", i),
+				Status:      model.DeviceStatusActive,
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			}
+			if i%4 != 0 {
+				device.Status = model.DeviceStatusStop
+			}
+			payload, err := json.Marshal(device)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketDevices).Put([]byte(device.DeviceToken), payload); err != nil {
+				return err
+			}
+			if err := indexDevice(tx, device); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return store
+}
+
+// BenchmarkGetDeviceByKey compares the key index with the full scan it
+// replaced.
+func BenchmarkGetDeviceByKey(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range benchmarkSizes {
+		store := benchmarkStore(b, n)
+		b.Run(fmt.Sprintf("devices=%d/index", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				if _, err := store.GetDeviceByKey(ctx, fmt.Sprintf("key-%06d", i%n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("devices=%d/scan", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				key := fmt.Sprintf("key-%06d", i%n)
+				devices, err := store.list(ctx, func(d *model.Device) bool { return d.DeviceKey == key })
+				if err != nil || len(devices) != 1 {
+					b.Fatalf("scan for %s: %d devices, %v", key, len(devices), err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListActiveDevices compares the status index with decoding every
+// device and filtering.
+func BenchmarkListActiveDevices(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range benchmarkSizes {
+		store := benchmarkStore(b, n)
+		want := (n + 3) / 4
+		b.Run(fmt.Sprintf("devices=%d/index", n), func(b *testing.B) {
+			for b.Loop() {
+				devices, err := store.ListActiveDevices(ctx)
+				if err != nil || len(devices) != want {
+					b.Fatalf("ListActiveDevices: %d devices, %v", len(devices), err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("devices=%d/scan", n), func(b *testing.B) {
+			for b.Loop() {
+				devices, err := store.list(ctx, func(d *model.Device) bool {
+					return d.Status == "" || strings.EqualFold(d.Status, model.DeviceStatusActive)
+				})
+				if err != nil || len(devices) != want {
+					b.Fatalf("scan: %d devices, %v", len(devices), err)
+				}
+			}
+		})
+	}
+}
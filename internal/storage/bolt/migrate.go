@@ -0,0 +1,165 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucketMeta holds store-wide settings; keySchemaVersion is the number of
+// migrations applied, as a big-endian uint64.
+var (
+	bucketMeta       = []byte("meta")
+	keySchemaVersion = []byte("schema_version")
+)
+
+// migration is one schema step. Steps must be idempotent: a database
+// written before versioning existed starts at version 0 and runs every step,
+// whatever parts of the schema it already has.
+type migration struct {
+	description string
+	// apply makes the change and summarizes it for the report.
+	apply func(tx *bolt.Tx) (string, error)
+}
+
+// migrations are applied in order. Append new steps; never edit or reorder
+// released ones.
+var migrations = []migration{
+	{"create data buckets", func(tx *bolt.Tx) (string, error) {
+		created := 0
+		for _, name := range [][]byte{bucketDevices, bucketNoticeLog, bucketNotices, bucketAttach, bucketAPIKeys, bucketUsers, bucketSessions, bucketAttempts, bucketAudit} {
+			if tx.Bucket(name) == nil {
+				if _, err := tx.CreateBucket(name); err != nil {
+					return "", err
+				}
+				created++
+			}
+		}
+		return fmt.Sprintf("created %d buckets", created), nil
+	}},
+	{"index devices by key and status", func(tx *bolt.Tx) (string, error) {
+		n, err := reindexDevices(tx)
+		return fmt.Sprintf("indexed %d devices", n), err
+	}},
+	{"index push logs by time, device, group and status", func(tx *bolt.Tx) (string, error) {
+		n, err := reindexNoticeLogs(tx)
+		return fmt.Sprintf("indexed %d push logs", n), err
+	}},
+	{"create deleted devices bucket", func(tx *bolt.Tx) (string, error) {
+		if tx.Bucket(bucketDeletedDevices) != nil {
+			return "already present", nil
+		}
+		_, err := tx.CreateBucket(bucketDeletedDevices)
+		return "created 1 bucket", err
+	}},
+	{"index audit entries by time", func(tx *bolt.Tx) (string, error) {
+		n, err := reindexAuditEntries(tx)
+		return fmt.Sprintf("indexed %d audit entries", n), err
+	}},
+}
+
+// SchemaVersion is the schema version this build migrates databases to.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	bkt := tx.Bucket(bucketMeta)
+	if bkt == nil {
+		return 0
+	}
+	v := bkt.Get(keySchemaVersion)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	bkt, err := tx.CreateBucketIfNotExists(bucketMeta)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(keySchemaVersion, uint64Key(uint64(version)))
+}
+
+// errDryRun rolls back a dry-run transaction.
+var errDryRun = errors.New("dry run")
+
+// migrate brings db up to SchemaVersion. Each step runs in its own
+// transaction together with the version bump, so an interrupted upgrade
+// resumes at the failed step. A dry run applies every pending step in one
+// transaction and rolls it back.
+func migrate(db *bolt.DB, dryRun bool) (*model.MigrationReport, error) {
+	report := &model.MigrationReport{DryRun: dryRun, Steps: []model.MigrationStep{}}
+	if err := db.View(func(tx *bolt.Tx) error {
+		report.From = schemaVersion(tx)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	report.To = report.From
+	if report.From > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than this build supports (%d)", report.From, len(migrations))
+	}
+	run := func(tx *bolt.Tx, version int) error {
+		step := migrations[version-1]
+		changes, err := step.apply(tx)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", version, step.description, err)
+		}
+		report.Steps = append(report.Steps, model.MigrationStep{Version: version, Description: step.description, Changes: changes})
+		report.To = version
+		return setSchemaVersion(tx, version)
+	}
+	if dryRun {
+		err := db.Update(func(tx *bolt.Tx) error {
+			for v := report.From + 1; v <= len(migrations); v++ {
+				if err := run(tx, v); err != nil {
+					return err
+				}
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return report, nil
+	}
+	for v := report.From + 1; v <= len(migrations); v++ {
+		if err := db.Update(func(tx *bolt.Tx) error { return run(tx, v) }); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Migrate opens the database at path, applies pending migrations and
+// closes it again. With dryRun nothing is written, and a missing file is
+// reported as a new database without being created.
+func Migrate(path string, dryRun bool) (*model.MigrationReport, error) {
+	if _, err := os.Stat(path); dryRun && errors.Is(err, os.ErrNotExist) {
+		report := &model.MigrationReport{DryRun: true, To: len(migrations), Steps: []model.MigrationStep{}}
+		for i, step := range migrations {
+			report.Steps = append(report.Steps, model.MigrationStep{Version: i + 1, Description: step.description, Changes: "new database"})
+		}
+		return report, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Dry runs need a writable transaction to roll back, so the file is
+	// opened normally either way.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate(db, dryRun)
+}
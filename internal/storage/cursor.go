@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a malformed NoticeLogFilter.Cursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeLogCursor builds the opaque cursor pointing just past a push log:
+// its CreatedAt in Unix nanoseconds and its ID, big-endian, hex encoded.
+// Every Store uses this format so cursors stay valid across backends.
+func EncodeLogCursor(createdAt time.Time, id uint64) string {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(createdAt.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:], id)
+	return hex.EncodeToString(buf)
+}
+
+// DecodeLogCursor parses a cursor made by EncodeLogCursor.
+func DecodeLogCursor(cursor string) (int64, uint64, error) {
+	buf, err := hex.DecodeString(cursor)
+	if err != nil || len(buf) != 16 {
+		return 0, 0, ErrInvalidCursor
+	}
+	return int64(binary.BigEndian.Uint64(buf)), binary.BigEndian.Uint64(buf[8:]), nil
+}
@@ -4,3 +4,11 @@ import "errors"
 
 // ErrNotFound indicates the requested record does not exist.
 var ErrNotFound = errors.New("not found")
+
+// ErrConflict indicates the record changed since the caller read it, so a
+// conditional update was not applied.
+var ErrConflict = errors.New("record changed concurrently")
+
+// ErrNotSupported indicates the storage driver cannot perform the operation,
+// e.g. backups of the memory store.
+var ErrNotSupported = errors.New("not supported by this storage driver")
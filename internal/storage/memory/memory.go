@@ -0,0 +1,923 @@
+// Package memory provides a storage.Store that keeps everything in process
+// memory, for throwaway instances and tests. Nothing survives a restart.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+var _ storage.Store = (*Store)(nil)
+
+// Document tables hold every record type other than devices, push logs and
+// audit entries, keyed the same way as in the other stores.
+const (
+	tableNotices        = "notices"
+	tableAttachments    = "attachments"
+	tableAPIKeys        = "api_keys"
+	tableUsers          = "users"
+	tableSessions       = "sessions"
+	tableAttempts       = "login_attempts"
+	tableDeletedDevices = "deleted_devices"
+)
+
+var tables = []string{tableNotices, tableAttachments, tableAPIKeys, tableUsers, tableSessions, tableAttempts, tableDeletedDevices}
+
+// Store is an in-memory Store implementation, safe for concurrent use.
+// Devices and push logs are held as values; the remaining records are kept
+// JSON-encoded, as the other stores do, so callers never share memory with
+// the store.
+type Store struct {
+	mu      sync.RWMutex
+	devices map[string]model.Device
+	// logs is kept in ID order.
+	logs   []model.NoticeLog
+	logSeq uint64
+	// retried holds the IDs of logs that have been retried. Like Bolt's
+	// retry index it outlives the retry, so pruning a successful retry
+	// does not make its original look unretried again.
+	retried map[uint64]bool
+	// audit is kept in ID order.
+	audit    []auditRecord
+	auditSeq uint64
+	docs     map[string]map[string][]byte
+}
+
+// auditRecord is an encoded audit entry with its creation time, so time
+// ranges can be selected without decoding.
+type auditRecord struct {
+	at      time.Time
+	payload []byte
+}
+
+// New returns an empty store.
+func New() *Store {
+	docs := make(map[string]map[string][]byte, len(tables))
+	for _, table := range tables {
+		docs[table] = make(map[string][]byte)
+	}
+	return &Store{devices: make(map[string]model.Device), retried: make(map[uint64]bool), docs: docs}
+}
+
+// Close does nothing; the data stays readable until the Store is dropped.
+func (s *Store) Close() error {
+	return nil
+}
+
+// UpsertDevice stores or updates a device record.
+func (s *Store) UpsertDevice(ctx context.Context, device *model.Device) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if device.CreatedAt.IsZero() {
+		device.CreatedAt = now
+	}
+	device.UpdatedAt = now
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[device.DeviceToken] = *device
+	return nil
+}
+
+// GetDevice fetches device by token.
+func (s *Store) GetDevice(ctx context.Context, token string) (*model.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	device, ok := s.devices[token]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &device, nil
+}
+
+// GetDeviceByKey fetches device by Bark device key. If several devices share
+// the key, the most recently written one wins, as with the other stores.
+func (s *Store) GetDeviceByKey(ctx context.Context, key string) (*model.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, storage.ErrNotFound
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *model.Device
+	for _, device := range s.devices {
+		if device.DeviceKey == key && (found == nil || device.UpdatedAt.After(found.UpdatedAt)) {
+			copied := device
+			found = &copied
+		}
+	}
+	if found == nil {
+		return nil, storage.ErrNotFound
+	}
+	return found, nil
+}
+
+// ListDevices returns all devices ordered by token.
+func (s *Store) ListDevices(ctx context.Context) ([]*model.Device, error) {
+	return s.listDevices(ctx, func(*model.Device) bool { return true })
+}
+
+// ListActiveDevices returns ACTIVE devices only; an empty status counts as
+// ACTIVE.
+func (s *Store) ListActiveDevices(ctx context.Context) ([]*model.Device, error) {
+	return s.listDevices(ctx, func(device *model.Device) bool {
+		status := strings.TrimSpace(device.Status)
+		return status == "" || strings.EqualFold(status, model.DeviceStatusActive)
+	})
+}
+
+func (s *Store) listDevices(ctx context.Context, filter func(*model.Device) bool) ([]*model.Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var devices []*model.Device
+	for _, device := range s.devices {
+		if filter(&device) {
+			copied := device
+			devices = append(devices, &copied)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceToken < devices[j].DeviceToken })
+	return devices, nil
+}
+
+// DeleteDevice removes a device.
+func (s *Store) DeleteDevice(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[token]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.devices, token)
+	return nil
+}
+
+// SaveDeletedDevice stores a soft-deleted device keyed by its token,
+// replacing any earlier entry for the same token.
+func (s *Store) SaveDeletedDevice(ctx context.Context, deleted *model.DeletedDevice) error {
+	return s.putDoc(ctx, tableDeletedDevices, deleted.Device.DeviceToken, deleted)
+}
+
+// GetDeletedDevice fetches a soft-deleted device by token.
+func (s *Store) GetDeletedDevice(ctx context.Context, token string) (*model.DeletedDevice, error) {
+	deleted := &model.DeletedDevice{}
+	if err := s.getDoc(ctx, tableDeletedDevices, token, deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// ListDeletedDevices returns all soft-deleted devices.
+func (s *Store) ListDeletedDevices(ctx context.Context) ([]*model.DeletedDevice, error) {
+	var list []*model.DeletedDevice
+	err := s.listDocs(ctx, tableDeletedDevices, func(payload []byte) error {
+		var deleted model.DeletedDevice
+		if err := json.Unmarshal(payload, &deleted); err != nil {
+			return err
+		}
+		list = append(list, &deleted)
+		return nil
+	})
+	return list, err
+}
+
+// DeleteDeletedDevice drops a soft-deleted device.
+func (s *Store) DeleteDeletedDevice(ctx context.Context, token string) error {
+	return s.deleteDoc(ctx, tableDeletedDevices, token)
+}
+
+// AppendNoticeLog stores a push log entry under the next ID.
+func (s *Store) AppendNoticeLog(ctx context.Context, log *model.NoticeLog) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = now
+	}
+	log.UpdatedAt = now
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logSeq++
+	log.ID = s.logSeq
+	s.logs = append(s.logs, *log)
+	if log.RetryOf != 0 {
+		s.retried[log.RetryOf] = true
+	}
+	return nil
+}
+
+// ListNoticeLogs returns all notice logs in ID order.
+func (s *Store) ListNoticeLogs(ctx context.Context) ([]*model.NoticeLog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var logs []*model.NoticeLog
+	for _, log := range s.logs {
+		copied := log
+		logs = append(logs, &copied)
+	}
+	return logs, nil
+}
+
+// GetNoticeLog fetches a single push log entry by ID.
+func (s *Store) GetNoticeLog(ctx context.Context, id uint64) (*model.NoticeLog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.logIndex(id)
+	if i < 0 {
+		return nil, storage.ErrNotFound
+	}
+	log := s.logs[i]
+	return &log, nil
+}
+
+// logIndex returns the position of the log with id, or -1.
+func (s *Store) logIndex(id uint64) int {
+	i := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].ID >= id })
+	if i < len(s.logs) && s.logs[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// matchingLogs returns the logs accepted by filter, newest first. The
+// cursor is not applied.
+func (s *Store) matchingLogs(filter model.NoticeLogFilter) []model.NoticeLog {
+	var matched []model.NoticeLog
+	for _, log := range s.logs {
+		if !sameValue(filter.DeviceKey, log.DeviceKey) || !sameValue(filter.Group, log.Group) || !sameValue(filter.Status, log.Status) {
+			continue
+		}
+		if !inRange(log.CreatedAt, filter.BeginTime, filter.EndTime) || (filter.Unretried && s.retried[log.ID]) {
+			continue
+		}
+		matched = append(matched, log)
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return newer(&matched[i], &matched[j]) })
+	return matched
+}
+
+// sameValue reports whether a log field matches a filter value, ignoring
+// case and surrounding space; an empty filter matches everything.
+func sameValue(filter, value string) bool {
+	filter = strings.TrimSpace(filter)
+	return filter == "" || strings.EqualFold(strings.TrimSpace(value), filter)
+}
+
+func inRange(at time.Time, begin, end *time.Time) bool {
+	n := at.UnixNano()
+	return (begin == nil || n >= begin.UnixNano()) && (end == nil || n <= end.UnixNano())
+}
+
+func newer(a, b *model.NoticeLog) bool {
+	x, y := a.CreatedAt.UnixNano(), b.CreatedAt.UnixNano()
+	return x > y || (x == y && a.ID > b.ID)
+}
+
+// QueryNoticeLogs returns logs matching filter, newest first. A PageSize of
+// zero returns every match.
+func (s *Store) QueryNoticeLogs(ctx context.Context, filter model.NoticeLogFilter) (*model.NoticeLogPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	page := &model.NoticeLogPage{Data: []*model.NoticeLog{}, PageNum: filter.Page, PageSize: filter.PageSize}
+	s.mu.RLock()
+	matched := s.matchingLogs(filter)
+	s.mu.RUnlock()
+
+	if filter.Page > 0 {
+		page.Total = len(matched)
+		if filter.PageSize > 0 {
+			page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+			start := min((filter.Page-1)*filter.PageSize, len(matched))
+			end := min(start+filter.PageSize, len(matched))
+			if end < len(matched) && end > start {
+				page.NextCursor = storage.EncodeLogCursor(matched[end-1].CreatedAt, matched[end-1].ID)
+			}
+			matched = matched[start:end]
+		}
+	} else {
+		if filter.Cursor != "" {
+			at, id, err := storage.DecodeLogCursor(filter.Cursor)
+			if err != nil {
+				return nil, err
+			}
+			bound := model.NoticeLog{ID: id, CreatedAt: time.Unix(0, at)}
+			i := sort.Search(len(matched), func(i int) bool { return newer(&bound, &matched[i]) })
+			matched = matched[i:]
+		}
+		if filter.PageSize > 0 && len(matched) > filter.PageSize {
+			matched = matched[:filter.PageSize]
+			last := matched[len(matched)-1]
+			page.NextCursor = storage.EncodeLogCursor(last.CreatedAt, last.ID)
+		}
+	}
+	for i := range matched {
+		page.Data = append(page.Data, &matched[i])
+	}
+	return page, nil
+}
+
+// CountNoticeLogs counts the logs created within [begin, end] per day, month
+// or year (UTC), or per status, group or device key. Values differing only
+// in case are counted together under the spelling of the oldest log.
+func (s *Store) CountNoticeLogs(ctx context.Context, groupBy string, begin, end *time.Time) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var label func(*model.NoticeLog) string
+	switch groupBy {
+	case model.NoticeLogByDay:
+		label = func(log *model.NoticeLog) string { return log.CreatedAt.UTC().Format("2006-01-02") }
+	case model.NoticeLogByMonth:
+		label = func(log *model.NoticeLog) string { return log.CreatedAt.UTC().Format("2006-01") }
+	case model.NoticeLogByYear:
+		label = func(log *model.NoticeLog) string { return log.CreatedAt.UTC().Format("2006") }
+	case model.NoticeLogByStatus:
+		label = func(log *model.NoticeLog) string { return log.Status }
+	case model.NoticeLogByGroup:
+		label = func(log *model.NoticeLog) string { return log.Group }
+	case model.NoticeLogByDevice:
+		label = func(log *model.NoticeLog) string { return log.DeviceKey }
+	default:
+		return nil, fmt.Errorf("unknown log grouping %q", groupBy)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[string]int)
+	spelling := make(map[string]string)
+	for i := range s.logs {
+		log := &s.logs[i]
+		if !inRange(log.CreatedAt, begin, end) {
+			continue
+		}
+		value := strings.TrimSpace(label(log))
+		folded := strings.ToLower(value)
+		if _, ok := spelling[folded]; !ok {
+			spelling[folded] = value
+		}
+		counts[spelling[folded]]++
+	}
+	return counts, nil
+}
+
+// PruneNoticeLogs deletes the logs selected by rule and returns how many were
+// removed.
+func (s *Store) PruneNoticeLogs(ctx context.Context, rule model.NoticeLogPrune) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if rule.Before.IsZero() && rule.Keep <= 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remove := make(map[uint64]bool)
+	seen := 0
+	for _, log := range s.matchingLogs(model.NoticeLogFilter{Status: rule.Status}) {
+		if rule.Status == "" && slices.ContainsFunc(rule.ExceptStatuses, func(status string) bool { return sameValue(status, log.Status) }) {
+			continue
+		}
+		seen++
+		if (rule.Keep > 0 && seen > rule.Keep) || (!rule.Before.IsZero() && log.CreatedAt.Before(rule.Before)) {
+			remove[log.ID] = true
+		}
+	}
+	return s.removeLogs(func(log *model.NoticeLog) bool { return remove[log.ID] }), nil
+}
+
+// DeleteDeviceNoticeLogs deletes every push log sent to deviceKey, matched
+// case-insensitively, and returns how many were removed.
+func (s *Store) DeleteDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(deviceKey) == "" {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeLogs(func(log *model.NoticeLog) bool { return sameValue(deviceKey, log.DeviceKey) }), nil
+}
+
+// AnonymizeDeviceNoticeLogs replaces deviceKey with model.AnonymizedDeviceKey
+// in every push log sent to it and returns how many were changed.
+func (s *Store) AnonymizeDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(deviceKey) == "" {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := 0
+	for i := range s.logs {
+		if sameValue(deviceKey, s.logs[i].DeviceKey) {
+			s.logs[i].DeviceKey = model.AnonymizedDeviceKey
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// removeLogs drops the logs accepted by match, with their retry markers,
+// and returns how many there were. The caller holds the write lock.
+func (s *Store) removeLogs(match func(*model.NoticeLog) bool) int {
+	kept := s.logs[:0]
+	for i := range s.logs {
+		if !match(&s.logs[i]) {
+			kept = append(kept, s.logs[i])
+			continue
+		}
+		delete(s.retried, s.logs[i].ID)
+	}
+	removed := len(s.logs) - len(kept)
+	clear(s.logs[len(kept):])
+	s.logs = kept
+	return removed
+}
+
+// Document tables hold one JSON value per key.
+
+func (s *Store) putDoc(ctx context.Context, table, key string, v any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[table][key] = payload
+	return nil
+}
+
+func (s *Store) getDoc(ctx context.Context, table, key string, v any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	payload, ok := s.docs[table][key]
+	s.mu.RUnlock()
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// deleteDoc removes key, returning ErrNotFound if it did not exist.
+func (s *Store) deleteDoc(ctx context.Context, table, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[table][key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.docs[table], key)
+	return nil
+}
+
+// updateDoc decodes key into v, lets fn change it and stores the result, all
+// under the write lock. It returns ErrNotFound if key does not exist and
+// fn's error, writing nothing, if fn fails.
+func (s *Store) updateDoc(ctx context.Context, table, key string, v any, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, ok := s.docs[table][key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.docs[table][key] = payload
+	return nil
+}
+
+// listDocs decodes every value of table with decode, in key order.
+func (s *Store) listDocs(ctx context.Context, table string, decode func([]byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.docs[table]))
+	for key := range s.docs[table] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	payloads := make([][]byte, len(keys))
+	for i, key := range keys {
+		payloads[i] = s.docs[table][key]
+	}
+	s.mu.RUnlock()
+	for _, payload := range payloads {
+		if err := decode(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveNotice stores a broadcast record keyed by its message ID.
+func (s *Store) SaveNotice(ctx context.Context, notice *model.NoticeRecord) error {
+	now := time.Now().UTC()
+	if notice.CreatedAt.IsZero() {
+		notice.CreatedAt = now
+	}
+	notice.UpdatedAt = now
+	return s.putDoc(ctx, tableNotices, notice.ID, notice)
+}
+
+// GetNotice fetches a broadcast record by message ID.
+func (s *Store) GetNotice(ctx context.Context, id string) (*model.NoticeRecord, error) {
+	notice := &model.NoticeRecord{}
+	if err := s.getDoc(ctx, tableNotices, id, notice); err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+// SaveAttachment stores attachment metadata keyed by its ID.
+func (s *Store) SaveAttachment(ctx context.Context, attachment *model.Attachment) error {
+	if attachment.CreatedAt.IsZero() {
+		attachment.CreatedAt = time.Now().UTC()
+	}
+	return s.putDoc(ctx, tableAttachments, attachment.ID, attachment)
+}
+
+// GetAttachment fetches attachment metadata by ID.
+func (s *Store) GetAttachment(ctx context.Context, id string) (*model.Attachment, error) {
+	attachment := &model.Attachment{}
+	if err := s.getDoc(ctx, tableAttachments, id, attachment); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// ListExpiredAttachments returns attachments whose expiry is not after before.
+func (s *Store) ListExpiredAttachments(ctx context.Context, before time.Time) ([]*model.Attachment, error) {
+	var expired []*model.Attachment
+	err := s.listDocs(ctx, tableAttachments, func(payload []byte) error {
+		var attachment model.Attachment
+		if err := json.Unmarshal(payload, &attachment); err != nil {
+			return err
+		}
+		if attachment.Expired(before) {
+			expired = append(expired, &attachment)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// DeleteAttachment removes attachment metadata; missing IDs are ignored.
+func (s *Store) DeleteAttachment(ctx context.Context, id string) error {
+	if err := s.deleteDoc(ctx, tableAttachments, id); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// SaveAPIKey stores or updates an API key record.
+func (s *Store) SaveAPIKey(ctx context.Context, key *model.APIKey) error {
+	now := time.Now().UTC()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = now
+	}
+	key.UpdatedAt = now
+	return s.putDoc(ctx, tableAPIKeys, key.ID, key)
+}
+
+// GetAPIKey fetches an API key by ID.
+func (s *Store) GetAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	key := &model.APIKey{}
+	if err := s.getDoc(ctx, tableAPIKeys, id, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all API keys.
+func (s *Store) ListAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	var keys []*model.APIKey
+	err := s.listDocs(ctx, tableAPIKeys, func(payload []byte) error {
+		var key model.APIKey
+		if err := json.Unmarshal(payload, &key); err != nil {
+			return err
+		}
+		keys = append(keys, &key)
+		return nil
+	})
+	return keys, err
+}
+
+// DeleteAPIKey removes an API key.
+func (s *Store) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, tableAPIKeys, id)
+}
+
+// TouchAPIKey records that an existing API key was used at at.
+func (s *Store) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	var key model.APIKey
+	return s.updateDoc(ctx, tableAPIKeys, id, &key, func() error {
+		key.LastUsedAt = &at
+		return nil
+	})
+}
+
+// SaveUser stores or updates an admin user keyed by normalized username.
+func (s *Store) SaveUser(ctx context.Context, user *model.User) error {
+	now := time.Now().UTC()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	return s.putDoc(ctx, tableUsers, model.NormalizeUsername(user.Username), user)
+}
+
+// GetUser fetches an admin user by username.
+func (s *Store) GetUser(ctx context.Context, username string) (*model.User, error) {
+	user := &model.User{}
+	if err := s.getDoc(ctx, tableUsers, model.NormalizeUsername(username), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListUsers returns all admin users.
+func (s *Store) ListUsers(ctx context.Context) ([]*model.User, error) {
+	var users []*model.User
+	err := s.listDocs(ctx, tableUsers, func(payload []byte) error {
+		var user model.User
+		if err := json.Unmarshal(payload, &user); err != nil {
+			return err
+		}
+		users = append(users, &user)
+		return nil
+	})
+	return users, err
+}
+
+// DeleteUser removes an admin user.
+func (s *Store) DeleteUser(ctx context.Context, username string) error {
+	return s.deleteDoc(ctx, tableUsers, model.NormalizeUsername(username))
+}
+
+// SaveSession stores or updates a login session.
+func (s *Store) SaveSession(ctx context.Context, session *model.Session) error {
+	return s.putDoc(ctx, tableSessions, session.ID, session)
+}
+
+// GetSession fetches a login session by ID.
+func (s *Store) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	session := &model.Session{}
+	if err := s.getDoc(ctx, tableSessions, id, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ListSessions returns all login sessions, including expired ones.
+func (s *Store) ListSessions(ctx context.Context) ([]*model.Session, error) {
+	var sessions []*model.Session
+	err := s.listDocs(ctx, tableSessions, func(payload []byte) error {
+		var session model.Session
+		if err := json.Unmarshal(payload, &session); err != nil {
+			return err
+		}
+		sessions = append(sessions, &session)
+		return nil
+	})
+	return sessions, err
+}
+
+// RotateSession replaces a session, but only while its stored RefreshHash is
+// still previousHash. It returns ErrNotFound if the session was deleted and
+// ErrConflict if it was rotated in the meantime; it never creates one.
+func (s *Store) RotateSession(ctx context.Context, session *model.Session, previousHash string) error {
+	var current model.Session
+	return s.updateDoc(ctx, tableSessions, session.ID, &current, func() error {
+		if current.RefreshHash != previousHash {
+			return storage.ErrConflict
+		}
+		current = *session
+		return nil
+	})
+}
+
+// DeleteSession removes a login session.
+func (s *Store) DeleteSession(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, tableSessions, id)
+}
+
+// SaveLoginAttempt stores the failed-login counter for a username or IP.
+func (s *Store) SaveLoginAttempt(ctx context.Context, attempt *model.LoginAttempt) error {
+	return s.putDoc(ctx, tableAttempts, attempt.Key(), attempt)
+}
+
+// GetLoginAttempt fetches a failed-login counter by key.
+func (s *Store) GetLoginAttempt(ctx context.Context, key string) (*model.LoginAttempt, error) {
+	attempt := &model.LoginAttempt{}
+	if err := s.getDoc(ctx, tableAttempts, key, attempt); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// ListLoginAttempts returns all failed-login counters.
+func (s *Store) ListLoginAttempts(ctx context.Context) ([]*model.LoginAttempt, error) {
+	var attempts []*model.LoginAttempt
+	err := s.listDocs(ctx, tableAttempts, func(payload []byte) error {
+		var attempt model.LoginAttempt
+		if err := json.Unmarshal(payload, &attempt); err != nil {
+			return err
+		}
+		attempts = append(attempts, &attempt)
+		return nil
+	})
+	return attempts, err
+}
+
+// DeleteLoginAttempt removes a failed-login counter.
+func (s *Store) DeleteLoginAttempt(ctx context.Context, key string) error {
+	return s.deleteDoc(ctx, tableAttempts, key)
+}
+
+// AppendAuditEntry stores an audit entry under the next ID.
+func (s *Store) AppendAuditEntry(ctx context.Context, entry *model.AuditEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.ID = s.auditSeq + 1
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		entry.ID = 0
+		return err
+	}
+	s.auditSeq++
+	s.audit = append(s.audit, auditRecord{at: entry.CreatedAt, payload: payload})
+	return nil
+}
+
+// ListAuditEntries returns all audit entries in insertion order.
+func (s *Store) ListAuditEntries(ctx context.Context) ([]*model.AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	records := s.audit[:len(s.audit):len(s.audit)]
+	s.mu.RUnlock()
+	var entries []*model.AuditEntry
+	for _, record := range records {
+		var entry model.AuditEntry
+		if err := json.Unmarshal(record.payload, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// QueryAuditEntries returns a page of the entries matching filter, newest
+// first. Entries outside the time range are skipped without decoding. A
+// PageSize of zero returns every match.
+func (s *Store) QueryAuditEntries(ctx context.Context, filter model.AuditFilter) (*model.AuditPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	records := s.audit[:len(s.audit):len(s.audit)]
+	s.mu.RUnlock()
+	page := &model.AuditPage{Data: []*model.AuditEntry{}, PageNum: filter.Page, PageSize: filter.PageSize}
+	skip := 0
+	if filter.Page > 0 {
+		skip = (filter.Page - 1) * filter.PageSize
+	}
+	// Entries are kept in ID order; sort the range by time like the other
+	// stores' time indexes.
+	var selected []int
+	for i := len(records) - 1; i >= 0; i-- {
+		if inRange(records[i].at, filter.BeginTime, filter.EndTime) {
+			selected = append(selected, i)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return records[selected[i]].at.UnixNano() > records[selected[j]].at.UnixNano()
+	})
+	for _, i := range selected {
+		entry := &model.AuditEntry{}
+		if err := json.Unmarshal(records[i].payload, entry); err != nil {
+			return nil, err
+		}
+		if !filter.Matches(entry) {
+			continue
+		}
+		page.Total++
+		if page.Total > skip && (filter.PageSize <= 0 || len(page.Data) < filter.PageSize) {
+			page.Data = append(page.Data, entry)
+		}
+	}
+	if filter.PageSize > 0 {
+		page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+	}
+	return page, nil
+}
+
+// PruneAuditEntries deletes the entries created before before and returns
+// how many were removed.
+func (s *Store) PruneAuditEntries(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]auditRecord, 0, len(s.audit))
+	for _, record := range s.audit {
+		if !record.at.Before(before) {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(s.audit) - len(kept)
+	s.audit = kept
+	return removed, nil
+}
+
+// Stats reports the number of records of each kind. There is no file, so
+// all sizes are zero.
+func (s *Store) Stats(ctx context.Context) (*model.StoreStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := &model.StoreStats{Path: ":memory:", Buckets: []model.BucketStats{
+		{Name: "audit", Keys: len(s.audit)},
+		{Name: "devices", Keys: len(s.devices)},
+		{Name: "notice_logs", Keys: len(s.logs)},
+	}}
+	for _, table := range tables {
+		stats.Buckets = append(stats.Buckets, model.BucketStats{Name: table, Keys: len(s.docs[table])})
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool { return stats.Buckets[i].Name < stats.Buckets[j].Name })
+	return stats, nil
+}
+
+// Compact has nothing to reclaim and returns an empty result.
+func (s *Store) Compact(ctx context.Context) (*model.CompactResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &model.CompactResult{}, nil
+}
+
+// Backup is not supported: there is no database file to snapshot, and
+// restore has nothing to restore into.
+func (s *Store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	return 0, storage.ErrNotSupported
+}
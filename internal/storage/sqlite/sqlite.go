@@ -0,0 +1,1196 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+	_ "modernc.org/sqlite"
+)
+
+var _ storage.Store = (*Store)(nil)
+
+// Store is a SQLite-backed Store implementation. Devices and push logs are
+// kept in regular columns so they can be queried with any SQLite tool; the
+// remaining records are stored as JSON documents keyed by their ID.
+type Store struct {
+	path string
+	db   *sql.DB
+}
+
+// New opens (creating if needed) the SQLite database at path and applies
+// pending schema migrations.
+func New(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrate(context.Background(), db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{path: path, db: db}, nil
+}
+
+func open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serialises writers the same way Bolt does and avoids
+	// SQLITE_BUSY between our own goroutines.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// migration is one schema step, run as a script inside a transaction.
+type migration struct {
+	description string
+	script      string
+}
+
+// migrations are applied in order; schema_migrations records the number
+// applied so far. Append new steps, never edit released ones.
+var migrations = []migration{
+	{"create tables", `CREATE TABLE devices (
+		device_token TEXT PRIMARY KEY,
+		device_key   TEXT NOT NULL DEFAULT '',
+		name         TEXT NOT NULL DEFAULT '',
+		algorithm    TEXT NOT NULL DEFAULT '',
+		mode         TEXT NOT NULL DEFAULT '',
+		padding      TEXT NOT NULL DEFAULT '',
+		encode_key   TEXT NOT NULL DEFAULT '',
+		iv           TEXT NOT NULL DEFAULT '',
+		status       TEXT NOT NULL DEFAULT '',
+		created_at   INTEGER NOT NULL DEFAULT 0,
+		updated_at   INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX idx_devices_key ON devices (device_key);
+	CREATE INDEX idx_devices_status ON devices (status COLLATE NOCASE);
+
+	CREATE TABLE notice_logs (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		notice_id  TEXT NOT NULL DEFAULT '',
+		retry_of   INTEGER NOT NULL DEFAULT 0,
+		recall     INTEGER NOT NULL DEFAULT 0,
+		device_key TEXT NOT NULL DEFAULT '',
+		url        TEXT NOT NULL DEFAULT '',
+		title      TEXT NOT NULL DEFAULT '',
+		subtitle   TEXT NOT NULL DEFAULT '',
+		body       TEXT NOT NULL DEFAULT '',
+		group_name TEXT NOT NULL DEFAULT '',
+		link       TEXT NOT NULL DEFAULT '',
+		icon       TEXT NOT NULL DEFAULT '',
+		image      TEXT NOT NULL DEFAULT '',
+		result     TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_notice_logs_time ON notice_logs (created_at, id);
+	CREATE INDEX idx_notice_logs_device ON notice_logs (device_key COLLATE NOCASE, created_at, id);
+	CREATE INDEX idx_notice_logs_group ON notice_logs (group_name COLLATE NOCASE, created_at, id);
+	CREATE INDEX idx_notice_logs_status ON notice_logs (status COLLATE NOCASE, created_at, id);
+	CREATE INDEX idx_notice_logs_retry ON notice_logs (retry_of) WHERE retry_of != 0;
+
+	CREATE TABLE notices (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+	CREATE TABLE attachments (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+	CREATE TABLE api_keys (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+	CREATE TABLE users (username TEXT PRIMARY KEY, data TEXT NOT NULL);
+	CREATE TABLE sessions (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+	CREATE TABLE login_attempts (key TEXT PRIMARY KEY, data TEXT NOT NULL);
+
+	CREATE TABLE audit (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor      TEXT NOT NULL DEFAULT '',
+		action     TEXT NOT NULL DEFAULT '',
+		target     TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX idx_audit_time ON audit (created_at);`},
+	{"create deleted devices table", `CREATE TABLE deleted_devices (device_token TEXT PRIMARY KEY, data TEXT NOT NULL);`},
+	// log_retries outlives the retry it records, so pruning a retry does not
+	// make its original look unretried again.
+	{"track retries in log_retries", `CREATE TABLE log_retries (log_id INTEGER PRIMARY KEY, retry_id INTEGER NOT NULL);
+	INSERT OR REPLACE INTO log_retries (log_id, retry_id)
+		SELECT retry_of, id FROM notice_logs WHERE retry_of != 0 ORDER BY id;
+	CREATE TRIGGER notice_logs_retry_insert AFTER INSERT ON notice_logs WHEN NEW.retry_of != 0 BEGIN
+		INSERT OR REPLACE INTO log_retries (log_id, retry_id) VALUES (NEW.retry_of, NEW.id);
+	END;
+	CREATE TRIGGER notice_logs_retry_delete AFTER DELETE ON notice_logs BEGIN
+		DELETE FROM log_retries WHERE log_id = OLD.id;
+	END;`},
+}
+
+// SchemaVersion is the schema version this build migrates databases to.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// errDryRun rolls back a dry-run transaction.
+var errDryRun = errors.New("dry run")
+
+// migrate brings db up to SchemaVersion, one transaction per step. A dry run
+// applies every pending step in one transaction and rolls it back; that
+// includes creating schema_migrations, so the file is left untouched.
+func migrate(ctx context.Context, db *sql.DB, dryRun bool) (*model.MigrationReport, error) {
+	report := &model.MigrationReport{DryRun: dryRun, Steps: []model.MigrationStep{}}
+	run := func(tx *sql.Tx, version int) error {
+		step := migrations[version-1]
+		if _, err := tx.ExecContext(ctx, step.script); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", version, step.description, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix()); err != nil {
+			return err
+		}
+		report.Steps = append(report.Steps, model.MigrationStep{Version: version, Description: step.description, Changes: "applied schema script"})
+		report.To = version
+		return nil
+	}
+	if dryRun {
+		err := withTx(ctx, db, func(tx *sql.Tx) error {
+			if err := readSchemaVersion(ctx, tx, report); err != nil {
+				return err
+			}
+			for v := report.From + 1; v <= len(migrations); v++ {
+				if err := run(tx, v); err != nil {
+					return err
+				}
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return report, nil
+	}
+	if err := readSchemaVersion(ctx, db, report); err != nil {
+		return nil, err
+	}
+	for v := report.From + 1; v <= len(migrations); v++ {
+		if err := withTx(ctx, db, func(tx *sql.Tx) error { return run(tx, v) }); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// schemaDB is implemented by both *sql.DB and *sql.Tx.
+type schemaDB interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// readSchemaVersion creates schema_migrations if needed and sets report.From
+// and report.To to the version db is at.
+func readSchemaVersion(ctx context.Context, db schemaDB, report *model.MigrationReport) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&report.From); err != nil {
+		return err
+	}
+	report.To = report.From
+	if report.From > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", report.From, len(migrations))
+	}
+	return nil
+}
+
+// Migrate opens the database at path, applies pending migrations and
+// closes it again. With dryRun nothing is written, and a missing file is
+// reported as a new database without being created.
+func Migrate(path string, dryRun bool) (*model.MigrationReport, error) {
+	if _, err := os.Stat(path); dryRun && errors.Is(err, os.ErrNotExist) {
+		report := &model.MigrationReport{DryRun: true, To: len(migrations), Steps: []model.MigrationStep{}}
+		for i, step := range migrations {
+			report.Steps = append(report.Steps, model.MigrationStep{Version: i + 1, Description: step.description, Changes: "new database"})
+		}
+		return report, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate(context.Background(), db, dryRun)
+}
+
+func withTx(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nanos stores a time as Unix nanoseconds; the zero time is stored as 0.
+func nanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+const deviceColumns = `device_token, device_key, name, algorithm, mode, padding, encode_key, iv, status, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDevice(row scanner) (*model.Device, error) {
+	var d model.Device
+	var created, updated int64
+	if err := row.Scan(&d.DeviceToken, &d.DeviceKey, &d.Name, &d.Algorithm, &d.Mode, &d.Padding, &d.EncodeKey, &d.IV, &d.Status, &created, &updated); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	d.CreatedAt = fromNanos(created)
+	d.UpdatedAt = fromNanos(updated)
+	return &d, nil
+}
+
+func (s *Store) queryDevices(ctx context.Context, query string, args ...any) ([]*model.Device, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []*model.Device
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// UpsertDevice stores or updates a device record.
+func (s *Store) UpsertDevice(ctx context.Context, device *model.Device) error {
+	now := time.Now().UTC()
+	if device.CreatedAt.IsZero() {
+		device.CreatedAt = now
+	}
+	device.UpdatedAt = now
+	_, err := s.db.ExecContext(ctx, `INSERT INTO devices (`+deviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (device_token) DO UPDATE SET
+			device_key = excluded.device_key, name = excluded.name, algorithm = excluded.algorithm,
+			mode = excluded.mode, padding = excluded.padding, encode_key = excluded.encode_key,
+			iv = excluded.iv, status = excluded.status, created_at = excluded.created_at,
+			updated_at = excluded.updated_at`,
+		device.DeviceToken, device.DeviceKey, device.Name, device.Algorithm, device.Mode, device.Padding,
+		device.EncodeKey, device.IV, device.Status, nanos(device.CreatedAt), nanos(device.UpdatedAt))
+	return err
+}
+
+// GetDevice fetches device by token.
+func (s *Store) GetDevice(ctx context.Context, token string) (*model.Device, error) {
+	return scanDevice(s.db.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices WHERE device_token = ?`, token))
+}
+
+// GetDeviceByKey fetches device by Bark device key. If several devices share
+// the key, the most recently written one wins, as with the Bolt index.
+func (s *Store) GetDeviceByKey(ctx context.Context, key string) (*model.Device, error) {
+	return scanDevice(s.db.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices WHERE device_key = ? ORDER BY updated_at DESC LIMIT 1`, key))
+}
+
+// ListDevices returns all devices.
+func (s *Store) ListDevices(ctx context.Context) ([]*model.Device, error) {
+	return s.queryDevices(ctx, `SELECT `+deviceColumns+` FROM devices ORDER BY device_token`)
+}
+
+// ListActiveDevices returns ACTIVE devices only; an empty status counts as
+// ACTIVE.
+func (s *Store) ListActiveDevices(ctx context.Context) ([]*model.Device, error) {
+	return s.queryDevices(ctx, `SELECT `+deviceColumns+` FROM devices WHERE status COLLATE NOCASE IN ('', ?) ORDER BY device_token`, model.DeviceStatusActive)
+}
+
+// DeleteDevice removes a device.
+func (s *Store) DeleteDevice(ctx context.Context, token string) error {
+	return s.deleteDoc(ctx, "devices", "device_token", token)
+}
+
+// SaveDeletedDevice stores a soft-deleted device keyed by its token,
+// replacing any earlier entry for the same token.
+func (s *Store) SaveDeletedDevice(ctx context.Context, deleted *model.DeletedDevice) error {
+	return s.putDoc(ctx, "deleted_devices", deleted.Device.DeviceToken, deleted)
+}
+
+// GetDeletedDevice fetches a soft-deleted device by token.
+func (s *Store) GetDeletedDevice(ctx context.Context, token string) (*model.DeletedDevice, error) {
+	deleted := &model.DeletedDevice{}
+	if err := s.getDoc(ctx, "deleted_devices", "device_token", token, deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// ListDeletedDevices returns all soft-deleted devices.
+func (s *Store) ListDeletedDevices(ctx context.Context) ([]*model.DeletedDevice, error) {
+	var list []*model.DeletedDevice
+	err := s.listDocs(ctx, "deleted_devices", "device_token", func(payload []byte) error {
+		var deleted model.DeletedDevice
+		if err := json.Unmarshal(payload, &deleted); err != nil {
+			return err
+		}
+		list = append(list, &deleted)
+		return nil
+	})
+	return list, err
+}
+
+// DeleteDeletedDevice drops a soft-deleted device.
+func (s *Store) DeleteDeletedDevice(ctx context.Context, token string) error {
+	return s.deleteDoc(ctx, "deleted_devices", "device_token", token)
+}
+
+const logColumns = `id, notice_id, retry_of, recall, device_key, url, title, subtitle, body, group_name, link, icon, image, result, status, created_at, updated_at`
+
+func scanLog(row scanner) (*model.NoticeLog, error) {
+	var l model.NoticeLog
+	var created, updated int64
+	if err := row.Scan(&l.ID, &l.NoticeID, &l.RetryOf, &l.Recall, &l.DeviceKey, &l.URL, &l.Title, &l.Subtitle, &l.Body, &l.Group, &l.Link, &l.Icon, &l.Image, &l.Result, &l.Status, &created, &updated); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	l.CreatedAt = fromNanos(created)
+	l.UpdatedAt = fromNanos(updated)
+	return &l, nil
+}
+
+func (s *Store) queryLogs(ctx context.Context, query string, args ...any) ([]*model.NoticeLog, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []*model.NoticeLog{}
+	for rows.Next() {
+		log, err := scanLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, rows.Err()
+}
+
+// AppendNoticeLog stores a push log entry.
+func (s *Store) AppendNoticeLog(ctx context.Context, log *model.NoticeLog) error {
+	now := time.Now().UTC()
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = now
+	}
+	log.UpdatedAt = now
+	res, err := s.db.ExecContext(ctx, `INSERT INTO notice_logs (notice_id, retry_of, recall, device_key, url, title, subtitle, body, group_name, link, icon, image, result, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		log.NoticeID, log.RetryOf, log.Recall, log.DeviceKey, log.URL, log.Title, log.Subtitle, log.Body, log.Group,
+		log.Link, log.Icon, log.Image, log.Result, log.Status, nanos(log.CreatedAt), nanos(log.UpdatedAt))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	log.ID = uint64(id)
+	return nil
+}
+
+// ListNoticeLogs returns all notice logs.
+func (s *Store) ListNoticeLogs(ctx context.Context) ([]*model.NoticeLog, error) {
+	return s.queryLogs(ctx, `SELECT `+logColumns+` FROM notice_logs ORDER BY id`)
+}
+
+// GetNoticeLog fetches a single push log entry by ID.
+func (s *Store) GetNoticeLog(ctx context.Context, id uint64) (*model.NoticeLog, error) {
+	return scanLog(s.db.QueryRowContext(ctx, `SELECT `+logColumns+` FROM notice_logs WHERE id = ?`, id))
+}
+
+// logWhere renders the filter as a WHERE clause over notice_logs.
+func logWhere(filter model.NoticeLogFilter) (string, []any) {
+	var conds []string
+	var args []any
+	if v := strings.TrimSpace(filter.DeviceKey); v != "" {
+		conds = append(conds, `device_key = ? COLLATE NOCASE`)
+		args = append(args, v)
+	}
+	if v := strings.TrimSpace(filter.Group); v != "" {
+		conds = append(conds, `group_name = ? COLLATE NOCASE`)
+		args = append(args, v)
+	}
+	if v := strings.TrimSpace(filter.Status); v != "" {
+		conds = append(conds, `status = ? COLLATE NOCASE`)
+		args = append(args, v)
+	}
+	if filter.BeginTime != nil {
+		conds = append(conds, `created_at >= ?`)
+		args = append(args, filter.BeginTime.UnixNano())
+	}
+	if filter.EndTime != nil {
+		conds = append(conds, `created_at <= ?`)
+		args = append(args, filter.EndTime.UnixNano())
+	}
+	if filter.Unretried {
+		conds = append(conds, `NOT EXISTS (SELECT 1 FROM log_retries r WHERE r.log_id = notice_logs.id)`)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// QueryNoticeLogs returns logs matching filter, newest first. A PageSize of
+// zero returns every match.
+func (s *Store) QueryNoticeLogs(ctx context.Context, filter model.NoticeLogFilter) (*model.NoticeLogPage, error) {
+	page := &model.NoticeLogPage{PageNum: filter.Page, PageSize: filter.PageSize}
+	where, args := logWhere(filter)
+	order := ` ORDER BY created_at DESC, id DESC`
+	if filter.Page > 0 {
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notice_logs`+where, args...).Scan(&page.Total); err != nil {
+			return nil, err
+		}
+		query := `SELECT ` + logColumns + ` FROM notice_logs` + where + order
+		if filter.PageSize > 0 {
+			query += ` LIMIT ? OFFSET ?`
+			args = append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)
+			page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+		}
+		logs, err := s.queryLogs(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		page.Data = logs
+		if filter.PageSize > 0 && len(logs) > 0 && filter.Page*filter.PageSize < page.Total {
+			last := logs[len(logs)-1]
+			page.NextCursor = storage.EncodeLogCursor(last.CreatedAt, last.ID)
+		}
+		return page, nil
+	}
+
+	if filter.Cursor != "" {
+		at, id, err := storage.DecodeLogCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cond := `(created_at < ? OR (created_at = ? AND id < ?))`
+		if where == "" {
+			where = " WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+		args = append(args, at, at, id)
+	}
+	query := `SELECT ` + logColumns + ` FROM notice_logs` + where + order
+	if filter.PageSize > 0 {
+		// One extra row tells whether another page follows.
+		query += ` LIMIT ?`
+		args = append(args, filter.PageSize+1)
+	}
+	logs, err := s.queryLogs(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if filter.PageSize > 0 && len(logs) > filter.PageSize {
+		logs = logs[:filter.PageSize]
+		last := logs[len(logs)-1]
+		page.NextCursor = storage.EncodeLogCursor(last.CreatedAt, last.ID)
+	}
+	page.Data = logs
+	return page, nil
+}
+
+// CountNoticeLogs counts the logs created within [begin, end] per day, month
+// or year (UTC), or per status, group or device key.
+func (s *Store) CountNoticeLogs(ctx context.Context, groupBy string, begin, end *time.Time) (map[string]int, error) {
+	var key, group string
+	switch groupBy {
+	case model.NoticeLogByDay:
+		key = `strftime('%Y-%m-%d', created_at / 1000000000, 'unixepoch')`
+	case model.NoticeLogByMonth:
+		key = `strftime('%Y-%m', created_at / 1000000000, 'unixepoch')`
+	case model.NoticeLogByYear:
+		key = `strftime('%Y', created_at / 1000000000, 'unixepoch')`
+	case model.NoticeLogByStatus:
+		key, group = `MIN(status)`, `status COLLATE NOCASE`
+	case model.NoticeLogByGroup:
+		key, group = `MIN(group_name)`, `group_name COLLATE NOCASE`
+	case model.NoticeLogByDevice:
+		key, group = `MIN(device_key)`, `device_key COLLATE NOCASE`
+	default:
+		return nil, fmt.Errorf("unknown log grouping %q", groupBy)
+	}
+	if group == "" {
+		group = "1"
+	}
+	where, args := logWhere(model.NoticeLogFilter{BeginTime: begin, EndTime: end})
+	rows, err := s.db.QueryContext(ctx, `SELECT `+key+`, COUNT(*) FROM notice_logs`+where+` GROUP BY `+group, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var label string
+		var n int
+		if err := rows.Scan(&label, &n); err != nil {
+			return nil, err
+		}
+		counts[label] += n
+	}
+	return counts, rows.Err()
+}
+
+// PruneNoticeLogs deletes the logs selected by rule and returns how many were
+// removed.
+func (s *Store) PruneNoticeLogs(ctx context.Context, rule model.NoticeLogPrune) (int, error) {
+	if rule.Before.IsZero() && rule.Keep <= 0 {
+		return 0, nil
+	}
+	scope, args := pruneWhere(rule)
+	var selectors []string
+	if !rule.Before.IsZero() {
+		selectors = append(selectors, `created_at < ?`)
+		args = append(args, rule.Before.UnixNano())
+	}
+	if rule.Keep > 0 {
+		inner, innerArgs := pruneWhere(rule)
+		selectors = append(selectors, `id IN (SELECT id FROM notice_logs`+inner+` ORDER BY created_at DESC, id DESC LIMIT -1 OFFSET ?)`)
+		args = append(append(args, innerArgs...), rule.Keep)
+	}
+	cond := "(" + strings.Join(selectors, " OR ") + ")"
+	if scope == "" {
+		scope = " WHERE " + cond
+	} else {
+		scope += " AND " + cond
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM notice_logs`+scope, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// pruneWhere selects the logs rule applies to.
+func pruneWhere(rule model.NoticeLogPrune) (string, []any) {
+	where, args := logWhere(model.NoticeLogFilter{Status: rule.Status})
+	if rule.Status != "" || len(rule.ExceptStatuses) == 0 {
+		return where, args
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(rule.ExceptStatuses)), ", ")
+	for _, status := range rule.ExceptStatuses {
+		args = append(args, strings.TrimSpace(status))
+	}
+	return " WHERE status COLLATE NOCASE NOT IN (" + marks + ")", args
+}
+
+// DeleteDeviceNoticeLogs deletes every push log sent to deviceKey, matched
+// case-insensitively, and returns how many were removed.
+func (s *Store) DeleteDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	if strings.TrimSpace(deviceKey) == "" {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM notice_logs WHERE device_key = ? COLLATE NOCASE`, deviceKey)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// AnonymizeDeviceNoticeLogs replaces deviceKey with model.AnonymizedDeviceKey
+// in every push log sent to it and returns how many were changed.
+func (s *Store) AnonymizeDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error) {
+	if strings.TrimSpace(deviceKey) == "" {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE notice_logs SET device_key = ? WHERE device_key = ? COLLATE NOCASE`, model.AnonymizedDeviceKey, deviceKey)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Document tables hold one JSON value per key.
+
+func (s *Store) putDoc(ctx context.Context, table, key string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO `+table+` VALUES (?, ?) ON CONFLICT DO UPDATE SET data = excluded.data`, key, string(payload))
+	return err
+}
+
+func (s *Store) getDoc(ctx context.Context, table, column, key string, v any) error {
+	var payload string
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM `+table+` WHERE `+column+` = ?`, key).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(payload), v)
+}
+
+// deleteDoc removes key, returning ErrNotFound if it did not exist.
+func (s *Store) deleteDoc(ctx context.Context, table, column, key string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE `+column+` = ?`, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// updateDoc decodes key into v, lets fn change it and stores the result in
+// one transaction. It returns ErrNotFound if key does not exist and fn's
+// error, writing nothing, if fn fails.
+func (s *Store) updateDoc(ctx context.Context, table, column, key string, v any, fn func() error) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var payload string
+		err := tx.QueryRowContext(ctx, `SELECT data FROM `+table+` WHERE `+column+` = ?`, key).Scan(&payload)
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(payload), v); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		updated, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET data = ? WHERE `+column+` = ?`, string(updated), key)
+		return err
+	})
+}
+
+// listDocs decodes every row of table with decode, in key order.
+func (s *Store) listDocs(ctx context.Context, table, column string, decode func([]byte) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM `+table+` ORDER BY `+column)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return err
+		}
+		if err := decode([]byte(payload)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SaveNotice stores a broadcast record keyed by its message ID.
+func (s *Store) SaveNotice(ctx context.Context, notice *model.NoticeRecord) error {
+	now := time.Now().UTC()
+	if notice.CreatedAt.IsZero() {
+		notice.CreatedAt = now
+	}
+	notice.UpdatedAt = now
+	return s.putDoc(ctx, "notices", notice.ID, notice)
+}
+
+// GetNotice fetches a broadcast record by message ID.
+func (s *Store) GetNotice(ctx context.Context, id string) (*model.NoticeRecord, error) {
+	notice := &model.NoticeRecord{}
+	if err := s.getDoc(ctx, "notices", "id", id, notice); err != nil {
+		return nil, err
+	}
+	return notice, nil
+}
+
+// SaveAttachment stores attachment metadata keyed by its ID.
+func (s *Store) SaveAttachment(ctx context.Context, attachment *model.Attachment) error {
+	if attachment.CreatedAt.IsZero() {
+		attachment.CreatedAt = time.Now().UTC()
+	}
+	return s.putDoc(ctx, "attachments", attachment.ID, attachment)
+}
+
+// GetAttachment fetches attachment metadata by ID.
+func (s *Store) GetAttachment(ctx context.Context, id string) (*model.Attachment, error) {
+	attachment := &model.Attachment{}
+	if err := s.getDoc(ctx, "attachments", "id", id, attachment); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// ListExpiredAttachments returns attachments whose expiry is not after before.
+func (s *Store) ListExpiredAttachments(ctx context.Context, before time.Time) ([]*model.Attachment, error) {
+	var expired []*model.Attachment
+	err := s.listDocs(ctx, "attachments", "id", func(payload []byte) error {
+		var attachment model.Attachment
+		if err := json.Unmarshal(payload, &attachment); err != nil {
+			return err
+		}
+		if attachment.Expired(before) {
+			expired = append(expired, &attachment)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// DeleteAttachment removes attachment metadata; missing IDs are ignored.
+func (s *Store) DeleteAttachment(ctx context.Context, id string) error {
+	if err := s.deleteDoc(ctx, "attachments", "id", id); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// SaveAPIKey stores or updates an API key record.
+func (s *Store) SaveAPIKey(ctx context.Context, key *model.APIKey) error {
+	now := time.Now().UTC()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = now
+	}
+	key.UpdatedAt = now
+	return s.putDoc(ctx, "api_keys", key.ID, key)
+}
+
+// GetAPIKey fetches an API key by ID.
+func (s *Store) GetAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	key := &model.APIKey{}
+	if err := s.getDoc(ctx, "api_keys", "id", id, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all API keys.
+func (s *Store) ListAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	var keys []*model.APIKey
+	err := s.listDocs(ctx, "api_keys", "id", func(payload []byte) error {
+		var key model.APIKey
+		if err := json.Unmarshal(payload, &key); err != nil {
+			return err
+		}
+		keys = append(keys, &key)
+		return nil
+	})
+	return keys, err
+}
+
+// DeleteAPIKey removes an API key.
+func (s *Store) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "api_keys", "id", id)
+}
+
+// TouchAPIKey records that an existing API key was used at at.
+func (s *Store) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	var key model.APIKey
+	return s.updateDoc(ctx, "api_keys", "id", id, &key, func() error {
+		key.LastUsedAt = &at
+		return nil
+	})
+}
+
+// SaveUser stores or updates an admin user keyed by normalized username.
+func (s *Store) SaveUser(ctx context.Context, user *model.User) error {
+	now := time.Now().UTC()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	return s.putDoc(ctx, "users", model.NormalizeUsername(user.Username), user)
+}
+
+// GetUser fetches an admin user by username.
+func (s *Store) GetUser(ctx context.Context, username string) (*model.User, error) {
+	user := &model.User{}
+	if err := s.getDoc(ctx, "users", "username", model.NormalizeUsername(username), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListUsers returns all admin users.
+func (s *Store) ListUsers(ctx context.Context) ([]*model.User, error) {
+	var users []*model.User
+	err := s.listDocs(ctx, "users", "username", func(payload []byte) error {
+		var user model.User
+		if err := json.Unmarshal(payload, &user); err != nil {
+			return err
+		}
+		users = append(users, &user)
+		return nil
+	})
+	return users, err
+}
+
+// DeleteUser removes an admin user.
+func (s *Store) DeleteUser(ctx context.Context, username string) error {
+	return s.deleteDoc(ctx, "users", "username", model.NormalizeUsername(username))
+}
+
+// SaveSession stores or updates a login session.
+func (s *Store) SaveSession(ctx context.Context, session *model.Session) error {
+	return s.putDoc(ctx, "sessions", session.ID, session)
+}
+
+// GetSession fetches a login session by ID.
+func (s *Store) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	session := &model.Session{}
+	if err := s.getDoc(ctx, "sessions", "id", id, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ListSessions returns all login sessions, including expired ones.
+func (s *Store) ListSessions(ctx context.Context) ([]*model.Session, error) {
+	var sessions []*model.Session
+	err := s.listDocs(ctx, "sessions", "id", func(payload []byte) error {
+		var session model.Session
+		if err := json.Unmarshal(payload, &session); err != nil {
+			return err
+		}
+		sessions = append(sessions, &session)
+		return nil
+	})
+	return sessions, err
+}
+
+// RotateSession replaces a session, but only while its stored RefreshHash is
+// still previousHash. It returns ErrNotFound if the session was deleted and
+// ErrConflict if it was rotated in the meantime; it never creates one.
+func (s *Store) RotateSession(ctx context.Context, session *model.Session, previousHash string) error {
+	var current model.Session
+	return s.updateDoc(ctx, "sessions", "id", session.ID, &current, func() error {
+		if current.RefreshHash != previousHash {
+			return storage.ErrConflict
+		}
+		current = *session
+		return nil
+	})
+}
+
+// DeleteSession removes a login session.
+func (s *Store) DeleteSession(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "sessions", "id", id)
+}
+
+// SaveLoginAttempt stores the failed-login counter for a username or IP.
+func (s *Store) SaveLoginAttempt(ctx context.Context, attempt *model.LoginAttempt) error {
+	return s.putDoc(ctx, "login_attempts", attempt.Key(), attempt)
+}
+
+// GetLoginAttempt fetches a failed-login counter by key.
+func (s *Store) GetLoginAttempt(ctx context.Context, key string) (*model.LoginAttempt, error) {
+	attempt := &model.LoginAttempt{}
+	if err := s.getDoc(ctx, "login_attempts", "key", key, attempt); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// ListLoginAttempts returns all failed-login counters.
+func (s *Store) ListLoginAttempts(ctx context.Context) ([]*model.LoginAttempt, error) {
+	var attempts []*model.LoginAttempt
+	err := s.listDocs(ctx, "login_attempts", "key", func(payload []byte) error {
+		var attempt model.LoginAttempt
+		if err := json.Unmarshal(payload, &attempt); err != nil {
+			return err
+		}
+		attempts = append(attempts, &attempt)
+		return nil
+	})
+	return attempts, err
+}
+
+// DeleteLoginAttempt removes a failed-login counter.
+func (s *Store) DeleteLoginAttempt(ctx context.Context, key string) error {
+	return s.deleteDoc(ctx, "login_attempts", "key", key)
+}
+
+// AppendAuditEntry stores an audit entry under the next ID.
+func (s *Store) AppendAuditEntry(ctx context.Context, entry *model.AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO audit (actor, action, target, created_at, data) VALUES (?, ?, ?, ?, '')`,
+			entry.Actor, entry.Action, entry.Target, nanos(entry.CreatedAt))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		entry.ID = uint64(id)
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE audit SET data = ? WHERE id = ?`, string(payload), id)
+		return err
+	})
+}
+
+// ListAuditEntries returns all audit entries in insertion order.
+func (s *Store) ListAuditEntries(ctx context.Context) ([]*model.AuditEntry, error) {
+	var entries []*model.AuditEntry
+	err := s.listDocs(ctx, "audit", "id", func(payload []byte) error {
+		var entry model.AuditEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, &entry)
+		return nil
+	})
+	return entries, err
+}
+
+// QueryAuditEntries returns a page of the entries matching filter, newest
+// first. A PageSize of zero returns every match.
+func (s *Store) QueryAuditEntries(ctx context.Context, filter model.AuditFilter) (*model.AuditPage, error) {
+	page := &model.AuditPage{Data: []*model.AuditEntry{}, PageNum: filter.Page, PageSize: filter.PageSize}
+	var conds []string
+	var args []any
+	if filter.Actor != "" {
+		conds = append(conds, `actor = ? COLLATE NOCASE`)
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conds = append(conds, `substr(action, 1, length(?)) = ?`)
+		args = append(args, filter.Action, filter.Action)
+	}
+	if filter.Target != "" {
+		conds = append(conds, `instr(target, ?) > 0`)
+		args = append(args, filter.Target)
+	}
+	if filter.BeginTime != nil {
+		conds = append(conds, `created_at >= ?`)
+		args = append(args, filter.BeginTime.UnixNano())
+	}
+	if filter.EndTime != nil {
+		conds = append(conds, `created_at <= ?`)
+		args = append(args, filter.EndTime.UnixNano())
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit`+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+	query := `SELECT data FROM audit` + where + ` ORDER BY created_at DESC, id DESC`
+	if filter.PageSize > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.PageSize, max(filter.Page-1, 0)*filter.PageSize)
+		page.Pages = (page.Total + filter.PageSize - 1) / filter.PageSize
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		entry := &model.AuditEntry{}
+		if err := json.Unmarshal([]byte(payload), entry); err != nil {
+			return nil, err
+		}
+		page.Data = append(page.Data, entry)
+	}
+	return page, rows.Err()
+}
+
+// PruneAuditEntries deletes the entries created before before and returns
+// how many were removed.
+func (s *Store) PruneAuditEntries(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM audit WHERE created_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Stats reports the file size and the row count and size of every table.
+// Sizes come from the dbstat virtual table and are left at zero if the
+// driver was built without it.
+func (s *Store) Stats(ctx context.Context) (*model.StoreStats, error) {
+	stats := &model.StoreStats{Path: s.path, Buckets: []model.BucketStats{}}
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sizes := make(map[string][2]int64)
+	if rows, err := s.db.QueryContext(ctx, `SELECT name, SUM(pgsize - unused), SUM(pgsize) FROM dbstat GROUP BY name`); err == nil {
+		for rows.Next() {
+			var name string
+			var used, allocated int64
+			if rows.Scan(&name, &used, &allocated) == nil {
+				sizes[name] = [2]int64{used, allocated}
+			}
+		}
+		rows.Close()
+	}
+	for _, table := range tables {
+		var n int
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM "`+table+`"`).Scan(&n); err != nil {
+			return nil, err
+		}
+		size := sizes[table]
+		stats.Buckets = append(stats.Buckets, model.BucketStats{Name: table, Keys: n, Bytes: size[0], Allocated: size[1]})
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		stats.FileSize = info.Size()
+	}
+	return stats, nil
+}
+
+// Compact rebuilds the database file with VACUUM, returning free pages to
+// the file system. Other calls wait until it finishes.
+func (s *Store) Compact(ctx context.Context) (*model.CompactResult, error) {
+	start := time.Now()
+	result := &model.CompactResult{}
+	if info, err := os.Stat(s.path); err == nil {
+		result.BeforeSize = info.Size()
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		result.AfterSize = info.Size()
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// Backup writes a consistent snapshot of the database to w. The snapshot is
+// made with VACUUM INTO a temporary file next to the database, which is
+// removed afterwards.
+func (s *Store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".backup-*")
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	// VACUUM INTO refuses to overwrite an existing file.
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+	if _, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, tmpPath); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// Verify checks that the file at path is an intact SQLite database written
+// by this store: it passes the integrity check, its schema version is one
+// this build knows, and every device row can be read.
+func Verify(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	var check string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&check); err != nil {
+		return err
+	}
+	if check != "ok" {
+		return fmt.Errorf("corrupt database: %s", check)
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version < 1 || version > len(migrations) {
+		return fmt.Errorf("unsupported schema version %d (this build supports 1-%d)", version, len(migrations))
+	}
+	rows, err := db.QueryContext(ctx, `SELECT `+deviceColumns+` FROM devices`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if _, err := scanDevice(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
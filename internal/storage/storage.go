@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/bark-labs/bark-secure-proxy/internal/model"
 )
@@ -13,7 +15,49 @@ type Store interface {
 	GetDeviceByKey(ctx context.Context, key string) (*model.Device, error)
 	ListDevices(ctx context.Context) ([]*model.Device, error)
 	ListActiveDevices(ctx context.Context) ([]*model.Device, error)
+	DeleteDevice(ctx context.Context, token string) error
+	SaveDeletedDevice(ctx context.Context, deleted *model.DeletedDevice) error
+	GetDeletedDevice(ctx context.Context, token string) (*model.DeletedDevice, error)
+	ListDeletedDevices(ctx context.Context) ([]*model.DeletedDevice, error)
+	DeleteDeletedDevice(ctx context.Context, token string) error
 	AppendNoticeLog(ctx context.Context, log *model.NoticeLog) error
 	ListNoticeLogs(ctx context.Context) ([]*model.NoticeLog, error)
+	QueryNoticeLogs(ctx context.Context, filter model.NoticeLogFilter) (*model.NoticeLogPage, error)
+	CountNoticeLogs(ctx context.Context, groupBy string, begin, end *time.Time) (map[string]int, error)
+	GetNoticeLog(ctx context.Context, id uint64) (*model.NoticeLog, error)
+	PruneNoticeLogs(ctx context.Context, rule model.NoticeLogPrune) (int, error)
+	DeleteDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error)
+	AnonymizeDeviceNoticeLogs(ctx context.Context, deviceKey string) (int, error)
+	SaveNotice(ctx context.Context, notice *model.NoticeRecord) error
+	GetNotice(ctx context.Context, id string) (*model.NoticeRecord, error)
+	SaveAttachment(ctx context.Context, attachment *model.Attachment) error
+	GetAttachment(ctx context.Context, id string) (*model.Attachment, error)
+	ListExpiredAttachments(ctx context.Context, before time.Time) ([]*model.Attachment, error)
+	DeleteAttachment(ctx context.Context, id string) error
+	SaveAPIKey(ctx context.Context, key *model.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*model.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]*model.APIKey, error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+	SaveUser(ctx context.Context, user *model.User) error
+	GetUser(ctx context.Context, username string) (*model.User, error)
+	ListUsers(ctx context.Context) ([]*model.User, error)
+	DeleteUser(ctx context.Context, username string) error
+	SaveSession(ctx context.Context, session *model.Session) error
+	GetSession(ctx context.Context, id string) (*model.Session, error)
+	ListSessions(ctx context.Context) ([]*model.Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	RotateSession(ctx context.Context, session *model.Session, previousHash string) error
+	SaveLoginAttempt(ctx context.Context, attempt *model.LoginAttempt) error
+	GetLoginAttempt(ctx context.Context, key string) (*model.LoginAttempt, error)
+	ListLoginAttempts(ctx context.Context) ([]*model.LoginAttempt, error)
+	DeleteLoginAttempt(ctx context.Context, key string) error
+	AppendAuditEntry(ctx context.Context, entry *model.AuditEntry) error
+	ListAuditEntries(ctx context.Context) ([]*model.AuditEntry, error)
+	QueryAuditEntries(ctx context.Context, filter model.AuditFilter) (*model.AuditPage, error)
+	PruneAuditEntries(ctx context.Context, before time.Time) (int, error)
+	Stats(ctx context.Context) (*model.StoreStats, error)
+	Compact(ctx context.Context) (*model.CompactResult, error)
+	Backup(ctx context.Context, w io.Writer) (int64, error)
 	Close() error
 }
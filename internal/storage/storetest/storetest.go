@@ -0,0 +1,885 @@
+// Package storetest is a conformance suite for storage.Store
+// implementations. Each backend runs it from its own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) storage.Store {
+//			store, err := bolt.New(filepath.Join(t.TempDir(), "test.db"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { store.Close() })
+//			return store
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bark-labs/bark-secure-proxy/internal/model"
+	"github.com/bark-labs/bark-secure-proxy/internal/storage"
+)
+
+// Run checks the behaviour every Store must share. open is called once per
+// subtest and must return a new, empty store.
+func Run(t *testing.T, open func(t *testing.T) storage.Store) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Store)
+	}{
+		{"Devices", testDevices},
+		{"ActiveDevices", testActiveDevices},
+		{"DeletedDevices", testDeletedDevices},
+		{"NoticeLogs", testNoticeLogs},
+		{"NoticeLogPages", testNoticeLogPages},
+		{"NoticeLogCursor", testNoticeLogCursor},
+		{"CountNoticeLogs", testCountNoticeLogs},
+		{"PruneNoticeLogs", testPruneNoticeLogs},
+		{"PruneExceptStatuses", testPruneExceptStatuses},
+		{"PruneKeepsRetries", testPruneKeepsRetries},
+		{"DeviceNoticeLogs", testDeviceNoticeLogs},
+		{"AnonymizeKeepsRetries", testAnonymizeKeepsRetries},
+		{"Records", testRecords},
+		{"Audit", testAudit},
+		{"AuditQuery", testAuditQuery},
+		{"Concurrency", testConcurrency},
+		{"CancelledContext", testCancelledContext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+// base is the creation time of the first log written by the suite. It is
+// whole seconds so that every backend stores it exactly.
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func testDevices(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	if _, err := s.GetDevice(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDevice(missing) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetDeviceByKey(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDeviceByKey(missing) = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteDevice(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("DeleteDevice(missing) = %v, want ErrNotFound", err)
+	}
+
+	device := &model.Device{DeviceToken: "tok-b", DeviceKey: "key-b", Name: "phone", EncodeKey: "0123456789abcdef", Status: model.DeviceStatusActive}
+	if err := s.UpsertDevice(ctx, device); err != nil {
+		t.Fatalf("UpsertDevice: %v", err)
+	}
+	if device.CreatedAt.IsZero() || device.UpdatedAt.IsZero() {
+		t.Fatalf("UpsertDevice did not set timestamps: %+v", device)
+	}
+	created := device.CreatedAt
+	got, err := s.GetDevice(ctx, "tok-b")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if got.DeviceKey != "key-b" || got.Name != "phone" || got.EncodeKey != "0123456789abcdef" {
+		t.Fatalf("GetDevice = %+v", got)
+	}
+	got.Name = "changed"
+	if again, _ := s.GetDevice(ctx, "tok-b"); again.Name != "phone" {
+		t.Fatalf("changing a returned device changed the store")
+	}
+	if got, err := s.GetDeviceByKey(ctx, "key-b"); err != nil || got.DeviceToken != "tok-b" {
+		t.Fatalf("GetDeviceByKey = %+v, %v", got, err)
+	}
+
+	device.Name = "tablet"
+	if err := s.UpsertDevice(ctx, device); err != nil {
+		t.Fatalf("UpsertDevice (update): %v", err)
+	}
+	if !device.CreatedAt.Equal(created) {
+		t.Fatalf("update changed CreatedAt from %v to %v", created, device.CreatedAt)
+	}
+	if got, _ := s.GetDevice(ctx, "tok-b"); got.Name != "tablet" {
+		t.Fatalf("update not stored: %+v", got)
+	}
+
+	if err := s.UpsertDevice(ctx, &model.Device{DeviceToken: "tok-a", DeviceKey: "key-a"}); err != nil {
+		t.Fatalf("UpsertDevice: %v", err)
+	}
+	list, err := s.ListDevices(ctx)
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if tokens := deviceTokens(list); fmt.Sprint(tokens) != "[tok-a tok-b]" {
+		t.Fatalf("ListDevices = %v, want [tok-a tok-b] in token order", tokens)
+	}
+
+	if err := s.DeleteDevice(ctx, "tok-b"); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if _, err := s.GetDevice(ctx, "tok-b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDevice after delete = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetDeviceByKey(ctx, "key-b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDeviceByKey after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func testActiveDevices(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	for token, status := range map[string]string{
+		"empty":   "",
+		"active":  model.DeviceStatusActive,
+		"lower":   "active",
+		"stopped": model.DeviceStatusStop,
+		"pending": model.DeviceStatusPending,
+	} {
+		if err := s.UpsertDevice(ctx, &model.Device{DeviceToken: token, Status: status}); err != nil {
+			t.Fatalf("UpsertDevice(%s): %v", token, err)
+		}
+	}
+	list, err := s.ListActiveDevices(ctx)
+	if err != nil {
+		t.Fatalf("ListActiveDevices: %v", err)
+	}
+	tokens := deviceTokens(list)
+	sort.Strings(tokens)
+	if fmt.Sprint(tokens) != "[active empty lower]" {
+		t.Fatalf("ListActiveDevices = %v, want [active empty lower]", tokens)
+	}
+
+	// Stopping a device takes it out of the active list.
+	if err := s.UpsertDevice(ctx, &model.Device{DeviceToken: "active", Status: model.DeviceStatusStop}); err != nil {
+		t.Fatalf("UpsertDevice: %v", err)
+	}
+	list, err = s.ListActiveDevices(ctx)
+	if err != nil {
+		t.Fatalf("ListActiveDevices: %v", err)
+	}
+	tokens = deviceTokens(list)
+	sort.Strings(tokens)
+	if fmt.Sprint(tokens) != "[empty lower]" {
+		t.Fatalf("ListActiveDevices after stop = %v, want [empty lower]", tokens)
+	}
+}
+
+func testDeletedDevices(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	if _, err := s.GetDeletedDevice(ctx, "tok"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDeletedDevice(missing) = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteDeletedDevice(ctx, "tok"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("DeleteDeletedDevice(missing) = %v, want ErrNotFound", err)
+	}
+	deleted := &model.DeletedDevice{
+		Device:    &model.Device{DeviceToken: "tok", DeviceKey: "key", Status: model.DeviceStatusStop},
+		LogPolicy: model.DeviceLogsAnonymize,
+		DeletedBy: "admin",
+		DeletedAt: base,
+		PurgeAt:   base.Add(time.Hour),
+	}
+	if err := s.SaveDeletedDevice(ctx, deleted); err != nil {
+		t.Fatalf("SaveDeletedDevice: %v", err)
+	}
+	got, err := s.GetDeletedDevice(ctx, "tok")
+	if err != nil {
+		t.Fatalf("GetDeletedDevice: %v", err)
+	}
+	if got.Device == nil || got.Device.DeviceKey != "key" || got.Device.Status != model.DeviceStatusStop ||
+		got.LogPolicy != model.DeviceLogsAnonymize || got.DeletedBy != "admin" || !got.PurgeAt.Equal(deleted.PurgeAt) {
+		t.Fatalf("GetDeletedDevice = %+v", got)
+	}
+	list, err := s.ListDeletedDevices(ctx)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("ListDeletedDevices = %d entries, %v; want 1", len(list), err)
+	}
+	if err := s.DeleteDeletedDevice(ctx, "tok"); err != nil {
+		t.Fatalf("DeleteDeletedDevice: %v", err)
+	}
+	if _, err := s.GetDeletedDevice(ctx, "tok"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetDeletedDevice after delete = %v, want ErrNotFound", err)
+	}
+}
+
+// appendLogs writes one log per entry of statuses, a minute apart starting
+// at base, alternating between two devices and groups. IDs are returned in
+// write order.
+func appendLogs(t *testing.T, s storage.Store, statuses ...string) []uint64 {
+	t.Helper()
+	ids := make([]uint64, len(statuses))
+	for i, status := range statuses {
+		log := &model.NoticeLog{
+			DeviceKey: []string{"dev-a", "dev-b"}[i%2],
+			Group:     []string{"alerts", "news"}[i%2],
+			Title:     fmt.Sprintf("log %d", i),
+			Status:    status,
+			CreatedAt: base.Add(time.Duration(i) * time.Minute),
+		}
+		if err := s.AppendNoticeLog(context.Background(), log); err != nil {
+			t.Fatalf("AppendNoticeLog: %v", err)
+		}
+		if log.ID == 0 {
+			t.Fatalf("AppendNoticeLog did not assign an ID")
+		}
+		if i > 0 && log.ID <= ids[i-1] {
+			t.Fatalf("AppendNoticeLog IDs not increasing: %d after %d", log.ID, ids[i-1])
+		}
+		ids[i] = log.ID
+	}
+	return ids
+}
+
+func testNoticeLogs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	if _, err := s.GetNoticeLog(ctx, 1); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetNoticeLog(missing) = %v, want ErrNotFound", err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs on empty store: %v", err)
+	}
+	if page.Data == nil || len(page.Data) != 0 {
+		t.Fatalf("QueryNoticeLogs on empty store = %v, want empty non-nil data", page.Data)
+	}
+
+	ids := appendLogs(t, s, "SUCCESS", "FAILED", "SUCCESS", "FAILED", "SUCCESS")
+	got, err := s.GetNoticeLog(ctx, ids[2])
+	if err != nil {
+		t.Fatalf("GetNoticeLog: %v", err)
+	}
+	if got.Title != "log 2" || !got.CreatedAt.Equal(base.Add(2*time.Minute)) {
+		t.Fatalf("GetNoticeLog = %+v", got)
+	}
+	all, err := s.ListNoticeLogs(ctx)
+	if err != nil || len(all) != len(ids) {
+		t.Fatalf("ListNoticeLogs = %d logs, %v; want %d", len(all), err, len(ids))
+	}
+
+	page, err = s.QueryNoticeLogs(ctx, model.NoticeLogFilter{})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint(reversed(ids)) {
+		t.Fatalf("QueryNoticeLogs = %v, want newest first %v", got, reversed(ids))
+	}
+
+	// Filters ignore case and surrounding space.
+	for _, tt := range []struct {
+		filter model.NoticeLogFilter
+		want   []uint64
+	}{
+		{model.NoticeLogFilter{Status: "failed"}, []uint64{ids[3], ids[1]}},
+		{model.NoticeLogFilter{DeviceKey: " DEV-A "}, []uint64{ids[4], ids[2], ids[0]}},
+		{model.NoticeLogFilter{Group: "News"}, []uint64{ids[3], ids[1]}},
+		{model.NoticeLogFilter{Group: "alerts", Status: "SUCCESS"}, []uint64{ids[4], ids[2], ids[0]}},
+		{model.NoticeLogFilter{BeginTime: timePtr(base.Add(time.Minute)), EndTime: timePtr(base.Add(3 * time.Minute))}, []uint64{ids[3], ids[2], ids[1]}},
+		{model.NoticeLogFilter{Status: "UNKNOWN"}, nil},
+	} {
+		page, err := s.QueryNoticeLogs(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("QueryNoticeLogs(%+v): %v", tt.filter, err)
+		}
+		if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("QueryNoticeLogs(%+v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	// A resend hides the original from Unretried queries.
+	retry := &model.NoticeLog{DeviceKey: "dev-b", Group: "news", Status: "SUCCESS", RetryOf: ids[1], CreatedAt: base.Add(10 * time.Minute)}
+	if err := s.AppendNoticeLog(ctx, retry); err != nil {
+		t.Fatalf("AppendNoticeLog: %v", err)
+	}
+	page, err = s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "FAILED", Unretried: true})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs(Unretried): %v", err)
+	}
+	if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint([]uint64{ids[3]}) {
+		t.Fatalf("QueryNoticeLogs(Unretried) = %v, want [%d]", got, ids[3])
+	}
+}
+
+func testNoticeLogPages(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "SUCCESS", "SUCCESS", "SUCCESS", "SUCCESS", "SUCCESS")
+	newest := reversed(ids)
+	for _, tt := range []struct {
+		page     int
+		want     []uint64
+		nextPage bool
+	}{
+		{1, newest[0:2], true},
+		{2, newest[2:4], true},
+		{3, newest[4:5], false},
+		{4, nil, false},
+	} {
+		page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Page: tt.page, PageSize: 2})
+		if err != nil {
+			t.Fatalf("QueryNoticeLogs(page %d): %v", tt.page, err)
+		}
+		if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("page %d = %v, want %v", tt.page, got, tt.want)
+		}
+		if page.Total != 5 || page.Pages != 3 || page.PageNum != tt.page || page.PageSize != 2 {
+			t.Errorf("page %d: total %d, pages %d, pageNum %d, pageSize %d; want 5, 3, %d, 2",
+				tt.page, page.Total, page.Pages, page.PageNum, page.PageSize, tt.page)
+		}
+		if (page.NextCursor != "") != tt.nextPage {
+			t.Errorf("page %d: nextCursor %q, want set %v", tt.page, page.NextCursor, tt.nextPage)
+		}
+	}
+}
+
+func testNoticeLogCursor(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "SUCCESS", "FAILED", "SUCCESS", "FAILED", "SUCCESS")
+	var got []uint64
+	filter := model.NoticeLogFilter{PageSize: 2}
+	for range len(ids) {
+		page, err := s.QueryNoticeLogs(ctx, filter)
+		if err != nil {
+			t.Fatalf("QueryNoticeLogs(cursor %q): %v", filter.Cursor, err)
+		}
+		if page.Total != 0 {
+			t.Errorf("cursor query counted %d logs, want no count", page.Total)
+		}
+		got = append(got, logIDs(page.Data)...)
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if fmt.Sprint(got) != fmt.Sprint(reversed(ids)) {
+		t.Fatalf("walking the cursor = %v, want %v", got, reversed(ids))
+	}
+
+	// The cursor composes with filters.
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "SUCCESS", PageSize: 1})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	page, err = s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "SUCCESS", PageSize: 5, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint([]uint64{ids[2], ids[0]}) || page.NextCursor != "" {
+		t.Fatalf("filtered cursor page = %v (next %q), want [%d %d]", got, page.NextCursor, ids[2], ids[0])
+	}
+
+	if _, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Cursor: "not a cursor"}); err == nil {
+		t.Fatalf("QueryNoticeLogs accepted an invalid cursor")
+	}
+}
+
+func testCountNoticeLogs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	appendLogs(t, s, "SUCCESS", "FAILED", "SUCCESS")
+	// A log from another day and year.
+	if err := s.AppendNoticeLog(ctx, &model.NoticeLog{DeviceKey: "dev-a", Group: "alerts", Status: "SUCCESS", CreatedAt: base.AddDate(1, 0, 0)}); err != nil {
+		t.Fatalf("AppendNoticeLog: %v", err)
+	}
+	for _, tt := range []struct {
+		groupBy    string
+		begin, end *time.Time
+		want       map[string]int
+	}{
+		{model.NoticeLogByDay, nil, nil, map[string]int{"2024-03-01": 3, "2025-03-01": 1}},
+		{model.NoticeLogByMonth, nil, nil, map[string]int{"2024-03": 3, "2025-03": 1}},
+		{model.NoticeLogByYear, nil, nil, map[string]int{"2024": 3, "2025": 1}},
+		{model.NoticeLogByStatus, nil, nil, map[string]int{"SUCCESS": 3, "FAILED": 1}},
+		{model.NoticeLogByGroup, nil, nil, map[string]int{"alerts": 3, "news": 1}},
+		{model.NoticeLogByDevice, nil, nil, map[string]int{"dev-a": 3, "dev-b": 1}},
+		{model.NoticeLogByStatus, timePtr(base.Add(time.Minute)), timePtr(base.Add(2 * time.Minute)), map[string]int{"SUCCESS": 1, "FAILED": 1}},
+	} {
+		got, err := s.CountNoticeLogs(ctx, tt.groupBy, tt.begin, tt.end)
+		if err != nil {
+			t.Fatalf("CountNoticeLogs(%s): %v", tt.groupBy, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("CountNoticeLogs(%s) = %v, want %v", tt.groupBy, got, tt.want)
+		}
+	}
+	if _, err := s.CountNoticeLogs(ctx, "week", nil, nil); err == nil {
+		t.Fatalf("CountNoticeLogs accepted an unknown grouping")
+	}
+}
+
+func testPruneNoticeLogs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "SUCCESS", "FAILED", "SUCCESS", "FAILED", "SUCCESS", "FAILED")
+	if n, err := s.PruneNoticeLogs(ctx, model.NoticeLogPrune{}); err != nil || n != 0 {
+		t.Fatalf("empty prune rule removed %d logs, %v", n, err)
+	}
+	// Keep the newest FAILED log only.
+	if n, err := s.PruneNoticeLogs(ctx, model.NoticeLogPrune{Status: "FAILED", Keep: 1}); err != nil || n != 2 {
+		t.Fatalf("PruneNoticeLogs(keep 1 FAILED) = %d, %v; want 2", n, err)
+	}
+	// Drop everything older than the fourth log.
+	if n, err := s.PruneNoticeLogs(ctx, model.NoticeLogPrune{Before: base.Add(3 * time.Minute)}); err != nil || n != 2 {
+		t.Fatalf("PruneNoticeLogs(before) = %d, %v; want 2", n, err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint([]uint64{ids[5], ids[4]}) {
+		t.Fatalf("after pruning = %v, want [%d %d]", got, ids[5], ids[4])
+	}
+	if _, err := s.GetNoticeLog(ctx, ids[0]); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetNoticeLog(pruned) = %v, want ErrNotFound", err)
+	}
+}
+
+func testPruneExceptStatuses(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "FAILED", "SUCCESS", "PENDING", "SUCCESS", "FAILED", "SUCCESS")
+	// FAILED has its own rule: it is neither deleted nor counted, so the
+	// newest two of the rest survive plus every FAILED log.
+	rule := model.NoticeLogPrune{ExceptStatuses: []string{"failed"}, Keep: 2}
+	if n, err := s.PruneNoticeLogs(ctx, rule); err != nil || n != 2 {
+		t.Fatalf("PruneNoticeLogs(keep 2 except FAILED) = %d, %v; want 2", n, err)
+	}
+	rule = model.NoticeLogPrune{ExceptStatuses: []string{"FAILED"}, Before: base.Add(4 * time.Minute)}
+	if n, err := s.PruneNoticeLogs(ctx, rule); err != nil || n != 1 {
+		t.Fatalf("PruneNoticeLogs(before except FAILED) = %d, %v; want 1", n, err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	if got, want := logIDs(page.Data), []uint64{ids[5], ids[4], ids[0]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("after pruning = %v, want %v", got, want)
+	}
+}
+
+// testPruneKeepsRetries checks that pruning a successful retry does not
+// bring its original back into Unretried queries.
+func testPruneKeepsRetries(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "FAILED")
+	retry := &model.NoticeLog{DeviceKey: "dev-a", Status: "SUCCESS", RetryOf: ids[0], CreatedAt: base.Add(time.Minute)}
+	if err := s.AppendNoticeLog(ctx, retry); err != nil {
+		t.Fatalf("AppendNoticeLog: %v", err)
+	}
+	if n, err := s.PruneNoticeLogs(ctx, model.NoticeLogPrune{Status: "SUCCESS", Before: base.Add(time.Hour)}); err != nil || n != 1 {
+		t.Fatalf("PruneNoticeLogs(SUCCESS) = %d, %v; want 1", n, err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "FAILED", Unretried: true})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs(Unretried): %v", err)
+	}
+	if got := logIDs(page.Data); len(got) != 0 {
+		t.Fatalf("QueryNoticeLogs(Unretried) = %v, want none", got)
+	}
+	page, err = s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "FAILED"})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs: %v", err)
+	}
+	if got := logIDs(page.Data); fmt.Sprint(got) != fmt.Sprint([]uint64{ids[0]}) {
+		t.Fatalf("QueryNoticeLogs(FAILED) = %v, want [%d]", got, ids[0])
+	}
+}
+
+func testDeviceNoticeLogs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "SUCCESS", "SUCCESS", "SUCCESS", "SUCCESS")
+	if n, err := s.AnonymizeDeviceNoticeLogs(ctx, "DEV-A"); err != nil || n != 2 {
+		t.Fatalf("AnonymizeDeviceNoticeLogs = %d, %v; want 2", n, err)
+	}
+	got, err := s.GetNoticeLog(ctx, ids[0])
+	if err != nil || got.DeviceKey != model.AnonymizedDeviceKey {
+		t.Fatalf("anonymized log = %+v, %v", got, err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{DeviceKey: "dev-a"})
+	if err != nil || len(page.Data) != 0 {
+		t.Fatalf("dev-a still has %d logs after anonymizing, %v", len(page.Data), err)
+	}
+	page, err = s.QueryNoticeLogs(ctx, model.NoticeLogFilter{DeviceKey: model.AnonymizedDeviceKey})
+	if err != nil || len(page.Data) != 2 {
+		t.Fatalf("%s has %d logs, %v; want 2", model.AnonymizedDeviceKey, len(page.Data), err)
+	}
+
+	if n, err := s.DeleteDeviceNoticeLogs(ctx, "dev-b"); err != nil || n != 2 {
+		t.Fatalf("DeleteDeviceNoticeLogs = %d, %v; want 2", n, err)
+	}
+	if _, err := s.GetNoticeLog(ctx, ids[1]); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetNoticeLog(deleted) = %v, want ErrNotFound", err)
+	}
+	if n, err := s.DeleteDeviceNoticeLogs(ctx, ""); err != nil || n != 0 {
+		t.Fatalf("DeleteDeviceNoticeLogs(\"\") = %d, %v; want 0", n, err)
+	}
+	all, err := s.ListNoticeLogs(ctx)
+	if err != nil || len(all) != 2 {
+		t.Fatalf("ListNoticeLogs = %d logs, %v; want 2", len(all), err)
+	}
+}
+
+// testAnonymizeKeepsRetries checks that anonymizing a retried log does not
+// make it show up as unretried again.
+func testAnonymizeKeepsRetries(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ids := appendLogs(t, s, "FAILED")
+	retry := &model.NoticeLog{DeviceKey: "dev-a", Status: "SUCCESS", RetryOf: ids[0], CreatedAt: base.Add(time.Minute)}
+	if err := s.AppendNoticeLog(ctx, retry); err != nil {
+		t.Fatalf("AppendNoticeLog: %v", err)
+	}
+	if n, err := s.AnonymizeDeviceNoticeLogs(ctx, "dev-a"); err != nil || n != 2 {
+		t.Fatalf("AnonymizeDeviceNoticeLogs = %d, %v; want 2", n, err)
+	}
+	page, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{Status: "FAILED", Unretried: true})
+	if err != nil {
+		t.Fatalf("QueryNoticeLogs(Unretried): %v", err)
+	}
+	if got := logIDs(page.Data); len(got) != 0 {
+		t.Fatalf("QueryNoticeLogs(Unretried) = %v, want none", got)
+	}
+}
+
+func testRecords(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	if _, err := s.GetNotice(ctx, "n1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetNotice(missing) = %v, want ErrNotFound", err)
+	}
+	notice := &model.NoticeRecord{ID: "n1", DeviceKeys: []string{"dev-a"}}
+	if err := s.SaveNotice(ctx, notice); err != nil {
+		t.Fatalf("SaveNotice: %v", err)
+	}
+	if got, err := s.GetNotice(ctx, "n1"); err != nil || fmt.Sprint(got.DeviceKeys) != "[dev-a]" || got.CreatedAt.IsZero() {
+		t.Fatalf("GetNotice = %+v, %v", got, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := s.SaveAttachment(ctx, &model.Attachment{ID: "a1", FileName: "old.png", ExpiresAt: now.Add(-time.Hour)}); err != nil {
+		t.Fatalf("SaveAttachment: %v", err)
+	}
+	if err := s.SaveAttachment(ctx, &model.Attachment{ID: "a2", FileName: "new.png", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("SaveAttachment: %v", err)
+	}
+	if err := s.SaveAttachment(ctx, &model.Attachment{ID: "a3", FileName: "kept.png"}); err != nil {
+		t.Fatalf("SaveAttachment: %v", err)
+	}
+	if got, err := s.GetAttachment(ctx, "a2"); err != nil || got.FileName != "new.png" {
+		t.Fatalf("GetAttachment = %+v, %v", got, err)
+	}
+	expired, err := s.ListExpiredAttachments(ctx, now)
+	if err != nil || len(expired) != 1 || expired[0].ID != "a1" {
+		t.Fatalf("ListExpiredAttachments = %v, %v; want [a1]", expired, err)
+	}
+	if err := s.DeleteAttachment(ctx, "a1"); err != nil {
+		t.Fatalf("DeleteAttachment: %v", err)
+	}
+	if _, err := s.GetAttachment(ctx, "a1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetAttachment(deleted) = %v, want ErrNotFound", err)
+	}
+
+	key := &model.APIKey{ID: "k1", Name: "ci", Scopes: []string{"send"}}
+	if err := s.SaveAPIKey(ctx, key); err != nil {
+		t.Fatalf("SaveAPIKey: %v", err)
+	}
+	if got, err := s.GetAPIKey(ctx, "k1"); err != nil || got.Name != "ci" || !got.HasScope("send") {
+		t.Fatalf("GetAPIKey = %+v, %v", got, err)
+	}
+	if keys, err := s.ListAPIKeys(ctx); err != nil || len(keys) != 1 {
+		t.Fatalf("ListAPIKeys = %d keys, %v; want 1", len(keys), err)
+	}
+	if err := s.TouchAPIKey(ctx, "k1", now); err != nil {
+		t.Fatalf("TouchAPIKey: %v", err)
+	}
+	if got, err := s.GetAPIKey(ctx, "k1"); err != nil || got.LastUsedAt == nil || !got.LastUsedAt.Equal(now) || got.Name != "ci" {
+		t.Fatalf("GetAPIKey(touched) = %+v, %v", got, err)
+	}
+	if err := s.DeleteAPIKey(ctx, "k1"); err != nil {
+		t.Fatalf("DeleteAPIKey: %v", err)
+	}
+	if err := s.DeleteAPIKey(ctx, "k1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("DeleteAPIKey(deleted) = %v, want ErrNotFound", err)
+	}
+	// Touching a deleted key must not bring it back.
+	if err := s.TouchAPIKey(ctx, "k1", now); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("TouchAPIKey(deleted) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetAPIKey(ctx, "k1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetAPIKey(touched after delete) = %v, want ErrNotFound", err)
+	}
+
+	// Usernames are looked up case-insensitively.
+	if err := s.SaveUser(ctx, &model.User{Username: "Alice", Role: "admin"}); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if got, err := s.GetUser(ctx, "alice"); err != nil || got.Role != "admin" {
+		t.Fatalf("GetUser = %+v, %v", got, err)
+	}
+	if users, err := s.ListUsers(ctx); err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers = %d users, %v; want 1", len(users), err)
+	}
+	if err := s.DeleteUser(ctx, "ALICE"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.GetUser(ctx, "alice"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetUser(deleted) = %v, want ErrNotFound", err)
+	}
+
+	if err := s.SaveSession(ctx, &model.Session{ID: "s1", Username: "alice", RefreshHash: "h1", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("SaveSession: %v", err)
+	}
+	rotated := &model.Session{ID: "s1", Username: "alice", RefreshHash: "h2", PreviousHash: "h1", ExpiresAt: now.Add(time.Hour)}
+	if err := s.RotateSession(ctx, rotated, "h1"); err != nil {
+		t.Fatalf("RotateSession: %v", err)
+	}
+	if err := s.RotateSession(ctx, &model.Session{ID: "s1", RefreshHash: "h3"}, "h1"); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("RotateSession(stale) = %v, want ErrConflict", err)
+	}
+	if got, err := s.GetSession(ctx, "s1"); err != nil || got.RefreshHash != "h2" || got.PreviousHash != "h1" {
+		t.Fatalf("GetSession(rotated) = %+v, %v", got, err)
+	}
+	if got, err := s.GetSession(ctx, "s1"); err != nil || got.Username != "alice" || !got.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("GetSession = %+v, %v", got, err)
+	}
+	if sessions, err := s.ListSessions(ctx); err != nil || len(sessions) != 1 {
+		t.Fatalf("ListSessions = %d sessions, %v; want 1", len(sessions), err)
+	}
+	if err := s.DeleteSession(ctx, "s1"); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if _, err := s.GetSession(ctx, "s1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetSession(deleted) = %v, want ErrNotFound", err)
+	}
+	if err := s.RotateSession(ctx, rotated, "h2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("RotateSession(deleted) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetSession(ctx, "s1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("RotateSession resurrected a deleted session: %v", err)
+	}
+
+	attempt := &model.LoginAttempt{Kind: model.LoginAttemptIP, Subject: "203.0.113.5", Failures: 3, LastFailure: now}
+	if err := s.SaveLoginAttempt(ctx, attempt); err != nil {
+		t.Fatalf("SaveLoginAttempt: %v", err)
+	}
+	if got, err := s.GetLoginAttempt(ctx, attempt.Key()); err != nil || got.Failures != 3 {
+		t.Fatalf("GetLoginAttempt = %+v, %v", got, err)
+	}
+	if attempts, err := s.ListLoginAttempts(ctx); err != nil || len(attempts) != 1 {
+		t.Fatalf("ListLoginAttempts = %d attempts, %v; want 1", len(attempts), err)
+	}
+	if err := s.DeleteLoginAttempt(ctx, attempt.Key()); err != nil {
+		t.Fatalf("DeleteLoginAttempt: %v", err)
+	}
+	if _, err := s.GetLoginAttempt(ctx, attempt.Key()); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetLoginAttempt(deleted) = %v, want ErrNotFound", err)
+	}
+}
+
+func testAudit(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	for _, action := range []string{"user.create", "device.update", "user.delete"} {
+		entry := &model.AuditEntry{Actor: "admin", Action: action}
+		if err := s.AppendAuditEntry(ctx, entry); err != nil {
+			t.Fatalf("AppendAuditEntry: %v", err)
+		}
+		if entry.ID == 0 || entry.CreatedAt.IsZero() {
+			t.Fatalf("AppendAuditEntry did not set ID and CreatedAt: %+v", entry)
+		}
+	}
+	entries, err := s.ListAuditEntries(ctx)
+	if err != nil {
+		t.Fatalf("ListAuditEntries: %v", err)
+	}
+	var actions []string
+	for i, entry := range entries {
+		if i > 0 && entry.ID <= entries[i-1].ID {
+			t.Fatalf("audit IDs not increasing: %d after %d", entry.ID, entries[i-1].ID)
+		}
+		actions = append(actions, entry.Action)
+	}
+	if fmt.Sprint(actions) != "[user.create device.update user.delete]" {
+		t.Fatalf("ListAuditEntries = %v, want insertion order", actions)
+	}
+}
+
+func testAuditQuery(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	seed := []struct {
+		actor, action, target string
+	}{
+		{"admin", "user.create", "alice"},
+		{"Admin", "device.status", "key-1"},
+		{"ops", "user.update", "alice"},
+		{"admin", "user.delete", "bob"},
+		{"ops", "device.delete", "key-2"},
+	}
+	for i, e := range seed {
+		entry := &model.AuditEntry{Actor: e.actor, Action: e.action, Target: e.target, CreatedAt: base.Add(time.Duration(i) * time.Hour)}
+		if err := s.AppendAuditEntry(ctx, entry); err != nil {
+			t.Fatalf("AppendAuditEntry: %v", err)
+		}
+	}
+	targets := func(page *model.AuditPage) string {
+		var out []string
+		for _, entry := range page.Data {
+			out = append(out, entry.Action+"/"+entry.Target)
+		}
+		return fmt.Sprint(out)
+	}
+	tests := []struct {
+		name      string
+		filter    model.AuditFilter
+		want      string
+		wantTotal int
+	}{
+		{"all", model.AuditFilter{}, "[device.delete/key-2 user.delete/bob user.update/alice device.status/key-1 user.create/alice]", 5},
+		{"actor ignores case", model.AuditFilter{Actor: "ADMIN"}, "[user.delete/bob device.status/key-1 user.create/alice]", 3},
+		{"action prefix", model.AuditFilter{Action: "user"}, "[user.delete/bob user.update/alice user.create/alice]", 3},
+		{"action is case-sensitive", model.AuditFilter{Action: "USER"}, "[]", 0},
+		{"target substring", model.AuditFilter{Target: "key"}, "[device.delete/key-2 device.status/key-1]", 2},
+		{"time range", model.AuditFilter{BeginTime: timePtr(base.Add(time.Hour)), EndTime: timePtr(base.Add(3 * time.Hour))}, "[user.delete/bob user.update/alice device.status/key-1]", 3},
+		{"combined", model.AuditFilter{Action: "user", Target: "alice", BeginTime: timePtr(base.Add(time.Hour))}, "[user.update/alice]", 1},
+		{"first page", model.AuditFilter{Page: 1, PageSize: 2}, "[device.delete/key-2 user.delete/bob]", 5},
+		{"last page", model.AuditFilter{Page: 3, PageSize: 2}, "[user.create/alice]", 5},
+		{"filtered page", model.AuditFilter{Action: "user", Page: 2, PageSize: 2}, "[user.create/alice]", 3},
+		{"past the end", model.AuditFilter{Page: 4, PageSize: 2}, "[]", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := s.QueryAuditEntries(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("QueryAuditEntries: %v", err)
+			}
+			if got := targets(page); got != tt.want || page.Total != tt.wantTotal {
+				t.Fatalf("QueryAuditEntries = %s (total %d), want %s (total %d)", got, page.Total, tt.want, tt.wantTotal)
+			}
+			if tt.filter.PageSize > 0 && page.Pages != (tt.wantTotal+tt.filter.PageSize-1)/tt.filter.PageSize {
+				t.Fatalf("Pages = %d for total %d and page size %d", page.Pages, page.Total, tt.filter.PageSize)
+			}
+		})
+	}
+
+	n, err := s.PruneAuditEntries(ctx, base.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("PruneAuditEntries: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("PruneAuditEntries removed %d, want 2", n)
+	}
+	page, err := s.QueryAuditEntries(ctx, model.AuditFilter{})
+	if err != nil {
+		t.Fatalf("QueryAuditEntries: %v", err)
+	}
+	if got := targets(page); got != "[device.delete/key-2 user.delete/bob user.update/alice]" {
+		t.Fatalf("after prune = %s", got)
+	}
+	entry := &model.AuditEntry{Actor: "admin", Action: "user.create", Target: "carol"}
+	if err := s.AppendAuditEntry(ctx, entry); err != nil {
+		t.Fatalf("AppendAuditEntry: %v", err)
+	}
+	if entry.ID <= page.Data[0].ID {
+		t.Fatalf("ID %d reused after pruning (newest was %d)", entry.ID, page.Data[0].ID)
+	}
+}
+
+func testConcurrency(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	const workers, perWorker = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				token := fmt.Sprintf("tok-%d-%d", w, i)
+				if err := s.UpsertDevice(ctx, &model.Device{DeviceToken: token, DeviceKey: token}); err != nil {
+					errs <- err
+					return
+				}
+				if err := s.AppendNoticeLog(ctx, &model.NoticeLog{DeviceKey: token, Status: "SUCCESS"}); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.GetDeviceByKey(ctx, token); err != nil {
+					errs <- fmt.Errorf("GetDeviceByKey(%s): %w", token, err)
+					return
+				}
+				if _, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{PageSize: 5}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	devices, err := s.ListDevices(ctx)
+	if err != nil || len(devices) != workers*perWorker {
+		t.Fatalf("ListDevices = %d devices, %v; want %d", len(devices), err, workers*perWorker)
+	}
+	logs, err := s.ListNoticeLogs(ctx)
+	if err != nil || len(logs) != workers*perWorker {
+		t.Fatalf("ListNoticeLogs = %d logs, %v; want %d", len(logs), err, workers*perWorker)
+	}
+	seen := make(map[uint64]bool)
+	for _, log := range logs {
+		if seen[log.ID] {
+			t.Fatalf("log ID %d assigned twice", log.ID)
+		}
+		seen[log.ID] = true
+	}
+}
+
+func testCancelledContext(t *testing.T, s storage.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.UpsertDevice(ctx, &model.Device{DeviceToken: "tok"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpsertDevice = %v, want context.Canceled", err)
+	}
+	if _, err := s.ListDevices(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListDevices = %v, want context.Canceled", err)
+	}
+	if err := s.AppendNoticeLog(ctx, &model.NoticeLog{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("AppendNoticeLog = %v, want context.Canceled", err)
+	}
+	if _, err := s.QueryNoticeLogs(ctx, model.NoticeLogFilter{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("QueryNoticeLogs = %v, want context.Canceled", err)
+	}
+	if _, err := s.GetUser(ctx, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUser = %v, want context.Canceled", err)
+	}
+	if devices, err := s.ListDevices(context.Background()); err != nil || len(devices) != 0 {
+		t.Errorf("a cancelled UpsertDevice stored %d devices, %v", len(devices), err)
+	}
+}
+
+func deviceTokens(devices []*model.Device) []string {
+	var tokens []string
+	for _, device := range devices {
+		tokens = append(tokens, device.DeviceToken)
+	}
+	return tokens
+}
+
+func logIDs(logs []*model.NoticeLog) []uint64 {
+	var ids []uint64
+	for _, log := range logs {
+		ids = append(ids, log.ID)
+	}
+	return ids
+}
+
+func reversed(ids []uint64) []uint64 {
+	out := make([]uint64, len(ids))
+	for i, id := range ids {
+		out[len(ids)-1-i] = id
+	}
+	return out
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
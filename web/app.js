@@ -1,10 +1,20 @@
 const state = {
   token: localStorage.getItem("bark_token") || "",
+  refreshToken: localStorage.getItem("bark_refresh") || "",
+  refreshing: null,
   username: "",
+  role: "",
+  challenge: "",
   currentView: "dashboard",
   devices: [],
 };
 
+const ROLE_LABELS = {
+  admin: "管理员",
+  operator: "操作员",
+  viewer: "只读",
+};
+
 const $ = (selector) => document.querySelector(selector);
 const $$ = (selector) => document.querySelectorAll(selector);
 
@@ -14,7 +24,8 @@ document.addEventListener("DOMContentLoaded", () => {
 });
 
 async function bootstrap() {
-  if (await tryAutoLoginFromQuery()) {
+  loadOIDCConfig();
+  if (takeOIDCResult() || (await tryAutoLoginFromQuery())) {
     return;
   }
   if (!state.token) {
@@ -30,6 +41,11 @@ async function bootstrap() {
       return;
     }
     state.username = profile.username;
+    state.role = profile.role || "";
+    if (profile.mustChangePassword) {
+      showPasswordChange();
+      return;
+    }
     showPortal();
     refreshAll();
   } catch (err) {
@@ -40,6 +56,11 @@ async function bootstrap() {
 
 function bindEvents() {
   $("#login-form").addEventListener("submit", handleLogin);
+  $("#password-form").addEventListener("submit", handlePasswordChange);
+  $("#totp-form").addEventListener("submit", handleTwoFactor);
+  $("#oidc-login").addEventListener("click", () => {
+    window.location.href = "/auth/oidc/login";
+  });
   $("#logout-btn").addEventListener("click", () => logout(false));
   $$("#nav .nav-link").forEach((btn) =>
     btn.addEventListener("click", () => switchView(btn.dataset.view))
@@ -48,6 +69,21 @@ function bindEvents() {
   $("#refresh-devices").addEventListener("click", loadDevices);
   $("#refresh-sender").addEventListener("click", loadDevices);
   $("#refresh-logs").addEventListener("click", () => loadLogs(true));
+  $("#resend-failed").addEventListener("click", resendFailedLogs);
+  $("#logs-table-body").addEventListener("click", (e) => {
+    const btn = e.target.closest("[data-resend]");
+    if (btn) resendLog(btn.dataset.resend);
+  });
+  $("#devices-table-body").addEventListener("click", (e) => {
+    const btn = e.target.closest("[data-delete]");
+    if (btn) deleteDevice(btn.dataset.delete);
+  });
+  $("#deleted-devices-table-body").addEventListener("click", (e) => {
+    const restore = e.target.closest("[data-restore]");
+    if (restore) restoreDevice(restore.dataset.restore);
+    const purge = e.target.closest("[data-purge]");
+    if (purge) purgeDevice(purge.dataset.purge);
+  });
   $("#device-form").addEventListener("submit", handleDeviceSubmit);
   $("#notice-form").addEventListener("submit", handleNoticeSubmit);
   $("#log-filter").addEventListener("submit", (e) => {
@@ -57,6 +93,9 @@ function bindEvents() {
   $("#notice-all").addEventListener("change", (e) => {
     $("#notice-device-keys").disabled = e.target.checked;
   });
+  $$(".upload-input").forEach((input) =>
+    input.addEventListener("change", handleAttachmentUpload)
+  );
   $$(".chip").forEach((chip) =>
     chip.addEventListener("click", () => applyTemplate(chip.dataset.template))
   );
@@ -87,6 +126,41 @@ function bindEvents() {
 function showAuth() {
   $("#auth-panel").classList.remove("hidden");
   $("#portal").classList.add("hidden");
+  $("#login-form").classList.remove("hidden");
+  $("#password-form").classList.add("hidden");
+  $("#totp-form").classList.add("hidden");
+}
+
+function showPasswordChange() {
+  showAuth();
+  $("#login-form").classList.add("hidden");
+  $("#password-form").classList.remove("hidden");
+}
+
+async function handlePasswordChange(event) {
+  event.preventDefault();
+  const form = event.currentTarget;
+  const payload = Object.fromEntries(new FormData(form).entries());
+  if (payload.newPassword !== payload.confirmPassword) {
+    showToast("两次输入的新密码不一致", true);
+    return;
+  }
+  try {
+    const res = await api("/auth/password", {
+      method: "POST",
+      body: JSON.stringify({
+        oldPassword: payload.oldPassword,
+        newPassword: payload.newPassword,
+      }),
+    });
+    saveTokens(res);
+    form.reset();
+    showPortal();
+    refreshAll();
+    showToast("密码已修改");
+  } catch (err) {
+    showToast(err.message, true);
+  }
 }
 
 function showPortal() {
@@ -94,7 +168,8 @@ function showPortal() {
   $("#portal").classList.remove("hidden");
   const sidebarUser = $("#sidebar-user");
   if (sidebarUser) {
-    sidebarUser.textContent = `欢迎，${state.username || "管理员"}`;
+    const role = ROLE_LABELS[state.role];
+    sidebarUser.textContent = `欢迎，${state.username || "管理员"}${role ? `（${role}）` : ""}`;
   }
 }
 
@@ -119,9 +194,19 @@ async function handleLogin(event) {
 }
 
 function logout(isExpired) {
+  if (!isExpired && (state.token || state.refreshToken)) {
+    api("/auth/logout", {
+      method: "POST",
+      body: JSON.stringify({ refreshToken: state.refreshToken }),
+      noRefresh: true,
+    }).catch((err) => console.warn("logout failed", err));
+  }
   state.token = "";
+  state.refreshToken = "";
   state.username = "";
+  state.role = "";
   localStorage.removeItem("bark_token");
+  localStorage.removeItem("bark_refresh");
   showAuth();
   if (isExpired) {
     showToast("登录已失效，请重新登录", true);
@@ -142,6 +227,36 @@ async function tryAutoLoginFromQuery() {
   return success;
 }
 
+async function loadOIDCConfig() {
+  try {
+    const res = await api("/auth/oidc/config", { skipAuth: true });
+    $("#oidc-login").classList.toggle("hidden", !res?.enabled);
+  } catch (err) {
+    console.warn("oidc config failed", err);
+  }
+}
+
+// takeOIDCResult picks up the session (or error) the SSO callback left in the
+// URL fragment. It returns true when the login page was shown for an error.
+function takeOIDCResult() {
+  const params = new URLSearchParams(window.location.hash.slice(1));
+  const token = params.get("oidc_token");
+  const refreshToken = params.get("oidc_refresh") || "";
+  const error = params.get("oidc_error");
+  if (!token && !error) {
+    return false;
+  }
+  history.replaceState({}, "", window.location.pathname);
+  if (error) {
+    $("#login-hint").textContent = error;
+    showToast(error, true);
+    showAuth();
+    return true;
+  }
+  saveTokens({ token, refreshToken });
+  return false;
+}
+
 async function performLogin(payload, { silent }) {
   try {
     const res = await api("/auth/login", {
@@ -149,14 +264,12 @@ async function performLogin(payload, { silent }) {
       body: JSON.stringify(payload),
       skipAuth: true,
     });
-    state.token = res.token || "";
-    state.username = res.username || payload.username;
-    localStorage.setItem("bark_token", state.token);
-    showPortal();
-    refreshAll();
-    if (!silent) {
-      showToast("登录成功");
+    if (res.twoFactorRequired) {
+      state.challenge = res.challenge;
+      showTwoFactor();
+      return true;
     }
+    completeLogin(res, payload.username, silent);
     return true;
   } catch (err) {
     $("#login-hint").textContent = err.message;
@@ -166,6 +279,82 @@ async function performLogin(payload, { silent }) {
   }
 }
 
+function completeLogin(res, fallbackUsername, silent) {
+  saveTokens(res);
+  state.username = res.username || fallbackUsername;
+  state.role = res.role || "";
+  if (res.mustChangePassword) {
+    showPasswordChange();
+    return;
+  }
+  showPortal();
+  refreshAll();
+  if (!silent) {
+    showToast("登录成功");
+  }
+}
+
+function saveTokens(res) {
+  state.token = res.token || "";
+  state.refreshToken = res.refreshToken || "";
+  localStorage.setItem("bark_token", state.token);
+  localStorage.setItem("bark_refresh", state.refreshToken);
+}
+
+// refreshSession trades the refresh token for a new token pair. Concurrent
+// callers share one request, since each refresh token works only once.
+function refreshSession() {
+  if (!state.refreshToken) {
+    return Promise.resolve(false);
+  }
+  if (!state.refreshing) {
+    state.refreshing = api("/auth/refresh", {
+      method: "POST",
+      body: JSON.stringify({ refreshToken: state.refreshToken }),
+      skipAuth: true,
+    })
+      .then((res) => {
+        saveTokens(res);
+        return true;
+      })
+      .catch(() => false)
+      .finally(() => {
+        state.refreshing = null;
+      });
+  }
+  return state.refreshing;
+}
+
+function showTwoFactor() {
+  showAuth();
+  $("#login-form").classList.add("hidden");
+  $("#totp-form").classList.remove("hidden");
+  $("#totp-form input[name=code]").focus();
+}
+
+async function handleTwoFactor(event) {
+  event.preventDefault();
+  const form = event.currentTarget;
+  const code = new FormData(form).get("code");
+  try {
+    const res = await api("/auth/login/2fa", {
+      method: "POST",
+      body: JSON.stringify({ challenge: state.challenge, code }),
+      skipAuth: true,
+    });
+    state.challenge = "";
+    form.reset();
+    completeLogin(res, "", false);
+  } catch (err) {
+    showToast(err.message, true);
+    if (err.message.includes("重新登录")) {
+      state.challenge = "";
+      form.reset();
+      showAuth();
+    }
+  }
+}
+
 function refreshAll() {
   switchView("dashboard");
   loadDashboard();
@@ -212,6 +401,9 @@ async function loadDevices() {
     state.devices = devices || [];
     renderDeviceTable();
     renderDeviceOptions();
+    if (state.currentView === "devices") {
+      renderDeletedDevices((await api("/admin/devices/deleted")) || []);
+    }
   } catch (err) {
     showToast(err.message, true);
   }
@@ -220,7 +412,7 @@ async function loadDevices() {
 function renderDeviceTable() {
   const body = $("#devices-table-body");
   if (!state.devices.length) {
-    body.innerHTML = `<tr><td colspan="5" class="empty">暂无数据</td></tr>`;
+    body.innerHTML = `<tr><td colspan="6" class="empty">暂无数据</td></tr>`;
     return;
   }
   body.innerHTML = state.devices
@@ -231,11 +423,74 @@ function renderDeviceTable() {
         <td class="mono" title="${d.deviceKey}">${mask(d.deviceKey)}</td>
         <td>${d.status || "ACTIVE"}</td>
         <td>${formatTime(d.updatedAt)}</td>
+        <td><button type="button" class="chip" data-delete="${escapeHtml(d.deviceToken)}">删除</button></td>
       </tr>`
     )
     .join("");
 }
 
+const LOG_POLICY_LABELS = {
+  keep: "保留",
+  purge: "删除",
+  anonymize: "匿名化",
+};
+
+function renderDeletedDevices(list) {
+  const body = $("#deleted-devices-table-body");
+  if (!list.length) {
+    body.innerHTML = `<tr><td colspan="6" class="empty">暂无数据</td></tr>`;
+    return;
+  }
+  body.innerHTML = list
+    .map(
+      (d) => `<tr>
+        <td>${escapeHtml(d.device.name || "-")}</td>
+        <td class="mono" title="${d.device.deviceKey}">${mask(d.device.deviceKey)}</td>
+        <td>${formatTime(d.deletedAt)}</td>
+        <td>${formatTime(d.purgeAt)}</td>
+        <td>${LOG_POLICY_LABELS[d.logPolicy] || d.logPolicy}</td>
+        <td>
+          <button type="button" class="chip" data-restore="${escapeHtml(d.device.deviceToken)}">恢复</button>
+          <button type="button" class="chip" data-purge="${escapeHtml(d.device.deviceToken)}">彻底删除</button>
+        </td>
+      </tr>`
+    )
+    .join("");
+}
+
+async function deleteDevice(token) {
+  const device = state.devices.find((d) => d.deviceToken === token);
+  if (!confirm(`删除设备 ${device?.name || mask(token)}？删除后在恢复期限内可以恢复。`)) return;
+  try {
+    await api(`/admin/devices/${encodeURIComponent(token)}`, { method: "DELETE" });
+    showToast("设备已删除");
+    loadDevices();
+  } catch (err) {
+    showToast(err.message, true);
+  }
+}
+
+async function restoreDevice(token) {
+  try {
+    await api(`/admin/devices/deleted/${encodeURIComponent(token)}/restore`, { method: "POST" });
+    showToast("设备已恢复");
+    loadDevices();
+  } catch (err) {
+    showToast(err.message, true);
+  }
+}
+
+async function purgeDevice(token) {
+  if (!confirm("彻底删除后无法恢复，确定继续？")) return;
+  try {
+    await api(`/admin/devices/deleted/${encodeURIComponent(token)}`, { method: "DELETE" });
+    showToast("设备已彻底删除");
+    loadDevices();
+  } catch (err) {
+    showToast(err.message, true);
+  }
+}
+
 function renderDeviceOptions() {
   const select = $("#notice-device-keys");
   if (!select) return;
@@ -302,9 +557,12 @@ async function handleNoticeSubmit(event) {
     payload.deviceKeys = Array.from($("#notice-device-keys").selectedOptions, (opt) => opt.value).filter(Boolean);
   }
   try {
-    const summary = await api("/notice", {
-      method: "POST",
-      body: JSON.stringify(payload),
+    let done = 0;
+    let failed = 0;
+    const summary = await streamNotice(payload, (result) => {
+      done += 1;
+      if (result.status !== "SUCCESS") failed += 1;
+      $("#notice-feedback").textContent = `发送中：已完成 ${done} 台，失败 ${failed} 台`;
     });
     $("#notice-feedback").textContent = `已完成：${summary.successNum}/${summary.sendNum}`;
     showToast("通知发送中");
@@ -319,6 +577,67 @@ async function handleNoticeSubmit(event) {
   }
 }
 
+async function handleAttachmentUpload(event) {
+  const input = event.currentTarget;
+  const file = input.files && input.files[0];
+  if (!file) return;
+  const form = new FormData();
+  form.append("file", file);
+  try {
+    const res = await api("/attachments", { method: "POST", body: form });
+    $("#notice-form")[input.dataset.uploadTarget].value = res.url;
+    showToast("上传成功");
+  } catch (err) {
+    showToast(err.message, true);
+  } finally {
+    input.value = "";
+  }
+}
+
+async function streamNotice(payload, onResult) {
+  const send = () => {
+    const headers = { "Content-Type": "application/json" };
+    if (state.token) {
+      headers.Authorization = `Bearer ${state.token}`;
+    }
+    return fetch("/notice?stream=ndjson", {
+      method: "POST",
+      headers,
+      body: JSON.stringify(payload),
+    });
+  };
+  let res = await send();
+  if (res.status === 401 && (await refreshSession())) {
+    res = await send();
+  }
+  if (!res.ok || !res.body || !(res.headers.get("content-type") || "").includes("ndjson")) {
+    const data = await res.json().catch(() => ({}));
+    throw new Error(data.msg || data.error || res.statusText);
+  }
+  const reader = res.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+  let final = null;
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) break;
+    buffer += decoder.decode(value, { stream: true });
+    let idx;
+    while ((idx = buffer.indexOf("\n")) >= 0) {
+      const line = buffer.slice(0, idx).trim();
+      buffer = buffer.slice(idx + 1);
+      if (!line) continue;
+      const event = JSON.parse(line);
+      if (event.type === "result") onResult(event.data);
+      else final = event.data;
+    }
+  }
+  if (!final || final.code !== "000000") {
+    throw new Error(final?.msg || "发送失败");
+  }
+  return final.data;
+}
+
 function applyTemplate(type) {
   const form = $("#notice-form");
   if (!form) return;
@@ -338,15 +657,9 @@ async function loadLogs(force) {
   if (!force && body.dataset.loaded === "true") {
     return;
   }
-  const form = $("#log-filter");
-  const params = new URLSearchParams({
-    page: "1",
-    pageSize: "20",
-  });
-  if (form.group.value) params.set("group", form.group.value.trim());
-  if (form.status.value) params.set("status", form.status.value);
-  if (form.beginTime.value) params.set("beginTime", form.beginTime.value);
-  if (form.endTime.value) params.set("endTime", form.endTime.value);
+  const params = logFilterParams();
+  params.set("page", "1");
+  params.set("pageSize", "20");
   try {
     const res = await api(`/api/notice/log/list?${params.toString()}`);
     renderLogTable(res.data || []);
@@ -356,10 +669,20 @@ async function loadLogs(force) {
   }
 }
 
+function logFilterParams() {
+  const form = $("#log-filter");
+  const params = new URLSearchParams();
+  if (form.group.value) params.set("group", form.group.value.trim());
+  if (form.status.value) params.set("status", form.status.value);
+  if (form.beginTime.value) params.set("beginTime", form.beginTime.value);
+  if (form.endTime.value) params.set("endTime", form.endTime.value);
+  return params;
+}
+
 function renderLogTable(logs) {
   const body = $("#logs-table-body");
   if (!logs.length) {
-    body.innerHTML = `<tr><td colspan="5" class="empty">暂无数据</td></tr>`;
+    body.innerHTML = `<tr><td colspan="6" class="empty">暂无数据</td></tr>`;
     return;
   }
   body.innerHTML = logs
@@ -370,11 +693,33 @@ function renderLogTable(logs) {
         <td>${escapeHtml(log.group || "-")}</td>
         <td>${mask(log.deviceKey)}</td>
         <td>${log.status}</td>
+        <td>${log.status === "FAILED" ? `<button type="button" class="chip" data-resend="${log.id}">重发</button>` : "-"}</td>
       </tr>`
     )
     .join("");
 }
 
+async function resendLog(id) {
+  try {
+    const res = await api(`/api/notice/log/resend/${id}`, { method: "POST" });
+    showToast(res.status === "SUCCESS" ? "重发成功" : `重发失败：${res.message || ""}`, res.status !== "SUCCESS");
+    loadLogs(true);
+  } catch (err) {
+    showToast(err.message, true);
+  }
+}
+
+async function resendFailedLogs() {
+  if (!confirm("按当前筛选条件重发所有失败记录？")) return;
+  try {
+    const res = await api(`/api/notice/log/resend?${logFilterParams().toString()}`, { method: "POST" });
+    showToast(`重发完成：${res.successNum}/${res.sendNum}`);
+    loadLogs(true);
+  } catch (err) {
+    showToast(err.message, true);
+  }
+}
+
 function updateSnippet() {
   const form = $("#snippet-form");
   if (!form) return;
@@ -482,7 +827,7 @@ function buildLogListSnippet(params) {
 
 async function api(path, options = {}) {
   const headers = {
-    "Content-Type": "application/json",
+    ...(options.body instanceof FormData ? {} : { "Content-Type": "application/json" }),
     ...(options.headers || {}),
   };
   if (!options.skipAuth && state.token) {
@@ -493,6 +838,9 @@ async function api(path, options = {}) {
     headers,
     body: options.body,
   });
+  if (res.status === 401 && !options.skipAuth && !options.noRefresh && (await refreshSession())) {
+    return api(path, { ...options, noRefresh: true });
+  }
   let data;
   const contentType = res.headers.get("content-type") || "";
   if (contentType.includes("application/json")) {
@@ -503,7 +851,7 @@ async function api(path, options = {}) {
   if (!res.ok) {
     const message =
       typeof data === "object" && data !== null
-        ? data.error || data.message || res.statusText
+        ? data.error || data.msg || data.message || res.statusText
         : data || res.statusText;
     throw new Error(message);
   }